@@ -0,0 +1,65 @@
+package api
+
+// ElasticInfoResponse is returned by `GET /`, the handshake most ES clients (filebeat, logstash) probe first.
+type ElasticInfoResponse struct {
+	Name        string         `json:"name"`
+	ClusterName string         `json:"cluster_name"`
+	ClusterUUID string         `json:"cluster_uuid"`
+	Version     ElasticVersion `json:"version"`
+	Tagline     string         `json:"tagline"`
+}
+
+type ElasticVersion struct {
+	Number                           string `json:"number"`
+	BuildFlavor                      string `json:"build_flavor"`
+	BuildType                        string `json:"build_type"`
+	BuildHash                        string `json:"build_hash"`
+	BuildDate                        string `json:"build_date"`
+	BuildSnapshot                    bool   `json:"build_snapshot"`
+	LuceneVersion                    string `json:"lucene_version"`
+	MinimumWireCompatibilityVersion  string `json:"minimum_wire_compatibility_version"`
+	MinimumIndexCompatibilityVersion string `json:"minimum_index_compatibility_version"`
+}
+
+// ElasticBulkOp is one action (plus its source document, if any) from a `_bulk` body.
+type ElasticBulkOp struct {
+	Action string                 // index, create, update, delete
+	Index  string                 // _index from the action line, or the index from the url path
+	Id     string                 // _id from the action line (optional)
+	Doc    map[string]interface{} // source document (nil for delete)
+	Err    string                 // non-empty if this op could not be parsed
+}
+
+type ElasticBulkRequest struct {
+	Ops []ElasticBulkOp
+}
+
+type ElasticBulkResponse struct {
+	Took   int64                          `json:"took"`
+	Errors bool                           `json:"errors"`
+	Items  []map[string]ElasticItemResult `json:"items"`
+}
+
+// ElasticItemResult is both a `_bulk` per-item result and the response of a single `_doc` request.
+type ElasticItemResult struct {
+	Index       string         `json:"_index"`
+	Id          string         `json:"_id"`
+	Version     int64          `json:"_version,omitempty"`
+	Result      string         `json:"result,omitempty"`
+	Shards      *ElasticShards `json:"_shards,omitempty"`
+	SeqNo       int64          `json:"_seq_no,omitempty"`
+	PrimaryTerm int64          `json:"_primary_term,omitempty"`
+	Status      int            `json:"status"`
+	Error       *ElasticError  `json:"error,omitempty"`
+}
+
+type ElasticShards struct {
+	Total      int `json:"total"`
+	Successful int `json:"successful"`
+	Failed     int `json:"failed"`
+}
+
+type ElasticError struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
@@ -0,0 +1,35 @@
+package api
+
+// FirehoseRequest is the Kinesis Data Firehose HTTP endpoint delivery request body.
+type FirehoseRequest struct {
+	RequestId string           `json:"requestId"`
+	Timestamp int64            `json:"timestamp"` // epoch ms
+	Records   []FirehoseRecord `json:"records"`
+}
+
+type FirehoseRecord struct {
+	Data string `json:"data"` // base64, gzip compressed json for CloudWatch Logs subscriptions
+}
+
+// FirehoseResponse must echo the request id, otherwise firehose treats the delivery as failed.
+type FirehoseResponse struct {
+	RequestId    string `json:"requestId"`
+	Timestamp    int64  `json:"timestamp"`
+	ErrorMessage string `json:"errorMessage,omitempty"`
+}
+
+// CloudWatchLogsData is the payload of a CloudWatch Logs subscription filter record.
+type CloudWatchLogsData struct {
+	MessageType         string               `json:"messageType"` // DATA_MESSAGE or CONTROL_MESSAGE
+	Owner               string               `json:"owner"`
+	LogGroup            string               `json:"logGroup"`
+	LogStream           string               `json:"logStream"`
+	SubscriptionFilters []string             `json:"subscriptionFilters"`
+	LogEvents           []CloudWatchLogEvent `json:"logEvents"`
+}
+
+type CloudWatchLogEvent struct {
+	Id        string `json:"id"`
+	Timestamp int64  `json:"timestamp"` // epoch ms
+	Message   string `json:"message"`
+}
@@ -0,0 +1,7 @@
+package api
+
+// ForwardEntry is one decoded fluentd forward protocol record.
+type ForwardEntry struct {
+	Time   int64                  // epoch ms
+	Record map[string]interface{} // exp: {"log":"hello","stream":"stdout"}
+}
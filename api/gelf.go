@@ -0,0 +1,12 @@
+package api
+
+// GelfMessage is a decoded Graylog GELF 1.1 message (https://go2docs.graylog.org/current/getting_in_log_data/gelf.html).
+type GelfMessage struct {
+	Version      string
+	Host         string
+	ShortMessage string
+	FullMessage  string
+	Timestamp    float64                // epoch seconds with optional fraction, 0 if absent
+	Level        int                    // syslog severity, -1 if absent
+	Additional   map[string]interface{} // `_` prefixed fields, prefix stripped
+}
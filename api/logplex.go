@@ -0,0 +1,13 @@
+package api
+
+// LogplexLine is one octet counted RFC5424 syslog frame from an `application/logplex-1` drain.
+// exp: `83 <40>1 2012-11-30T06:45:29+00:00 host app web.3 - State changed from starting to up`
+type LogplexLine struct {
+	Priority  int    // facility*8 + severity
+	Timestamp string // RFC3339
+	Hostname  string
+	AppName   string
+	ProcId    string
+	MsgId     string
+	Message   string
+}
@@ -0,0 +1,150 @@
+// hermes-script runs a pipeline script (see the script stage) against sample events, exp:
+//
+//	hermes-script -events samples.jsonl route.star
+//	hermes-script -events samples.jsonl -expect expected.jsonl route.star
+//
+// Events are json lines, either splunk HEC style ({"event": {...}, "time": ..., "host": ...}) or just the fields.
+// Every result is printed as one json line, null for a dropped event. With -expect the results are compared with
+// the expected lines (same format) and the exit code is 1 on any difference or script error.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/xinkaiwang/hermes/internal/dao"
+	"github.com/xinkaiwang/hermes/internal/pipeline"
+)
+
+func main() {
+	eventsFile := flag.String("events", "", "json lines file with the input events, default stdin")
+	expectFile := flag.String("expect", "", "json lines file with the expected results")
+	maxSteps := flag.Uint64("max-steps", 100000, "starlark steps per event, 0 = no limit")
+	timeout := flag.Duration("timeout", 50*time.Millisecond, "time per event, 0 = no limit")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] script.star\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	source, err := os.ReadFile(flag.Arg(0))
+	if err != nil {
+		fatal(err)
+	}
+	script, err := pipeline.CompileScript(flag.Arg(0), string(source), *maxSteps, *timeout)
+	if err != nil {
+		fatal(err)
+	}
+	script.Print = func(msg string) {
+		fmt.Fprintln(os.Stderr, msg)
+	}
+
+	var input io.Reader = os.Stdin
+	if *eventsFile != "" {
+		f, err := os.Open(*eventsFile)
+		if err != nil {
+			fatal(err)
+		}
+		defer f.Close()
+		input = f
+	}
+	events, err := readEvents(input)
+	if err != nil {
+		fatal(err)
+	}
+	var expected []*dao.EventJson
+	if *expectFile != "" {
+		f, err := os.Open(*expectFile)
+		if err != nil {
+			fatal(err)
+		}
+		expected, err = readEvents(f)
+		f.Close()
+		if err != nil {
+			fatal(err)
+		}
+		if len(expected) != len(events) {
+			fatal(fmt.Errorf("%d events but %d expected results", len(events), len(expected)))
+		}
+	}
+
+	failed := 0
+	for i, eve := range events {
+		if eve == nil {
+			fatal(fmt.Errorf("event %d is null", i+1))
+		}
+		result, err := script.Run(eve)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "event %d: %v\n", i+1, err)
+			failed++
+			continue
+		}
+		line, _ := json.Marshal(result)
+		fmt.Println(string(line))
+		if expected != nil && !sameEvent(result, expected[i]) {
+			want, _ := json.Marshal(expected[i])
+			fmt.Fprintf(os.Stderr, "event %d: got  %s\nevent %d: want %s\n", i+1, line, i+1, want)
+			failed++
+		}
+	}
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "%d of %d events failed\n", failed, len(events))
+		os.Exit(1)
+	}
+}
+
+// readEvents reads json lines, null stands for a dropped event.
+func readEvents(r io.Reader) ([]*dao.EventJson, error) {
+	var events []*dao.EventJson
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var doc map[string]interface{}
+		if err := json.Unmarshal(line, &doc); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		if doc == nil {
+			events = append(events, nil)
+			continue
+		}
+		eve := &dao.EventJson{}
+		if _, ok := doc["event"].(map[string]interface{}); ok {
+			if err := json.Unmarshal(line, eve); err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+		} else {
+			eve.Event = doc
+		}
+		events = append(events, eve)
+	}
+	return events, scanner.Err()
+}
+
+// sameEvent compares as json, so that exp: 200 and 200.0 are equal.
+func sameEvent(a *dao.EventJson, b *dao.EventJson) bool {
+	var docA, docB interface{}
+	dataA, _ := json.Marshal(a)
+	dataB, _ := json.Marshal(b)
+	json.Unmarshal(dataA, &docA)
+	json.Unmarshal(dataB, &docB)
+	return reflect.DeepEqual(docA, docB)
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
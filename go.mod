@@ -2,25 +2,32 @@ module github.com/xinkaiwang/hermes
 
 go 1.23.2
 
-require github.com/xinkaiwang/shardmanager/libs/xklib v0.0.0-20250613012226-637496e97731
+require (
+	contrib.go.opencensus.io/exporter/prometheus v0.4.2
+	github.com/golang/snappy v0.0.4
+	github.com/segmentio/kafka-go v0.4.47
+	github.com/xinkaiwang/shardmanager/libs/xklib v0.0.0-20250613012226-637496e97731
+	go.opencensus.io v0.24.0
+	go.starlark.net v0.0.0-20231121155337-90ade8b19d09
+	google.golang.org/protobuf v1.28.1
+)
 
 require (
-	contrib.go.opencensus.io/exporter/prometheus v0.4.2 // indirect
 	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/cespare/xxhash/v2 v2.1.2 // indirect
 	github.com/go-kit/log v0.2.1 // indirect
 	github.com/go-logfmt/logfmt v0.5.1 // indirect
 	github.com/golang/groupcache v0.0.0-20210331224755-41bb18bfe9da // indirect
 	github.com/golang/protobuf v1.5.2 // indirect
+	github.com/klauspost/compress v1.15.9 // indirect
 	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/pierrec/lz4/v4 v4.1.15 // indirect
 	github.com/prometheus/client_golang v1.13.0 // indirect
 	github.com/prometheus/client_model v0.2.0 // indirect
 	github.com/prometheus/common v0.37.0 // indirect
 	github.com/prometheus/procfs v0.8.0 // indirect
 	github.com/prometheus/statsd_exporter v0.22.7 // indirect
 	github.com/sirupsen/logrus v1.9.3 // indirect
-	go.opencensus.io v0.24.0 // indirect
-	golang.org/x/sys v0.0.0-20220715151400-c0bba94af5f8 // indirect
-	google.golang.org/protobuf v1.28.1 // indirect
+	golang.org/x/sys v0.13.0 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
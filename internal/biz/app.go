@@ -2,24 +2,50 @@ package biz
 
 import (
 	"context"
-	"strconv"
 	"time"
 
 	"github.com/xinkaiwang/hermes/api"
 	"github.com/xinkaiwang/hermes/internal/common"
 	"github.com/xinkaiwang/hermes/internal/dao"
+	"github.com/xinkaiwang/hermes/internal/pipeline"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kcommon"
 )
 
 type App struct {
 	ctx           context.Context
 	batchUploader *dao.BatchUploader
+	esIndexMapper *ElasticIndexMapper
+	logplexDrains *LogplexDrains
+	kafkaDecoder  *KafkaDecoder
+	pipeline      *pipeline.Pipeline
+	forwardIndex  string // FORWARD_INDEX
+	gelfIndex     string // GELF_INDEX
+	beatsIndex    string // LUMBERJACK_INDEX
+	firehoseIndex string // FIREHOSE_INDEX
 }
 
 func NewApp(ctx context.Context) *App {
-	return &App{
+	app := &App{
 		ctx:           ctx,
 		batchUploader: dao.NewBatchUploader(ctx),
+		esIndexMapper: NewElasticIndexMapperFromEnv(ctx),
+		logplexDrains: NewLogplexDrainsFromEnv(ctx),
+		kafkaDecoder:  NewKafkaDecoderFromEnv(ctx),
+		forwardIndex:  kcommon.GetEnvString("FORWARD_INDEX", "main"),
+		gelfIndex:     kcommon.GetEnvString("GELF_INDEX", "main"),
+		beatsIndex:    kcommon.GetEnvString("LUMBERJACK_INDEX", "main"),
+		firehoseIndex: kcommon.GetEnvString("FIREHOSE_INDEX", "main"),
 	}
+	app.pipeline = pipeline.NewPipelineFromEnv(ctx, func(eve *dao.EventJson) {
+		app.batchUploader.ChEvents <- eve
+	})
+	return app
+}
+
+// Close delivers the events accepted so far and closes the outputs, call it once the inputs are shut down.
+func (a *App) Close() {
+	a.pipeline.Close()
+	a.batchUploader.Close()
 }
 
 func (a *App) Ping(ctx context.Context) api.PingResponse {
@@ -56,32 +82,23 @@ func (a *App) Post(ctx context.Context, req api.PostRequest, remoteAddr string)
 		} else {
 			eve.Index = "main"
 		}
-		a.batchUploader.ChEvents <- eve
+		a.enqueue("post", eve)
 	}
 	return api.PostResponse{
 		Count: len(req.Events),
 	}
 }
 
-func parseTime(timeVal interface{}) int64 {
-	if timeVal == nil {
-		return time.Now().UnixMilli()
-	}
-	if timeStr, ok := timeVal.(string); ok {
-		// try to parse to int64
-		int64Val, err := strconv.ParseInt(timeStr, 10, 64)
-		if err == nil {
-			return int64Val
-		}
+// enqueue hands a fully populated event to the pipeline and then the batch uploader; every input ends up here.
+// input names the input (exp: post, gelf, kafka) for per input pipelines.
+func (a *App) enqueue(input string, eve *dao.EventJson) {
+	a.pipeline.Process(input, eve)
+}
 
-		// try to parse to time.Time
-		t, err := time.Parse(time.RFC3339, timeStr)
-		if err == nil {
-			return t.UnixMilli()
-		}
-	}
-	if int64Val, ok := timeVal.(int64); ok {
-		return int64Val
+func parseTime(timeVal interface{}) int64 {
+	// numbers (float64 from encoding/json) or numeric strings are epoch s/ms/us/ns, strings are RFC3339 and friends
+	if t, ok := pipeline.ParseTimestamp(timeVal, nil, nil); ok {
+		return t.UnixMilli()
 	}
 	return time.Now().UnixMilli()
 }
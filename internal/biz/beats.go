@@ -0,0 +1,54 @@
+package biz
+
+import (
+	"context"
+
+	"github.com/xinkaiwang/hermes/internal/dao"
+)
+
+// Beats enqueues events received over lumberjack. The beat name (exp: filebeat) becomes the sourcetype and the
+// harvested file path, if any, the source. `@metadata` is dropped the same way logstash does. ack is called once for
+// every event, when the outputs accepted it (or failed).
+func (a *App) Beats(ctx context.Context, events []map[string]interface{}, remoteAddr string, ack func(err error)) int {
+	for _, doc := range events {
+		beat := "beats"
+		if metadata, ok := doc["@metadata"].(map[string]interface{}); ok {
+			if name, ok := metadata["beat"].(string); ok && name != "" {
+				beat = name
+			}
+			delete(doc, "@metadata")
+		}
+		eve := &dao.EventJson{
+			Event:      doc,
+			Host:       elasticHost(doc, remoteAddr),
+			Source:     beatsSource(doc, beat),
+			SourceType: beat,
+			Index:      a.beatsIndex,
+		}
+		if ts, ok := doc["@timestamp"]; ok {
+			eve.Time = parseTime(ts)
+		} else {
+			eve.Time = parseTime(doc["time"])
+		}
+		eve.Ack = ack
+		a.enqueue("beats", eve)
+	}
+	return len(events)
+}
+
+// beatsSource prefers filebeat's `log.file.path`, then winlogbeat's `winlog.channel`.
+func beatsSource(doc map[string]interface{}, beat string) string {
+	if log, ok := doc["log"].(map[string]interface{}); ok {
+		if file, ok := log["file"].(map[string]interface{}); ok {
+			if path, ok := file["path"].(string); ok && path != "" {
+				return path
+			}
+		}
+	}
+	if winlog, ok := doc["winlog"].(map[string]interface{}); ok {
+		if channel, ok := winlog["channel"].(string); ok && channel != "" {
+			return channel
+		}
+	}
+	return beat
+}
@@ -0,0 +1,177 @@
+package biz
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xinkaiwang/hermes/api"
+	"github.com/xinkaiwang/hermes/internal/common"
+	"github.com/xinkaiwang/hermes/internal/dao"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kcommon"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/klogging"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kmetrics"
+)
+
+var (
+	ElasticItemsMetric = kmetrics.CreateKmetric(context.Background(), "elastic_bulk_items", "desc", []string{"action", "status"})
+)
+
+// ElasticIndexRule maps ES index names matching Pattern (path.Match syntax, exp: filebeat-*) to a splunk index.
+type ElasticIndexRule struct {
+	Pattern     string
+	SplunkIndex string
+}
+
+type ElasticIndexMapper struct {
+	rules        []ElasticIndexRule
+	defaultIndex string
+}
+
+// NewElasticIndexMapperFromEnv reads ES_INDEX_RULES (exp: "filebeat-*=main,logs-app-*=app") and ES_DEFAULT_INDEX.
+// Rules are evaluated in order, first match wins.
+func NewElasticIndexMapperFromEnv(ctx context.Context) *ElasticIndexMapper {
+	mapper := &ElasticIndexMapper{
+		defaultIndex: kcommon.GetEnvString("ES_DEFAULT_INDEX", "main"),
+	}
+	for _, item := range strings.Split(kcommon.GetEnvString("ES_INDEX_RULES", ""), ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		pattern, index, found := strings.Cut(item, "=")
+		if !found || pattern == "" || index == "" {
+			klogging.Error(ctx).With("rule", item).Log("ElasticIndexRuleInvalid", "ignored, expect <pattern>=<index>")
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			klogging.Error(ctx).With("rule", item).With("error", err.Error()).Log("ElasticIndexRuleInvalid", "ignored, bad pattern")
+			continue
+		}
+		mapper.rules = append(mapper.rules, ElasticIndexRule{Pattern: strings.TrimSpace(pattern), SplunkIndex: strings.TrimSpace(index)})
+	}
+	klogging.Info(ctx).With("rules", mapper.rules).With("defaultIndex", mapper.defaultIndex).Log("ElasticIndexMapper", "loaded")
+	return mapper
+}
+
+func (m *ElasticIndexMapper) Map(esIndex string) string {
+	for _, rule := range m.rules {
+		if ok, _ := path.Match(rule.Pattern, esIndex); ok {
+			return rule.SplunkIndex
+		}
+	}
+	return m.defaultIndex
+}
+
+func (a *App) ElasticInfo(ctx context.Context) api.ElasticInfoResponse {
+	return api.ElasticInfoResponse{
+		Name:        "hermes",
+		ClusterName: "hermes",
+		ClusterUUID: "hermes",
+		Version: api.ElasticVersion{
+			Number:                           kcommon.GetEnvString("ES_COMPAT_VERSION", "8.11.0"),
+			BuildFlavor:                      "default",
+			BuildType:                        "docker",
+			BuildHash:                        common.GetGitCommit(),
+			BuildDate:                        common.GetBuildTime(),
+			LuceneVersion:                    "9.8.0",
+			MinimumWireCompatibilityVersion:  "7.17.0",
+			MinimumIndexCompatibilityVersion: "7.0.0",
+		},
+		Tagline: "You Know, for Search",
+	}
+}
+
+// Bulk accepts index/create actions; update/delete are answered with a per-item error since hermes only appends.
+func (a *App) Bulk(ctx context.Context, req api.ElasticBulkRequest, remoteAddr string) api.ElasticBulkResponse {
+	startTime := time.Now()
+	resp := api.ElasticBulkResponse{
+		Items: make([]map[string]api.ElasticItemResult, 0, len(req.Ops)),
+	}
+	for _, op := range req.Ops {
+		item := a.bulkOne(ctx, op, remoteAddr)
+		if item.Error != nil {
+			resp.Errors = true
+		}
+		ElasticItemsMetric.GetTimeSequence(ctx, op.Action, strconv.Itoa(item.Status)).Add(1)
+		resp.Items = append(resp.Items, map[string]api.ElasticItemResult{op.Action: item})
+	}
+	resp.Took = time.Since(startTime).Milliseconds()
+	return resp
+}
+
+func (a *App) bulkOne(ctx context.Context, op api.ElasticBulkOp, remoteAddr string) api.ElasticItemResult {
+	item := api.ElasticItemResult{
+		Index: op.Index,
+		Id:    op.Id,
+	}
+	if op.Err != "" {
+		item.Status = http.StatusBadRequest
+		item.Error = &api.ElasticError{Type: "illegal_argument_exception", Reason: op.Err}
+		return item
+	}
+	if op.Action != "index" && op.Action != "create" {
+		item.Status = http.StatusBadRequest
+		item.Error = &api.ElasticError{Type: "action_request_validation_exception", Reason: "hermes only supports index and create actions, got " + op.Action}
+		return item
+	}
+	return a.ElasticIndex(ctx, op.Index, op.Id, op.Doc, remoteAddr)
+}
+
+// ElasticIndex handles a single document, either from `_bulk` or from `/<index>/_doc`.
+func (a *App) ElasticIndex(ctx context.Context, esIndex string, id string, doc map[string]interface{}, remoteAddr string) api.ElasticItemResult {
+	if id == "" {
+		id = newElasticId()
+	}
+	eve := &dao.EventJson{
+		Event:      doc,
+		Host:       elasticHost(doc, remoteAddr),
+		Source:     esIndex,
+		SourceType: "json",
+		Index:      a.esIndexMapper.Map(esIndex),
+	}
+	if ts, ok := doc["@timestamp"]; ok {
+		eve.Time = parseTime(ts)
+	} else {
+		eve.Time = parseTime(doc["time"])
+	}
+	a.enqueue("elastic", eve)
+	return api.ElasticItemResult{
+		Index:       esIndex,
+		Id:          id,
+		Version:     1,
+		Result:      "created",
+		Shards:      &api.ElasticShards{Total: 1, Successful: 1},
+		PrimaryTerm: 1,
+		Status:      http.StatusCreated,
+	}
+}
+
+// elasticHost prefers the beats style `host.name`, then a plain `host` string, then the peer address.
+func elasticHost(doc map[string]interface{}, remoteAddr string) string {
+	switch host := doc["host"].(type) {
+	case string:
+		if host != "" {
+			return host
+		}
+	case map[string]interface{}:
+		if name, ok := host["name"].(string); ok && name != "" {
+			return name
+		}
+		if name, ok := host["hostname"].(string); ok && name != "" {
+			return name
+		}
+	}
+	return remoteAddr
+}
+
+func newElasticId() string {
+	buf := make([]byte, 15)
+	rand.Read(buf)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
@@ -0,0 +1,108 @@
+package biz
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+
+	"github.com/xinkaiwang/hermes/api"
+	"github.com/xinkaiwang/hermes/internal/dao"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kerror"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/klogging"
+)
+
+const (
+	firehoseMaxRecordBytes = 64 * 1024 * 1024 // guard for decompressed CloudWatch Logs payloads
+)
+
+// Firehose decodes every record first and only enqueues once the whole request is valid, so that a rejected
+// request can be retried by firehose without duplicating its first records. attributes are the
+// X-Amz-Firehose-Common-Attributes, added to every event.
+func (a *App) Firehose(ctx context.Context, req api.FirehoseRequest, attributes map[string]string, remoteAddr string) int {
+	index := a.firehoseIndex
+	var events []*dao.EventJson
+	for i, record := range req.Records {
+		data, err := base64.StdEncoding.DecodeString(record.Data)
+		if err != nil {
+			panic(kerror.Wrap(err, "FirehoseInvalidRecord", "record data is not base64", false).With("record", i))
+		}
+		if len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b {
+			events = append(events, cloudWatchLogsEvents(ctx, gunzip(data), index)...)
+			continue
+		}
+		eve := &dao.EventJson{
+			Host:       remoteAddr,
+			Source:     "firehose",
+			SourceType: "aws:firehose",
+			Index:      index,
+		}
+		var doc map[string]interface{}
+		if err := json.Unmarshal(data, &doc); err == nil && doc != nil {
+			eve.Event = doc
+			eve.Time = parseTime(doc["time"])
+		} else {
+			eve.Event = map[string]interface{}{"message": string(bytes.TrimRight(data, "\n"))}
+			eve.Time = req.Timestamp
+		}
+		events = append(events, eve)
+	}
+	for _, eve := range events {
+		for k, v := range attributes {
+			if _, ok := eve.Event[k]; !ok {
+				eve.Event[k] = v
+			}
+		}
+		a.enqueue("firehose", eve)
+	}
+	return len(events)
+}
+
+// cloudWatchLogsEvents unpacks a subscription filter payload into one event per log event.
+func cloudWatchLogsEvents(ctx context.Context, data []byte, index string) []*dao.EventJson {
+	var payload api.CloudWatchLogsData
+	if err := json.Unmarshal(data, &payload); err != nil {
+		panic(kerror.Wrap(err, "FirehoseInvalidRecord", "gzip record is not a CloudWatch Logs payload", false))
+	}
+	if payload.MessageType != "DATA_MESSAGE" {
+		// CONTROL_MESSAGE is sent by CloudWatch Logs to check the destination is reachable
+		klogging.Verbose(ctx).With("messageType", payload.MessageType).Log("FirehoseControlMessage", "skipped")
+		return nil
+	}
+	events := make([]*dao.EventJson, 0, len(payload.LogEvents))
+	for _, logEvent := range payload.LogEvents {
+		events = append(events, &dao.EventJson{
+			Event: map[string]interface{}{
+				"message":    logEvent.Message,
+				"id":         logEvent.Id,
+				"log_group":  payload.LogGroup,
+				"log_stream": payload.LogStream,
+				"owner":      payload.Owner,
+			},
+			Time:       logEvent.Timestamp,
+			Host:       payload.LogStream,
+			Source:     payload.LogGroup,
+			SourceType: "aws:cloudwatchlogs",
+			Index:      index,
+		})
+	}
+	return events
+}
+
+func gunzip(data []byte) []byte {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		panic(kerror.Wrap(err, "FirehoseInvalidRecord", "bad gzip record", false))
+	}
+	defer gz.Close()
+	out, err := io.ReadAll(io.LimitReader(gz, firehoseMaxRecordBytes+1))
+	if err != nil {
+		panic(kerror.Wrap(err, "FirehoseInvalidRecord", "bad gzip record", false))
+	}
+	if len(out) > firehoseMaxRecordBytes {
+		panic(kerror.Create("FirehoseInvalidRecord", "decompressed record too large"))
+	}
+	return out
+}
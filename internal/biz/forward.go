@@ -0,0 +1,29 @@
+package biz
+
+import (
+	"context"
+
+	"github.com/xinkaiwang/hermes/api"
+	"github.com/xinkaiwang/hermes/internal/dao"
+)
+
+// Forward enqueues records received over the fluentd forward protocol. The fluentd tag becomes the splunk source.
+func (a *App) Forward(ctx context.Context, tag string, entries []api.ForwardEntry, remoteAddr string) int {
+	for _, entry := range entries {
+		eve := &dao.EventJson{
+			Event:      entry.Record,
+			Time:       entry.Time,
+			Host:       remoteAddr,
+			Source:     tag,
+			SourceType: "fluentd",
+			Index:      a.forwardIndex,
+		}
+		if host, ok := entry.Record["host"].(string); ok && host != "" {
+			eve.Host = host
+		} else if host, ok := entry.Record["hostname"].(string); ok && host != "" {
+			eve.Host = host
+		}
+		a.enqueue("forward", eve)
+	}
+	return len(entries)
+}
@@ -0,0 +1,45 @@
+package biz
+
+import (
+	"context"
+	"time"
+
+	"github.com/xinkaiwang/hermes/api"
+	"github.com/xinkaiwang/hermes/internal/dao"
+)
+
+var gelfSeverityNames = []string{"emergency", "alert", "critical", "error", "warning", "notice", "info", "debug"}
+
+// Gelf maps a GELF message into an event: short_message becomes `message`, additional fields are merged at the top level.
+func (a *App) Gelf(ctx context.Context, msg api.GelfMessage, remoteAddr string) {
+	event := make(map[string]interface{}, len(msg.Additional)+4)
+	for k, v := range msg.Additional {
+		event[k] = v
+	}
+	event["message"] = msg.ShortMessage
+	if msg.FullMessage != "" {
+		event["full_message"] = msg.FullMessage
+	}
+	if msg.Level >= 0 {
+		event["level"] = msg.Level
+		if msg.Level < len(gelfSeverityNames) {
+			event["severity"] = gelfSeverityNames[msg.Level]
+		}
+	}
+	eve := &dao.EventJson{
+		Event:      event,
+		Host:       msg.Host,
+		Source:     "gelf",
+		SourceType: "gelf",
+		Index:      a.gelfIndex,
+	}
+	if eve.Host == "" {
+		eve.Host = remoteAddr
+	}
+	if msg.Timestamp > 0 {
+		eve.Time = int64(msg.Timestamp * 1000)
+	} else {
+		eve.Time = time.Now().UnixMilli()
+	}
+	a.enqueue("gelf", eve)
+}
@@ -0,0 +1,116 @@
+package biz
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/xinkaiwang/hermes/internal/dao"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kcommon"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kerror"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/klogging"
+)
+
+const (
+	KafkaFormatJson    = "json"    // record value is a json object, used as the event
+	KafkaFormatText    = "text"    // record value is a raw line, sent as {"message": <value>}
+	KafkaFormatMapping = "mapping" // json, with metadata taken from fields named by KAFKA_FIELD_MAPPING
+)
+
+// KafkaDecoder turns kafka records into events according to KAFKA_FORMAT.
+type KafkaDecoder struct {
+	format  string
+	index   string
+	mapping map[string]string // EventJson field (time, host, source, sourcetype, index) => event field
+}
+
+// NewKafkaDecoderFromEnv reads KAFKA_FORMAT, KAFKA_INDEX and KAFKA_FIELD_MAPPING
+// (exp: "time=@timestamp,host=hostname,index=splunk_index").
+func NewKafkaDecoderFromEnv(ctx context.Context) *KafkaDecoder {
+	decoder := &KafkaDecoder{
+		format:  kcommon.GetEnvString("KAFKA_FORMAT", KafkaFormatJson),
+		index:   kcommon.GetEnvString("KAFKA_INDEX", "main"),
+		mapping: make(map[string]string),
+	}
+	switch decoder.format {
+	case KafkaFormatJson, KafkaFormatText, KafkaFormatMapping:
+	default:
+		panic(kerror.Create("KafkaFormatInvalid", "KAFKA_FORMAT must be json, text or mapping").With("format", decoder.format))
+	}
+	for _, item := range strings.Split(kcommon.GetEnvString("KAFKA_FIELD_MAPPING", ""), ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		target, field, found := strings.Cut(item, "=")
+		switch target {
+		case "time", "host", "source", "sourcetype", "index":
+		default:
+			found = false
+		}
+		if !found || field == "" {
+			panic(kerror.Create("KafkaFieldMappingInvalid", "expect <time|host|source|sourcetype|index>=<field>").With("item", item))
+		}
+		decoder.mapping[target] = field
+	}
+	klogging.Info(ctx).With("format", decoder.format).With("index", decoder.index).With("mapping", decoder.mapping).Log("KafkaDecoder", "loaded")
+	return decoder
+}
+
+// Decode never fails: a value that is not a json object is sent as text.
+func (d *KafkaDecoder) Decode(topic string, value []byte) *dao.EventJson {
+	eve := &dao.EventJson{
+		Source:     topic,
+		SourceType: d.format,
+		Index:      d.index,
+	}
+	var doc map[string]interface{}
+	if d.format != KafkaFormatText {
+		if err := json.Unmarshal(value, &doc); err != nil || doc == nil {
+			doc = nil
+		}
+	}
+	if doc == nil {
+		eve.Event = map[string]interface{}{"message": string(value)}
+		eve.SourceType = KafkaFormatText
+		eve.Time = parseTime(nil)
+		return eve
+	}
+	eve.Event = doc
+	eve.SourceType = "json"
+	eve.Time = parseTime(doc["time"])
+	if d.format != KafkaFormatMapping {
+		return eve
+	}
+	if field, ok := d.mapping["time"]; ok {
+		eve.Time = parseTime(doc[field])
+	}
+	if str := mappedString(doc, d.mapping["host"]); str != "" {
+		eve.Host = str
+	}
+	if str := mappedString(doc, d.mapping["source"]); str != "" {
+		eve.Source = str
+	}
+	if str := mappedString(doc, d.mapping["sourcetype"]); str != "" {
+		eve.SourceType = str
+	}
+	if str := mappedString(doc, d.mapping["index"]); str != "" {
+		eve.Index = str
+	}
+	return eve
+}
+
+func mappedString(doc map[string]interface{}, field string) string {
+	if field == "" {
+		return ""
+	}
+	str, _ := doc[field].(string)
+	return str
+}
+
+// Kafka enqueues one record. ack is called once the record's batch has been uploaded or has failed.
+func (a *App) Kafka(ctx context.Context, topic string, value []byte, ack func(err error)) {
+	eve := a.kafkaDecoder.Decode(topic, value)
+	eve.Ack = ack
+	a.enqueue("kafka", eve)
+}
@@ -0,0 +1,128 @@
+package biz
+
+import (
+	"container/list"
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xinkaiwang/hermes/api"
+	"github.com/xinkaiwang/hermes/internal/dao"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kcommon"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/klogging"
+)
+
+// LogplexDrains holds the drain token => splunk index table and the recently seen frame ids of each drain.
+type LogplexDrains struct {
+	indexByToken map[string]string
+	frames       *frameIdCache
+}
+
+// NewLogplexDrainsFromEnv reads LOGPLEX_DRAINS (exp: "d.0b1c-...=heroku,d.77aa-...=main").
+// With no drains configured every request is rejected.
+func NewLogplexDrainsFromEnv(ctx context.Context) *LogplexDrains {
+	drains := &LogplexDrains{
+		indexByToken: make(map[string]string),
+		frames: newFrameIdCache(
+			kcommon.GetEnvInt("LOGPLEX_DEDUP_CAPACITY", 100000),
+			time.Duration(kcommon.GetEnvInt("LOGPLEX_DEDUP_TTL_SEC", 600))*time.Second,
+		),
+	}
+	for _, item := range strings.Split(kcommon.GetEnvString("LOGPLEX_DRAINS", ""), ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		token, index, found := strings.Cut(item, "=")
+		if !found || token == "" || index == "" {
+			klogging.Error(ctx).Log("LogplexDrainInvalid", "ignored, expect <token>=<index>")
+			continue
+		}
+		drains.indexByToken[token] = index
+	}
+	klogging.Info(ctx).With("drains", len(drains.indexByToken)).Log("LogplexDrains", "loaded")
+	return drains
+}
+
+// LogplexDrainIndex returns the splunk index configured for the drain token.
+func (a *App) LogplexDrainIndex(token string) (string, bool) {
+	index, ok := a.logplexDrains.indexByToken[token]
+	return index, ok
+}
+
+// Logplex enqueues the lines of one drain request. A frame id seen from the same drain within LOGPLEX_DEDUP_TTL_SEC
+// is a logplex retry and is acknowledged without enqueuing again. Frame ids are only unique per drain.
+func (a *App) Logplex(ctx context.Context, token string, index string, frameId string, lines []api.LogplexLine, remoteAddr string) api.PostResponse {
+	if frameId != "" && !a.logplexDrains.frames.Add(token+"\x00"+frameId, time.Now()) {
+		klogging.Info(ctx).With("frameId", frameId).Log("LogplexDuplicateFrame", "skipped")
+		return api.PostResponse{Count: 0}
+	}
+	for _, line := range lines {
+		event := map[string]interface{}{
+			"message":  line.Message,
+			"app":      line.AppName,
+			"proc_id":  line.ProcId,
+			"facility": line.Priority / 8,
+			"severity": line.Priority % 8,
+		}
+		if line.MsgId != "" && line.MsgId != "-" {
+			event["msg_id"] = line.MsgId
+		}
+		eve := &dao.EventJson{
+			Event:      event,
+			Time:       parseTime(line.Timestamp),
+			Host:       line.Hostname,
+			Source:     line.AppName,
+			SourceType: "logplex",
+			Index:      index,
+		}
+		if eve.Host == "" || eve.Host == "-" {
+			eve.Host = remoteAddr
+		}
+		a.enqueue("logplex", eve)
+	}
+	return api.PostResponse{Count: len(lines)}
+}
+
+// frameIdCache remembers ids for ttl, evicting the oldest once capacity is reached.
+type frameIdCache struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	order    *list.List // of frameIdEntry, oldest first
+	index    map[string]*list.Element
+}
+
+type frameIdEntry struct {
+	id     string
+	seenAt time.Time
+}
+
+func newFrameIdCache(capacity int, ttl time.Duration) *frameIdCache {
+	return &frameIdCache{
+		capacity: capacity,
+		ttl:      ttl,
+		order:    list.New(),
+		index:    make(map[string]*list.Element),
+	}
+}
+
+// Add returns false if id was already seen within ttl.
+func (c *frameIdCache) Add(id string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for front := c.order.Front(); front != nil; front = c.order.Front() {
+		entry := front.Value.(frameIdEntry)
+		if now.Sub(entry.seenAt) < c.ttl && c.order.Len() < c.capacity {
+			break
+		}
+		c.order.Remove(front)
+		delete(c.index, entry.id)
+	}
+	if _, ok := c.index[id]; ok {
+		return false
+	}
+	c.index[id] = c.order.PushBack(frameIdEntry{id: id, seenAt: now})
+	return true
+}
@@ -1,37 +1,30 @@
 package dao
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
-	"fmt"
-	"io"
-	"net/http"
-	"strings"
 	"time"
 
 	"github.com/xinkaiwang/shardmanager/libs/xklib/kcommon"
 	"github.com/xinkaiwang/shardmanager/libs/xklib/kerror"
 	"github.com/xinkaiwang/shardmanager/libs/xklib/klogging"
-	"github.com/xinkaiwang/shardmanager/libs/xklib/kmetrics"
-)
-
-var (
-	UploadBytesMetric     = kmetrics.CreateKmetric(context.Background(), "splunk_upload_bytes", "desc", []string{})
-	UploadElapsedMsMetric = kmetrics.CreateKmetric(context.Background(), "splunk_upload_elapsed_ms", "desc", []string{})
 )
 
 type BatchUploader struct {
 	ctx      context.Context
-	ChEvents chan *EventJson
-	client   *http.Client
+	ChEvents chan *EventJson // a nil event stops the uploader, see Close
+	sinks    []Sink
+	retry    sinkRetry
+	stopped  chan struct{}
 }
 
 func NewBatchUploader(ctx context.Context) *BatchUploader {
 	bu := &BatchUploader{
 		ctx:      ctx,
 		ChEvents: make(chan *EventJson, 1000),
-		client:   &http.Client{},
+		sinks:    NewSinksFromEnv(ctx),
+		retry:    newSinkRetryFromEnv(),
+		stopped:  make(chan struct{}),
 	}
 	go bu.Start()
 	return bu
@@ -45,9 +38,10 @@ func (b *BatchUploader) Start() {
 		maxDelayMs = 1
 	}
 	klogging.Info(b.ctx).With("maxCount", maxCount).With("maxSize", maxSize).With("maxDelayMs", maxDelayMs).Log("BatchUploader", "Start")
+	defer close(b.stopped)
 	stop := false
-	var sb strings.Builder
-	batchSize := 0
+	batchBytes := 0
+	var batch []*EventJson
 	for !stop {
 		// forever loop
 		// 1. if chan not empty, append to payload
@@ -55,79 +49,72 @@ func (b *BatchUploader) Start() {
 
 		select {
 		case eve := <-b.ChEvents:
-			klogging.Info(b.ctx).With("eve", eve).With("batchSize", batchSize).With("sb", sb.String()).Log("BatchUploader", "Step2")
 			if eve == nil {
 				stop = true
+				if len(batch) > 0 {
+					b.flush(batch)
+				}
+				b.closeSinks()
 				break
 			}
-			if batchSize > 0 {
-				sb.WriteString("\n")
-			}
-			batchSize++
 			jsonData, err := json.Marshal(eve)
 			if err != nil {
+				// exp: NaN from a custom input, fail just this event instead of the uploader
 				ke := kerror.Wrap(err, "MarshallingFailed", "", false)
-				panic(ke)
-			}
-			sb.WriteString(string(jsonData))
-			klogging.Info(b.ctx).With("eve", eve).With("batchSize", batchSize).With("sb", sb.String()).Log("BatchUploader", "Step2.1")
-			if sb.Len() >= maxSize {
-				b.Upload(sb.String(), batchSize)
-				sb.Reset()
-				batchSize = 0
+				klogging.Error(b.ctx).WithError(ke).With("source", eve.Source).Log("BatchUploader", "event dropped")
+				if eve.Ack != nil {
+					eve.Ack(ke)
+				}
+				continue
 			}
-			if batchSize >= maxCount {
-				b.Upload(sb.String(), batchSize)
-				sb.Reset()
-				batchSize = 0
+			batch = append(batch, eve)
+			batchBytes += len(jsonData) + 1
+			if batchBytes >= maxSize || len(batch) >= maxCount {
+				b.flush(batch)
+				batchBytes = 0
+				batch = nil
 			}
 		case <-time.After(time.Duration(maxDelayMs) * time.Millisecond):
-			// klogging.Debug(b.ctx).With("batchSize", batchSize).Log("BatchUploader", "Step3")
-			if batchSize > 0 {
-				b.Upload(sb.String(), batchSize)
-				sb.Reset()
-				batchSize = 0
+			// klogging.Debug(b.ctx).With("batchSize", len(batch)).Log("BatchUploader", "Step3")
+			if len(batch) > 0 {
+				b.flush(batch)
+				batchBytes = 0
+				batch = nil
 			}
 		}
 	}
 }
 
-func (b *BatchUploader) Upload(payload string, count int) string { // count is the number of events in the payload, for metrics/logging purpose only
-	size := len(payload)
-	startTimeMs := kcommon.GetMonoTimeMs()
-	klogging.Debug(b.ctx).WithDebug("payload", payload).With("count", count).Log("Upload", "started")
-	// prepare data
-	url := fmt.Sprintf("%s/services/collector/event", GetSplunkEndpoint())
-	token := GetSplunkToken()
-
-	// prepare request
-	request, err := http.NewRequest("POST", url, bytes.NewBuffer([]byte(payload)))
-	if err != nil {
-		ke := kerror.Wrap(err, "NewRequestFailed", "", false)
-		panic(ke)
-	}
-	request.Header.Set("Authorization", fmt.Sprintf("Splunk %s", token))
-	request.Header.Set("Content-Type", "application/json")
-
-	// send request
-	response, err := b.client.Do(request)
-	if err != nil {
-		ke := kerror.Wrap(err, "SendRequestFailed", "", false)
-		panic(ke)
-	}
-	defer response.Body.Close()
+// Close flushes the events queued so far, then closes the sinks. No events may be queued after Close.
+func (b *BatchUploader) Close() {
+	b.ChEvents <- nil
+	<-b.stopped
+}
 
-	// Read response body for debugging
-	if response.StatusCode != 200 {
-		body, readErr := io.ReadAll(response.Body)
-		if readErr == nil {
-			fmt.Printf("Splunk error response: %s\n", string(body))
+func (b *BatchUploader) closeSinks() {
+	for _, sink := range b.sinks {
+		var err error
+		ke := kcommon.TryCatchRun(b.ctx, func() {
+			err = sink.Close()
+		})
+		if ke != nil {
+			err = ke
+		}
+		if err != nil {
+			klogging.Error(b.ctx).With("sink", sink.Name()).With("error", err.Error()).Log("SinkCloseFailed", "")
 		}
 	}
+}
 
-	elapsedMs := kcommon.GetMonoTimeMs() - startTimeMs
-	UploadBytesMetric.GetTimeSequence(b.ctx).Add(int64(size))
-	UploadElapsedMsMetric.GetTimeSequence(b.ctx).Add(int64(elapsedMs))
-	klogging.Info(b.ctx).With("response", response.Status).With("size", size).With("elapsedMs", elapsedMs).With("count", count).Log("Upload", "Completed")
-	return response.Status
+// flush delivers one batch to every sink (with retries) and acks its events, once buffering sinks stored them as
+// well. Failures are reported through Ack instead of crashing the uploader goroutine.
+func (b *BatchUploader) flush(batch []*EventJson) {
+	acks := newAckGroup(func(err error) {
+		for _, eve := range batch {
+			if eve.Ack != nil {
+				eve.Ack(err)
+			}
+		}
+	})
+	acks.release(b.retry.sendAll(b.ctx, b.sinks, batch, acks))
 }
@@ -0,0 +1,183 @@
+package dao
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kcommon"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kerror"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/klogging"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kmetrics"
+)
+
+var (
+	ClickHouseInsertErrorsMetric = kmetrics.CreateKmetric(context.Background(), "clickhouse_insert_errors", "desc", []string{"code"})
+)
+
+const (
+	ClickHouseEventJson   = "json"   // event as object, for a JSON column
+	ClickHouseEventMap    = "map"    // top level fields as strings, for a Map(String, String) column
+	ClickHouseEventString = "string" // event json text, for a String column
+)
+
+// ClickHouseSink inserts batches through the ClickHouse HTTP interface (INSERT ... FORMAT JSONEachRow), one row per
+// event with columns timestamp, host, source, sourcetype, index and event. A failed insert fails the whole batch,
+// which is retried by the sink retry policy.
+type ClickHouseSink struct {
+	ctx       context.Context
+	client    *http.Client
+	url       string // endpoint with query and settings
+	username  string
+	password  string
+	eventMode string
+}
+
+// NewClickHouseSinkFromEnv reads CLICKHOUSE_ENDPOINT, CLICKHOUSE_DATABASE, CLICKHOUSE_TABLE,
+// CLICKHOUSE_USERNAME/CLICKHOUSE_PASSWORD, CLICKHOUSE_EVENT_COLUMN, CLICKHOUSE_ASYNC_INSERT and
+// CLICKHOUSE_WAIT_FOR_ASYNC_INSERT.
+func NewClickHouseSinkFromEnv(ctx context.Context) *ClickHouseSink {
+	endpoint := strings.TrimSuffix(kcommon.GetEnvString("CLICKHOUSE_ENDPOINT", ""), "/")
+	if endpoint == "" {
+		panic(kerror.Create("ClickHouseSinkConfigInvalid", "CLICKHOUSE_ENDPOINT is required"))
+	}
+	sink := &ClickHouseSink{
+		ctx:       ctx,
+		client:    &http.Client{Timeout: time.Duration(kcommon.GetEnvInt("CLICKHOUSE_TIMEOUT_SEC", 30)) * time.Second},
+		username:  kcommon.GetEnvString("CLICKHOUSE_USERNAME", ""),
+		password:  kcommon.GetEnvString("CLICKHOUSE_PASSWORD", ""),
+		eventMode: kcommon.GetEnvString("CLICKHOUSE_EVENT_COLUMN", ClickHouseEventJson),
+	}
+	switch sink.eventMode {
+	case ClickHouseEventJson, ClickHouseEventMap, ClickHouseEventString:
+	default:
+		panic(kerror.Create("ClickHouseSinkConfigInvalid", "CLICKHOUSE_EVENT_COLUMN must be json, map or string").With("eventColumn", sink.eventMode))
+	}
+	table := kcommon.GetEnvString("CLICKHOUSE_TABLE", "logs")
+	query := url.Values{
+		"database":                         {kcommon.GetEnvString("CLICKHOUSE_DATABASE", "default")},
+		"query":                            {"INSERT INTO " + clickHouseIdentifier(table) + " FORMAT JSONEachRow"},
+		"date_time_input_format":           {"best_effort"},
+		"input_format_skip_unknown_fields": {"1"},
+	}
+	async := kcommon.GetEnvString("CLICKHOUSE_ASYNC_INSERT", "false") == "true"
+	if async {
+		// with wait_for_async_insert=0 the server answers once the rows are queued, insert errors are not reported
+		query.Set("async_insert", "1")
+		if kcommon.GetEnvString("CLICKHOUSE_WAIT_FOR_ASYNC_INSERT", "true") == "true" {
+			query.Set("wait_for_async_insert", "1")
+		} else {
+			query.Set("wait_for_async_insert", "0")
+		}
+	}
+	sink.url = endpoint + "/?" + query.Encode()
+	klogging.Info(ctx).With("endpoint", endpoint).With("table", table).With("eventColumn", sink.eventMode).With("async", async).Log("ClickHouseSink", "created")
+	return sink
+}
+
+// clickHouseIdentifier quotes a table name, exp: logs.app -> `logs`.`app`
+func clickHouseIdentifier(name string) string {
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		parts[i] = "`" + strings.ReplaceAll(part, "`", "\\`") + "`"
+	}
+	return strings.Join(parts, ".")
+}
+
+func (s *ClickHouseSink) Name() string {
+	return "clickhouse"
+}
+
+func (s *ClickHouseSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+type clickHouseRow struct {
+	Timestamp  string      `json:"timestamp"` // DateTime64(3), UTC
+	Host       string      `json:"host"`
+	Source     string      `json:"source"`
+	SourceType string      `json:"sourcetype"`
+	Index      string      `json:"index"`
+	Event      interface{} `json:"event"`
+}
+
+func (s *ClickHouseSink) Send(batch []*EventJson) error {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, eve := range batch {
+		if err := encoder.Encode(s.row(eve)); err != nil {
+			panic(kerror.Wrap(err, "MarshallingFailed", "", false))
+		}
+	}
+
+	request, err := http.NewRequest("POST", s.url, &body)
+	if err != nil {
+		panic(kerror.Wrap(err, "NewRequestFailed", "", false))
+	}
+	request.Header.Set("Content-Type", "application/x-ndjson")
+	if s.username != "" {
+		request.Header.Set("X-ClickHouse-User", s.username)
+		request.Header.Set("X-ClickHouse-Key", s.password)
+	}
+	response, err := s.client.Do(request)
+	if err != nil {
+		return kerror.Wrap(err, "SendRequestFailed", "", false)
+	}
+	defer response.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(response.Body, 4096))
+	// the exception code header is also set when an error happens after the response started
+	code := response.Header.Get("X-ClickHouse-Exception-Code")
+	if response.StatusCode/100 == 2 && code == "" {
+		return nil
+	}
+	if code == "" {
+		code = response.Status
+	}
+	ClickHouseInsertErrorsMetric.GetTimeSequence(s.ctx, code).Add(1)
+	return kerror.Create("ClickHouseInsertFailed", strings.TrimSpace(truncate(string(respBody), 512))).With("code", code).With("count", len(batch))
+}
+
+func (s *ClickHouseSink) row(eve *EventJson) *clickHouseRow {
+	timeMs := eve.Time
+	if timeMs == 0 {
+		timeMs = time.Now().UnixMilli()
+	}
+	row := &clickHouseRow{
+		Timestamp:  time.UnixMilli(timeMs).UTC().Format("2006-01-02 15:04:05.000"),
+		Host:       eve.Host,
+		Source:     eve.Source,
+		SourceType: eve.SourceType,
+		Index:      eve.Index,
+	}
+	switch s.eventMode {
+	case ClickHouseEventJson:
+		row.Event = eve.Event
+	case ClickHouseEventMap:
+		fields := make(map[string]string, len(eve.Event))
+		for k, v := range eve.Event {
+			if str, ok := v.(string); ok {
+				fields[k] = str
+				continue
+			}
+			jsonData, err := json.Marshal(v)
+			if err != nil {
+				panic(kerror.Wrap(err, "MarshallingFailed", "", false))
+			}
+			fields[k] = string(jsonData)
+		}
+		row.Event = fields
+	case ClickHouseEventString:
+		jsonData, err := json.Marshal(eve.Event)
+		if err != nil {
+			panic(kerror.Wrap(err, "MarshallingFailed", "", false))
+		}
+		row.Event = string(jsonData)
+	}
+	return row
+}
@@ -0,0 +1,401 @@
+package dao
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kcommon"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kerror"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/klogging"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kmetrics"
+)
+
+var (
+	FileRotationsMetric = kmetrics.CreateKmetric(context.Background(), "file_sink_rotations", "desc", []string{"reason"})
+	FileErrorsMetric    = kmetrics.CreateKmetric(context.Background(), "file_sink_errors", "desc", []string{"op"})
+)
+
+const (
+	FileFsyncNone     = "none"     // leave it to the OS
+	FileFsyncBatch    = "batch"    // fsync before a batch is acknowledged
+	FileFsyncInterval = "interval" // fsync every FILE_FSYNC_INTERVAL_MS
+)
+
+// FileSink writes events to local files under FILE_DIR, one file per rendered FILE_PATH_TEMPLATE. Files are rotated
+// by size and age to <file>.<timestamp> (gzipped in the background), old rotated files are removed by count and age.
+type FileSink struct {
+	ctx           context.Context
+	dir           string
+	pathTemplate  *eventTemplate
+	format        string // ndjson or hec
+	maxBytes      int64
+	maxAge        time.Duration
+	compress      bool
+	keepCount     int
+	keepAge       time.Duration
+	fsync         string
+	fsyncInterval time.Duration
+
+	mu    sync.Mutex
+	files map[string]*sinkFile // open files by path
+}
+
+type sinkFile struct {
+	path     string
+	file     *os.File
+	writer   *bufio.Writer
+	size     int64
+	openedAt time.Time
+	lastUsed time.Time
+	dirty    bool // written since the last fsync
+}
+
+// NewFileSinkFromEnv reads FILE_DIR, FILE_PATH_TEMPLATE, FILE_FORMAT, FILE_MAX_BYTES, FILE_MAX_AGE_SEC,
+// FILE_COMPRESS_ROTATED, FILE_RETENTION_COUNT, FILE_RETENTION_AGE_SEC, FILE_FSYNC and FILE_FSYNC_INTERVAL_MS.
+func NewFileSinkFromEnv(ctx context.Context) *FileSink {
+	sink := &FileSink{
+		ctx:           ctx,
+		dir:           kcommon.GetEnvString("FILE_DIR", "/var/log/hermes"),
+		pathTemplate:  parseEventTemplate(kcommon.GetEnvString("FILE_PATH_TEMPLATE", "{index}/{sourcetype}.log")),
+		format:        kcommon.GetEnvString("FILE_FORMAT", "ndjson"),
+		maxBytes:      int64(kcommon.GetEnvInt("FILE_MAX_BYTES", 100*1024*1024)),
+		maxAge:        time.Duration(kcommon.GetEnvInt("FILE_MAX_AGE_SEC", 3600)) * time.Second,
+		compress:      kcommon.GetEnvString("FILE_COMPRESS_ROTATED", "true") == "true",
+		keepCount:     kcommon.GetEnvInt("FILE_RETENTION_COUNT", 10),
+		keepAge:       time.Duration(kcommon.GetEnvInt("FILE_RETENTION_AGE_SEC", 0)) * time.Second,
+		fsync:         kcommon.GetEnvString("FILE_FSYNC", FileFsyncBatch),
+		fsyncInterval: time.Duration(kcommon.GetEnvInt("FILE_FSYNC_INTERVAL_MS", 1000)) * time.Millisecond,
+		files:         make(map[string]*sinkFile),
+	}
+	sink.pathTemplate.escape = filePathValue
+	if sink.format != "ndjson" && sink.format != "hec" {
+		panic(kerror.Create("FileSinkConfigInvalid", "FILE_FORMAT must be ndjson or hec").With("format", sink.format))
+	}
+	switch sink.fsync {
+	case FileFsyncNone, FileFsyncBatch, FileFsyncInterval:
+	default:
+		panic(kerror.Create("FileSinkConfigInvalid", "FILE_FSYNC must be none, batch or interval").With("fsync", sink.fsync))
+	}
+	if err := os.MkdirAll(sink.dir, 0755); err != nil {
+		panic(kerror.Wrap(err, "FileSinkConfigInvalid", "can not create FILE_DIR", false))
+	}
+	klogging.Info(ctx).With("dir", sink.dir).With("pathTemplate", sink.pathTemplate.raw).With("format", sink.format).With("fsync", sink.fsync).Log("FileSink", "created")
+	go sink.maintainLoop()
+	return sink
+}
+
+// filePathValue keeps field values inside FILE_DIR: no separators, no "..", no empty path elements.
+func filePathValue(value string) string {
+	value = strings.NewReplacer("/", "_", "\\", "_", "..", "_").Replace(value)
+	if value == "" {
+		return "_"
+	}
+	return value
+}
+
+func (s *FileSink) Name() string {
+	return "file"
+}
+
+// Close flushes and closes the open files, they are not rotated.
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var firstErr error
+	for _, f := range s.files {
+		if err := s.close(f); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (s *FileSink) Send(batch []*EventJson) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	touched := make(map[*sinkFile]struct{})
+	// events json can not hold are reported as failed, the rest of the batch is written as usual
+	var failed []*EventJson
+	var marshalErr error
+	for _, eve := range batch {
+		var doc interface{} = eve
+		if s.format == "ndjson" {
+			doc = flatDoc(eve)
+		}
+		line, err := json.Marshal(doc)
+		if err != nil {
+			failed = append(failed, eve)
+			marshalErr = kerror.Wrap(err, "MarshallingFailed", "", false)
+			continue
+		}
+		f, err := s.open(filepath.Join(s.dir, s.pathTemplate.render(eve)))
+		if err != nil {
+			return err
+		}
+		if _, err := f.writer.Write(append(line, '\n')); err != nil {
+			FileErrorsMetric.GetTimeSequence(s.ctx, "write").Add(1)
+			return kerror.Wrap(err, "FileWriteFailed", "", false).With("path", f.path)
+		}
+		f.size += int64(len(line) + 1)
+		f.dirty = true
+		touched[f] = struct{}{}
+		if f.size >= s.maxBytes {
+			if err := s.rotate(f, "size"); err != nil {
+				return err
+			}
+			delete(touched, f)
+		}
+	}
+	for f := range touched {
+		if err := f.writer.Flush(); err != nil {
+			FileErrorsMetric.GetTimeSequence(s.ctx, "write").Add(1)
+			return kerror.Wrap(err, "FileWriteFailed", "", false).With("path", f.path)
+		}
+		if s.fsync == FileFsyncBatch {
+			if err := s.sync(f); err != nil {
+				return err
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return &PartialSendError{Failed: failed, Err: marshalErr}
+	}
+	return nil
+}
+
+func (s *FileSink) open(path string) (*sinkFile, error) {
+	if f, ok := s.files[path]; ok {
+		f.lastUsed = time.Now()
+		return f, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		FileErrorsMetric.GetTimeSequence(s.ctx, "open").Add(1)
+		return nil, kerror.Wrap(err, "FileOpenFailed", "", false).With("path", path)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		FileErrorsMetric.GetTimeSequence(s.ctx, "open").Add(1)
+		return nil, kerror.Wrap(err, "FileOpenFailed", "", false).With("path", path)
+	}
+	f := &sinkFile{
+		path:     path,
+		file:     file,
+		writer:   bufio.NewWriterSize(file, 64*1024),
+		openedAt: time.Now(),
+		lastUsed: time.Now(),
+	}
+	// continue an existing file, it is rotated by age from now on
+	if info, err := file.Stat(); err == nil {
+		f.size = info.Size()
+	}
+	s.files[path] = f
+	return f, nil
+}
+
+func (s *FileSink) sync(f *sinkFile) error {
+	if !f.dirty {
+		return nil
+	}
+	if err := f.file.Sync(); err != nil {
+		FileErrorsMetric.GetTimeSequence(s.ctx, "fsync").Add(1)
+		return kerror.Wrap(err, "FileSyncFailed", "", false).With("path", f.path)
+	}
+	f.dirty = false
+	return nil
+}
+
+func (s *FileSink) close(f *sinkFile) error {
+	delete(s.files, f.path)
+	err := f.writer.Flush()
+	if err == nil && s.fsync != FileFsyncNone {
+		err = s.sync(f)
+	}
+	if closeErr := f.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		FileErrorsMetric.GetTimeSequence(s.ctx, "close").Add(1)
+		return kerror.Wrap(err, "FileCloseFailed", "", false).With("path", f.path)
+	}
+	return nil
+}
+
+// rotate renames the file to <path>.<timestamp>, then compresses it and applies retention in the background.
+func (s *FileSink) rotate(f *sinkFile, reason string) error {
+	if err := s.close(f); err != nil {
+		return err
+	}
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+	rotated := f.path + "." + stamp
+	for i := 1; fileExists(rotated) || fileExists(rotated+".gz"); i++ {
+		rotated = fmt.Sprintf("%s.%s-%d", f.path, stamp, i)
+	}
+	if err := os.Rename(f.path, rotated); err != nil {
+		FileErrorsMetric.GetTimeSequence(s.ctx, "rotate").Add(1)
+		return kerror.Wrap(err, "FileRotateFailed", "", false).With("path", f.path)
+	}
+	FileRotationsMetric.GetTimeSequence(s.ctx, reason).Add(1)
+	klogging.Info(s.ctx).With("path", f.path).With("rotated", rotated).With("size", f.size).With("reason", reason).Log("FileRotated", "rotated")
+	go func() {
+		kcommon.TryCatchRun(s.ctx, func() {
+			if s.compress {
+				s.gzipFile(rotated)
+			}
+			s.applyRetention(f.path)
+		})
+	}()
+	return nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func (s *FileSink) gzipFile(path string) {
+	src, err := os.Open(path)
+	if err != nil {
+		FileErrorsMetric.GetTimeSequence(s.ctx, "gzip").Add(1)
+		return
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(path+".gz.tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		FileErrorsMetric.GetTimeSequence(s.ctx, "gzip").Add(1)
+		return
+	}
+	gz := gzip.NewWriter(dst)
+	_, err = io.Copy(gz, src)
+	if err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(path+".gz.tmp", path+".gz")
+	}
+	if err != nil {
+		FileErrorsMetric.GetTimeSequence(s.ctx, "gzip").Add(1)
+		klogging.Error(s.ctx).With("path", path).With("error", err.Error()).Log("FileGzipFailed", "keeping uncompressed file")
+		os.Remove(path + ".gz.tmp")
+		return
+	}
+	os.Remove(path)
+}
+
+// rotatedSuffix matches the names rotate gives: <file>.<stamp>, <file>.<stamp>-<n>, optionally gzipped.
+var rotatedSuffix = regexp.MustCompile(`^\.(\d{8}T\d{6}Z)(?:-(\d+))?(?:\.gz)?$`)
+
+// rotatedFile is one rotation of a file, names holds both the plain and the .gz name while it is being compressed.
+type rotatedFile struct {
+	stamp string
+	seq   int
+	names []string
+}
+
+// applyRetention keeps the newest FILE_RETENTION_COUNT rotated files of path, and none older than FILE_RETENTION_AGE_SEC.
+// Only exact rotations of path count, not other outputs whose name starts with it (exp: json and json.log).
+func (s *FileSink) applyRetention(path string) {
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return
+	}
+	base := filepath.Base(path)
+	byRotation := make(map[string]*rotatedFile)
+	var rotated []*rotatedFile
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, base) {
+			continue
+		}
+		match := rotatedSuffix.FindStringSubmatch(name[len(base):])
+		if match == nil {
+			continue
+		}
+		key := match[1] + "-" + match[2]
+		r, ok := byRotation[key]
+		if !ok {
+			r = &rotatedFile{stamp: match[1]}
+			if match[2] != "" {
+				r.seq, _ = strconv.Atoi(match[2])
+			}
+			byRotation[key] = r
+			rotated = append(rotated, r)
+		}
+		r.names = append(r.names, filepath.Join(filepath.Dir(path), name))
+	}
+	// newest last
+	sort.Slice(rotated, func(i, j int) bool {
+		if rotated[i].stamp != rotated[j].stamp {
+			return rotated[i].stamp < rotated[j].stamp
+		}
+		return rotated[i].seq < rotated[j].seq
+	})
+	for i, r := range rotated {
+		remove := s.keepCount > 0 && i < len(rotated)-s.keepCount
+		if !remove && s.keepAge > 0 {
+			if info, err := os.Stat(r.names[0]); err == nil && time.Since(info.ModTime()) > s.keepAge {
+				remove = true
+			}
+		}
+		if !remove {
+			continue
+		}
+		for _, name := range r.names {
+			if err := os.Remove(name); err == nil {
+				klogging.Info(s.ctx).With("path", name).Log("FileRetention", "removed")
+			}
+		}
+	}
+}
+
+// maintainLoop rotates files by age, fsyncs for the interval policy and closes files idle for a while.
+func (s *FileSink) maintainLoop() {
+	tick := time.Second
+	if s.fsync == FileFsyncInterval && s.fsyncInterval > 0 {
+		tick = min(tick, s.fsyncInterval)
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		kcommon.TryCatchRun(s.ctx, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			for _, f := range s.files {
+				var err error
+				switch {
+				case time.Since(f.openedAt) >= s.maxAge && f.size > 0:
+					err = s.rotate(f, "age")
+				case time.Since(f.lastUsed) >= 5*time.Minute:
+					err = s.close(f)
+				case s.fsync == FileFsyncInterval:
+					err = s.sync(f)
+				}
+				if err != nil {
+					klogging.Error(s.ctx).With("path", f.path).With("error", err.Error()).Log("FileMaintainFailed", "")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package dao
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kcommon"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kerror"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/klogging"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kmetrics"
+)
+
+var (
+	KafkaProducedMetric = kmetrics.CreateKmetric(context.Background(), "kafka_produced_records", "desc", []string{"result"})
+)
+
+// KafkaSink writes every event (HEC json) as one record to KAFKA_OUTPUT_TOPIC. Records are partitioned by the
+// hash of KAFKA_OUTPUT_KEY_FIELD, so all events of one host/source/tenant stay in order on one partition.
+type KafkaSink struct {
+	ctx      context.Context
+	writer   *kafka.Writer
+	keyField string
+}
+
+// NewKafkaSinkFromEnv reads KAFKA_OUTPUT_BROKERS, KAFKA_OUTPUT_TOPIC, KAFKA_OUTPUT_KEY_FIELD, KAFKA_OUTPUT_ACKS,
+// KAFKA_OUTPUT_COMPRESSION, KAFKA_OUTPUT_BATCH_TIMEOUT_MS and KAFKA_OUTPUT_MAX_ATTEMPTS.
+func NewKafkaSinkFromEnv(ctx context.Context) *KafkaSink {
+	var brokers []string
+	for _, broker := range strings.Split(kcommon.GetEnvString("KAFKA_OUTPUT_BROKERS", ""), ",") {
+		if broker = strings.TrimSpace(broker); broker != "" {
+			brokers = append(brokers, broker)
+		}
+	}
+	topic := kcommon.GetEnvString("KAFKA_OUTPUT_TOPIC", "")
+	if len(brokers) == 0 || topic == "" {
+		panic(kerror.Create("KafkaSinkConfigInvalid", "KAFKA_OUTPUT_BROKERS and KAFKA_OUTPUT_TOPIC are required"))
+	}
+	acks := kcommon.GetEnvString("KAFKA_OUTPUT_ACKS", "all")
+	compression := kcommon.GetEnvString("KAFKA_OUTPUT_COMPRESSION", "snappy")
+	sink := &KafkaSink{
+		ctx: ctx,
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(brokers...),
+			Topic:        topic,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafkaRequiredAcks(acks),
+			Compression:  kafkaCompression(compression),
+			BatchSize:    kcommon.GetEnvInt("MAX_BATCH_COUNT", 100),
+			BatchBytes:   int64(kcommon.GetEnvInt("MAX_BATCH_SIZE", 1024*1024)),
+			BatchTimeout: time.Duration(kcommon.GetEnvInt("KAFKA_OUTPUT_BATCH_TIMEOUT_MS", 10)) * time.Millisecond,
+			MaxAttempts:  kcommon.GetEnvInt("KAFKA_OUTPUT_MAX_ATTEMPTS", 3),
+		},
+		keyField: kcommon.GetEnvString("KAFKA_OUTPUT_KEY_FIELD", "host"),
+	}
+	klogging.Info(ctx).With("brokers", brokers).With("topic", topic).With("keyField", sink.keyField).With("acks", acks).With("compression", compression).Log("KafkaSink", "created")
+	return sink
+}
+
+func kafkaRequiredAcks(acks string) kafka.RequiredAcks {
+	switch acks {
+	case "all", "-1":
+		return kafka.RequireAll
+	case "one", "1":
+		return kafka.RequireOne
+	case "none", "0":
+		return kafka.RequireNone
+	}
+	panic(kerror.Create("KafkaSinkConfigInvalid", "KAFKA_OUTPUT_ACKS must be all, one or none").With("acks", acks))
+}
+
+func kafkaCompression(name string) kafka.Compression {
+	switch name {
+	case "none", "":
+		return 0
+	case "gzip":
+		return kafka.Gzip
+	case "snappy":
+		return kafka.Snappy
+	case "lz4":
+		return kafka.Lz4
+	case "zstd":
+		return kafka.Zstd
+	}
+	panic(kerror.Create("KafkaSinkConfigInvalid", "KAFKA_OUTPUT_COMPRESSION must be none, gzip, snappy, lz4 or zstd").With("compression", name))
+}
+
+func (s *KafkaSink) Name() string {
+	return "kafka"
+}
+
+// Close flushes the writer's pending records and closes its connections.
+func (s *KafkaSink) Close() error {
+	return s.writer.Close()
+}
+
+func (s *KafkaSink) Send(batch []*EventJson) error {
+	msgs := make([]kafka.Message, 0, len(batch))
+	for _, eve := range batch {
+		value, err := json.Marshal(eve)
+		if err != nil {
+			ke := kerror.Wrap(err, "MarshallingFailed", "", false)
+			panic(ke)
+		}
+		msg := kafka.Message{Value: value}
+		if key := eventKey(eve, s.keyField); key != "" {
+			msg.Key = []byte(key) // nil key is balanced round robin
+		}
+		msgs = append(msgs, msg)
+	}
+	err := s.writer.WriteMessages(s.ctx, msgs...)
+	if err == nil {
+		KafkaProducedMetric.GetTimeSequence(s.ctx, "success").Add(int64(len(msgs)))
+		return nil
+	}
+	// delivery report: WriteErrors has one entry per message, nil for the ones that were written. Only the failed
+	// ones are retried, resending the whole batch would duplicate the written ones.
+	var writeErrors kafka.WriteErrors
+	if !errors.As(err, &writeErrors) || len(writeErrors) != len(batch) {
+		KafkaProducedMetric.GetTimeSequence(s.ctx, "failure").Add(int64(len(msgs)))
+		return kerror.Wrap(err, "KafkaWriteFailed", "", false).With("failed", len(msgs))
+	}
+	var failed []*EventJson
+	for i, writeErr := range writeErrors {
+		if writeErr != nil {
+			failed = append(failed, batch[i])
+		}
+	}
+	KafkaProducedMetric.GetTimeSequence(s.ctx, "success").Add(int64(len(msgs) - len(failed)))
+	KafkaProducedMetric.GetTimeSequence(s.ctx, "failure").Add(int64(len(failed)))
+	return &PartialSendError{Failed: failed, Err: kerror.Wrap(err, "KafkaWriteFailed", "", false).With("failed", len(failed))}
+}
+
+// eventKey returns an EventJson field (host, source, sourcetype, index) or else a top level event field (exp: tenant).
+func eventKey(eve *EventJson, field string) string {
+	switch field {
+	case "":
+		return ""
+	case "host":
+		return eve.Host
+	case "source":
+		return eve.Source
+	case "sourcetype":
+		return eve.SourceType
+	case "index":
+		return eve.Index
+	}
+	switch val := eve.Event[field].(type) {
+	case string:
+		return val
+	case nil:
+		return ""
+	default:
+		jsonData, _ := json.Marshal(val)
+		return string(jsonData)
+	}
+}
@@ -0,0 +1,314 @@
+package dao
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kcommon"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kerror"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/klogging"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kmetrics"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var (
+	LokiLabelOverflowMetric = kmetrics.CreateKmetric(context.Background(), "loki_label_overflow", "desc", []string{"label"})
+	LokiTruncatedMetric     = kmetrics.CreateKmetric(context.Background(), "loki_truncated_lines", "desc", []string{})
+	LokiRejectedMetric      = kmetrics.CreateKmetric(context.Background(), "loki_rejected_entries", "desc", []string{})
+)
+
+const lokiOverflowValue = "__overflow__"
+
+// LokiSink pushes batches to Loki (/loki/api/v1/push, protobuf + snappy). Events are grouped into streams by
+// LOKI_LABELS, the line is the event json. Entries of a stream are sent in time order and pushes are split to stay
+// under LOKI_MAX_PUSH_BYTES. A push rejected with 4xx other than 429 (exp: entries too old) is dropped.
+type LokiSink struct {
+	ctx            context.Context
+	client         *http.Client
+	url            string
+	tenantId       string
+	username       string
+	password       string
+	labels         []lokiLabel
+	maxValueLength int
+	maxValues      int
+	maxLineBytes   int
+	maxPushBytes   int
+
+	// seen label values, once a label has maxValues distinct values new ones are replaced by __overflow__.
+	// Send is never called concurrently (one batch at a time per sink), so no lock.
+	seen map[string]map[string]struct{}
+}
+
+type lokiLabel struct {
+	name  string // sanitized loki label name
+	field string // index, host, source, sourcetype or a top level event field
+}
+
+// NewLokiSinkFromEnv reads LOKI_ENDPOINT, LOKI_TENANT_ID, LOKI_USERNAME/LOKI_PASSWORD, LOKI_LABELS and the limits
+// LOKI_MAX_LABEL_VALUE_LENGTH, LOKI_MAX_VALUES_PER_LABEL, LOKI_MAX_LINE_BYTES, LOKI_MAX_PUSH_BYTES.
+func NewLokiSinkFromEnv(ctx context.Context) *LokiSink {
+	endpoint := strings.TrimSuffix(kcommon.GetEnvString("LOKI_ENDPOINT", ""), "/")
+	if endpoint == "" {
+		panic(kerror.Create("LokiSinkConfigInvalid", "LOKI_ENDPOINT is required"))
+	}
+	sink := &LokiSink{
+		ctx:            ctx,
+		client:         &http.Client{Timeout: time.Duration(kcommon.GetEnvInt("LOKI_TIMEOUT_SEC", 30)) * time.Second},
+		url:            endpoint + "/loki/api/v1/push",
+		tenantId:       kcommon.GetEnvString("LOKI_TENANT_ID", ""),
+		username:       kcommon.GetEnvString("LOKI_USERNAME", ""),
+		password:       kcommon.GetEnvString("LOKI_PASSWORD", ""),
+		maxValueLength: kcommon.GetEnvInt("LOKI_MAX_LABEL_VALUE_LENGTH", 128),
+		maxValues:      kcommon.GetEnvInt("LOKI_MAX_VALUES_PER_LABEL", 100),
+		maxLineBytes:   kcommon.GetEnvInt("LOKI_MAX_LINE_BYTES", 256*1024),
+		maxPushBytes:   kcommon.GetEnvInt("LOKI_MAX_PUSH_BYTES", 1024*1024),
+		seen:           make(map[string]map[string]struct{}),
+	}
+	for _, field := range strings.Split(kcommon.GetEnvString("LOKI_LABELS", "index,host,source,sourcetype"), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			sink.labels = append(sink.labels, lokiLabel{name: lokiLabelName(field), field: field})
+		}
+	}
+	klogging.Info(ctx).With("url", sink.url).With("tenantId", sink.tenantId).With("labels", sink.labels).Log("LokiSink", "created")
+	return sink
+}
+
+// lokiLabelName maps a field name to [a-zA-Z_][a-zA-Z0-9_]*
+func lokiLabelName(field string) string {
+	var sb strings.Builder
+	for i, c := range field {
+		switch {
+		case c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+			sb.WriteRune(c)
+		case c >= '0' && c <= '9' && i > 0:
+			sb.WriteRune(c)
+		default:
+			sb.WriteByte('_')
+		}
+	}
+	return sb.String()
+}
+
+func (s *LokiSink) Name() string {
+	return "loki"
+}
+
+func (s *LokiSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+type lokiEntry struct {
+	timeNs int64
+	line   string
+	eve    *EventJson
+}
+
+type lokiStream struct {
+	labels  string
+	entries []lokiEntry
+}
+
+func (s *LokiSink) Send(batch []*EventJson) error {
+	// group into streams, in order of first appearance
+	var streams []*lokiStream
+	byLabels := make(map[string]*lokiStream)
+	for _, eve := range batch {
+		labels := s.streamLabels(eve)
+		stream, ok := byLabels[labels]
+		if !ok {
+			stream = &lokiStream{labels: labels}
+			byLabels[labels] = stream
+			streams = append(streams, stream)
+		}
+		stream.entries = append(stream.entries, lokiEntry{timeNs: eventTimeNs(eve), line: s.line(eve), eve: eve})
+	}
+
+	// loki wants entries of one stream in time order
+	for _, stream := range streams {
+		sort.SliceStable(stream.entries, func(i, j int) bool {
+			return stream.entries[i].timeNs < stream.entries[j].timeNs
+		})
+	}
+
+	// split into pushes of at most maxPushBytes (uncompressed)
+	var pending []*lokiStream
+	var pendingEvents []*EventJson
+	size := 0
+	var failed []*EventJson
+	var lastErr error
+	push := func() {
+		if len(pending) == 0 {
+			return
+		}
+		if err := s.push(pending, len(pendingEvents)); err != nil {
+			failed = append(failed, pendingEvents...)
+			lastErr = err
+		}
+		pending, pendingEvents, size = nil, nil, 0
+	}
+	for _, stream := range streams {
+		var current *lokiStream
+		for _, entry := range stream.entries {
+			entrySize := len(entry.line) + 32
+			if size > 0 && size+entrySize+len(stream.labels) > s.maxPushBytes {
+				push()
+				current = nil
+			}
+			if current == nil {
+				current = &lokiStream{labels: stream.labels}
+				pending = append(pending, current)
+				size += len(stream.labels) + 8
+			}
+			current.entries = append(current.entries, entry)
+			pendingEvents = append(pendingEvents, entry.eve)
+			size += entrySize
+		}
+	}
+	push()
+	if lastErr == nil {
+		return nil
+	}
+	if len(failed) == len(batch) {
+		return lastErr
+	}
+	return &PartialSendError{Failed: failed, Err: lastErr}
+}
+
+// streamLabels renders the label set, exp: {host="web-1", index="main"}. Labels without value are left out.
+func (s *LokiSink) streamLabels(eve *EventJson) string {
+	pairs := make([]string, 0, len(s.labels))
+	for _, label := range s.labels {
+		value := eventKey(eve, label.field)
+		if value == "" {
+			continue
+		}
+		pairs = append(pairs, label.name+"="+strconv.Quote(s.guardValue(label.name, value)))
+	}
+	sort.Strings(pairs)
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
+
+// guardValue truncates long values and caps the number of distinct values per label.
+func (s *LokiSink) guardValue(name string, value string) string {
+	if len(value) > s.maxValueLength {
+		value = TruncateUtf8(value, s.maxValueLength)
+	}
+	values, ok := s.seen[name]
+	if !ok {
+		values = make(map[string]struct{})
+		s.seen[name] = values
+	}
+	if _, ok := values[value]; ok {
+		return value
+	}
+	if len(values) >= s.maxValues {
+		LokiLabelOverflowMetric.GetTimeSequence(s.ctx, name).Add(1)
+		return lokiOverflowValue
+	}
+	values[value] = struct{}{}
+	return value
+}
+
+func (s *LokiSink) line(eve *EventJson) string {
+	jsonData, err := json.Marshal(eve.Event)
+	if err != nil {
+		panic(kerror.Wrap(err, "MarshallingFailed", "", false))
+	}
+	if len(jsonData) > s.maxLineBytes {
+		LokiTruncatedMetric.GetTimeSequence(s.ctx).Add(1)
+		return TruncateUtf8(string(jsonData), s.maxLineBytes)
+	}
+	return string(jsonData)
+}
+
+func (s *LokiSink) push(streams []*lokiStream, count int) error {
+	body := snappy.Encode(nil, encodeLokiPush(streams))
+	request, err := http.NewRequest("POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		panic(kerror.Wrap(err, "NewRequestFailed", "", false))
+	}
+	request.Header.Set("Content-Type", "application/x-protobuf")
+	if s.tenantId != "" {
+		request.Header.Set("X-Scope-OrgID", s.tenantId)
+	}
+	if s.username != "" {
+		request.SetBasicAuth(s.username, s.password)
+	}
+	response, err := s.client.Do(request)
+	if err != nil {
+		return kerror.Wrap(err, "SendRequestFailed", "", false)
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 == 2 {
+		return nil
+	}
+	respBody, _ := io.ReadAll(io.LimitReader(response.Body, 4096))
+	if response.StatusCode == http.StatusBadRequest && isLokiEntryRejection(string(respBody)) {
+		// the entries themselves were refused (exp: out of order), retrying can not help
+		LokiRejectedMetric.GetTimeSequence(s.ctx).Add(int64(count))
+		klogging.Error(s.ctx).With("status", response.Status).With("body", truncate(string(respBody), 512)).With("count", count).Log("LokiPushRejected", "dropping entries")
+		return nil
+	}
+	// 401/403/404 etc. are configuration problems, the batch fails so that it is retried and not acked
+	return kerror.Create("UploadRejected", response.Status).With("body", truncate(string(respBody), 512))
+}
+
+// lokiEntryRejections are the per entry validation errors of a loki 400 response.
+var lokiEntryRejections = []string{"out of order", "too far behind", "timestamp too old", "timestamp too new", "line too long"}
+
+func isLokiEntryRejection(body string) bool {
+	for _, reason := range lokiEntryRejections {
+		if strings.Contains(body, reason) {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeLokiPush encodes logproto.PushRequest:
+//
+//	PushRequest { repeated Stream streams = 1; }
+//	Stream { string labels = 1; repeated Entry entries = 2; }
+//	Entry { google.protobuf.Timestamp timestamp = 1; string line = 2; }
+func encodeLokiPush(streams []*lokiStream) []byte {
+	var req []byte
+	for _, stream := range streams {
+		var msg []byte
+		msg = protowire.AppendTag(msg, 1, protowire.BytesType)
+		msg = protowire.AppendString(msg, stream.labels)
+		for _, entry := range stream.entries {
+			var ts []byte
+			ts = protowire.AppendTag(ts, 1, protowire.VarintType)
+			ts = protowire.AppendVarint(ts, uint64(entry.timeNs/int64(time.Second)))
+			ts = protowire.AppendTag(ts, 2, protowire.VarintType)
+			ts = protowire.AppendVarint(ts, uint64(entry.timeNs%int64(time.Second)))
+			var e []byte
+			e = protowire.AppendTag(e, 1, protowire.BytesType)
+			e = protowire.AppendBytes(e, ts)
+			e = protowire.AppendTag(e, 2, protowire.BytesType)
+			e = protowire.AppendString(e, entry.line)
+			msg = protowire.AppendTag(msg, 2, protowire.BytesType)
+			msg = protowire.AppendBytes(msg, e)
+		}
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, msg)
+	}
+	return req
+}
+
+func eventTimeNs(eve *EventJson) int64 {
+	if eve.Time == 0 {
+		return time.Now().UnixNano()
+	}
+	return eve.Time * int64(time.Millisecond)
+}
@@ -0,0 +1,162 @@
+package dao
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kcommon"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kerror"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/klogging"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kmetrics"
+)
+
+var (
+	OpenSearchRejectedMetric = kmetrics.CreateKmetric(context.Background(), "opensearch_rejected_docs", "desc", []string{"type"})
+)
+
+// OpenSearchSink writes batches through the _bulk API (works for Elasticsearch too). Documents rejected with 429 or
+// 5xx are retried, other per-item errors (exp: mapping conflicts) can never succeed and are dropped with a metric.
+type OpenSearchSink struct {
+	ctx           context.Context
+	client        *http.Client
+	endpoint      string
+	username      string
+	password      string
+	apiKey        string
+	action        string
+	indexTemplate *eventTemplate
+}
+
+// NewOpenSearchSinkFromEnv reads OPENSEARCH_ENDPOINT, OPENSEARCH_USERNAME/OPENSEARCH_PASSWORD or OPENSEARCH_API_KEY,
+// OPENSEARCH_INDEX_TEMPLATE and OPENSEARCH_BULK_ACTION.
+func NewOpenSearchSinkFromEnv(ctx context.Context) *OpenSearchSink {
+	sink := &OpenSearchSink{
+		ctx:           ctx,
+		client:        &http.Client{Timeout: time.Duration(kcommon.GetEnvInt("OPENSEARCH_TIMEOUT_SEC", 30)) * time.Second},
+		endpoint:      strings.TrimSuffix(kcommon.GetEnvString("OPENSEARCH_ENDPOINT", ""), "/"),
+		username:      kcommon.GetEnvString("OPENSEARCH_USERNAME", ""),
+		password:      kcommon.GetEnvString("OPENSEARCH_PASSWORD", ""),
+		apiKey:        kcommon.GetEnvString("OPENSEARCH_API_KEY", ""),
+		action:        kcommon.GetEnvString("OPENSEARCH_BULK_ACTION", "index"),
+		indexTemplate: parseEventTemplate(kcommon.GetEnvString("OPENSEARCH_INDEX_TEMPLATE", "logs-{index}-{yyyy.MM.dd}")),
+	}
+	if sink.endpoint == "" {
+		panic(kerror.Create("OpenSearchSinkConfigInvalid", "OPENSEARCH_ENDPOINT is required"))
+	}
+	if sink.action != "index" && sink.action != "create" {
+		panic(kerror.Create("OpenSearchSinkConfigInvalid", "OPENSEARCH_BULK_ACTION must be index or create").With("action", sink.action))
+	}
+	klogging.Info(ctx).With("endpoint", sink.endpoint).With("action", sink.action).With("indexTemplate", sink.indexTemplate.raw).Log("OpenSearchSink", "created")
+	return sink
+}
+
+func (s *OpenSearchSink) Name() string {
+	return "opensearch"
+}
+
+func (s *OpenSearchSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+type openSearchBulkResponse struct {
+	Errors bool                                  `json:"errors"`
+	Items  []map[string]openSearchBulkItemResult `json:"items"`
+}
+
+type openSearchBulkItemResult struct {
+	Status int `json:"status"`
+	Error  *struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	} `json:"error,omitempty"`
+}
+
+func (s *OpenSearchSink) Send(batch []*EventJson) error {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, eve := range batch {
+		action := map[string]map[string]string{s.action: {"_index": s.indexName(eve)}}
+		if err := encoder.Encode(action); err != nil {
+			panic(kerror.Wrap(err, "MarshallingFailed", "", false))
+		}
+		if err := encoder.Encode(flatDoc(eve)); err != nil {
+			panic(kerror.Wrap(err, "MarshallingFailed", "", false))
+		}
+	}
+
+	request, err := http.NewRequest("POST", s.endpoint+"/_bulk", &body)
+	if err != nil {
+		panic(kerror.Wrap(err, "NewRequestFailed", "", false))
+	}
+	request.Header.Set("Content-Type", "application/x-ndjson")
+	if s.apiKey != "" {
+		request.Header.Set("Authorization", "ApiKey "+s.apiKey)
+	} else if s.username != "" {
+		request.SetBasicAuth(s.username, s.password)
+	}
+	response, err := s.client.Do(request)
+	if err != nil {
+		return kerror.Wrap(err, "SendRequestFailed", "", false)
+	}
+	defer response.Body.Close()
+	respBody, err := io.ReadAll(response.Body)
+	if err != nil {
+		return kerror.Wrap(err, "ReadResponseFailed", "", false)
+	}
+	if response.StatusCode/100 != 2 {
+		return kerror.Create("UploadRejected", response.Status).With("body", truncate(string(respBody), 512))
+	}
+
+	var resp openSearchBulkResponse
+	if err := json.Unmarshal(respBody, &resp); err != nil {
+		return kerror.Wrap(err, "DecodingError", "invalid _bulk response", false)
+	}
+	if !resp.Errors {
+		return nil
+	}
+	if len(resp.Items) != len(batch) {
+		return kerror.Create("OpenSearchBulkMismatch", fmt.Sprintf("%d items for %d documents", len(resp.Items), len(batch)))
+	}
+	var failed []*EventJson
+	var lastError string
+	for i, item := range resp.Items {
+		for _, result := range item {
+			if result.Error == nil {
+				continue
+			}
+			lastError = result.Error.Type + ": " + result.Error.Reason
+			if result.Status == http.StatusTooManyRequests || result.Status >= 500 {
+				failed = append(failed, batch[i])
+				continue
+			}
+			OpenSearchRejectedMetric.GetTimeSequence(s.ctx, result.Error.Type).Add(1)
+			klogging.Error(s.ctx).With("status", result.Status).With("error", lastError).With("index", s.indexName(batch[i])).Log("OpenSearchDocRejected", "dropping document")
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return &PartialSendError{
+		Failed: failed,
+		Err:    kerror.Create("OpenSearchBulkItemsFailed", lastError),
+	}
+}
+
+// indexName renders OPENSEARCH_INDEX_TEMPLATE, index names must be lower case.
+func (s *OpenSearchSink) indexName(eve *EventJson) string {
+	return strings.ToLower(s.indexTemplate.render(eve))
+}
+
+func truncate(str string, max int) string {
+	if len(str) <= max {
+		return str
+	}
+	return str[:max] + "..."
+}
@@ -0,0 +1,419 @@
+package dao
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kcommon"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kerror"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/klogging"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kmetrics"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var (
+	OtlpRejectedMetric = kmetrics.CreateKmetric(context.Background(), "otlp_rejected_records", "desc", []string{"reason"})
+)
+
+// OtlpSink exports batches to an OpenTelemetry collector over OTLP/HTTP (protobuf, POST <endpoint>/v1/logs).
+// host/source/sourcetype/index become resource attributes (the names used by the collector's splunk_hec receiver and
+// exporter), the body is taken from the first of OTLP_BODY_FIELDS, the other event fields become attributes.
+// Requests failing with 429/502/503/504 are retried, other failures can not succeed and are dropped with a metric.
+type OtlpSink struct {
+	ctx            context.Context
+	client         *http.Client
+	url            string
+	headers        map[string]string
+	gzip           bool
+	bodyFields     []string
+	severityFields []string
+}
+
+// NewOtlpSinkFromEnv reads OTLP_ENDPOINT, OTLP_HEADERS, OTLP_COMPRESSION, OTLP_BODY_FIELDS and OTLP_SEVERITY_FIELDS.
+func NewOtlpSinkFromEnv(ctx context.Context) *OtlpSink {
+	endpoint := strings.TrimSuffix(kcommon.GetEnvString("OTLP_ENDPOINT", ""), "/")
+	if endpoint == "" {
+		panic(kerror.Create("OtlpSinkConfigInvalid", "OTLP_ENDPOINT is required"))
+	}
+	sink := &OtlpSink{
+		ctx:            ctx,
+		client:         &http.Client{Timeout: time.Duration(kcommon.GetEnvInt("OTLP_TIMEOUT_SEC", 10)) * time.Second},
+		url:            endpoint + "/v1/logs",
+		headers:        map[string]string{},
+		bodyFields:     splitFields(kcommon.GetEnvString("OTLP_BODY_FIELDS", "message,msg,log")),
+		severityFields: splitFields(kcommon.GetEnvString("OTLP_SEVERITY_FIELDS", "severity,level,log.level,loglevel,lvl")),
+	}
+	switch compression := kcommon.GetEnvString("OTLP_COMPRESSION", "gzip"); compression {
+	case "gzip":
+		sink.gzip = true
+	case "none":
+	default:
+		panic(kerror.Create("OtlpSinkConfigInvalid", "OTLP_COMPRESSION must be gzip or none").With("compression", compression))
+	}
+	// same format as WEBHOOK_HEADERS, exp: {"Authorization":"Bearer ${OTLP_TOKEN}"}
+	if rawHeaders := kcommon.GetEnvString("OTLP_HEADERS", ""); rawHeaders != "" {
+		var headers map[string]string
+		if err := json.Unmarshal([]byte(rawHeaders), &headers); err != nil {
+			panic(kerror.Wrap(err, "OtlpSinkConfigInvalid", "OTLP_HEADERS must be a json object", false))
+		}
+		for name, value := range headers {
+			sink.headers[name] = interpolateSecrets(value)
+		}
+	}
+	klogging.Info(ctx).With("url", sink.url).With("gzip", sink.gzip).With("bodyFields", sink.bodyFields).Log("OtlpSink", "created")
+	return sink
+}
+
+func splitFields(str string) []string {
+	var fields []string
+	for _, field := range strings.Split(str, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+func (s *OtlpSink) Name() string {
+	return "otlp"
+}
+
+func (s *OtlpSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+func (s *OtlpSink) Send(batch []*EventJson) error {
+	body := s.encodeRequest(batch)
+	if s.gzip {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write(body)
+		gz.Close()
+		body = buf.Bytes()
+	}
+	request, err := http.NewRequest("POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		panic(kerror.Wrap(err, "NewRequestFailed", "", false))
+	}
+	request.Header.Set("Content-Type", "application/x-protobuf")
+	if s.gzip {
+		request.Header.Set("Content-Encoding", "gzip")
+	}
+	for name, value := range s.headers {
+		request.Header.Set(name, value)
+	}
+	response, err := s.client.Do(request)
+	if err != nil {
+		return kerror.Wrap(err, "SendRequestFailed", "", false)
+	}
+	defer response.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(response.Body, 64*1024))
+	switch {
+	case response.StatusCode/100 == 2:
+		if rejected, message := decodeOtlpPartialSuccess(respBody); rejected > 0 {
+			OtlpRejectedMetric.GetTimeSequence(s.ctx, "partial").Add(rejected)
+			klogging.Error(s.ctx).With("rejected", rejected).With("error", message).Log("OtlpPartialSuccess", "records rejected by collector")
+		}
+		return nil
+	case response.StatusCode == http.StatusBadRequest:
+		if rejected, message := decodeOtlpPartialSuccess(respBody); rejected > 0 {
+			// the collector refused the records themselves, retrying can not help
+			OtlpRejectedMetric.GetTimeSequence(s.ctx, fmt.Sprint(response.StatusCode)).Add(int64(len(batch)))
+			klogging.Error(s.ctx).With("status", response.Status).With("rejected", rejected).With("error", message).With("count", len(batch)).Log("OtlpExportRejected", "dropping records")
+			return nil
+		}
+	}
+	// 429/502/503/504 are retryable per the OTLP spec; anything else (exp: 401/403/404, other 5xx) is most likely
+	// configuration or a collector problem, the batch fails so that it is not acknowledged
+	return kerror.Create("UploadRejected", response.Status).With("body", truncate(string(respBody), 512))
+}
+
+// encodeRequest encodes ExportLogsServiceRequest, one ResourceLogs per distinct host/source/sourcetype/index:
+//
+//	ExportLogsServiceRequest { repeated ResourceLogs resource_logs = 1; }
+//	ResourceLogs { Resource resource = 1; repeated ScopeLogs scope_logs = 2; }
+//	Resource { repeated KeyValue attributes = 1; }
+//	ScopeLogs { InstrumentationScope scope = 1; repeated LogRecord log_records = 2; }
+//	InstrumentationScope { string name = 1; }
+func (s *OtlpSink) encodeRequest(batch []*EventJson) []byte {
+	type resourceKey struct{ host, source, sourceType, index string }
+	var keys []resourceKey
+	records := make(map[resourceKey][]byte)
+	observedNs := time.Now().UnixNano()
+	for _, eve := range batch {
+		key := resourceKey{eve.Host, eve.Source, eve.SourceType, eve.Index}
+		if _, ok := records[key]; !ok {
+			keys = append(keys, key)
+		}
+		records[key] = protowire.AppendTag(records[key], 2, protowire.BytesType)
+		records[key] = protowire.AppendBytes(records[key], s.encodeLogRecord(eve, observedNs))
+	}
+
+	var req []byte
+	for _, key := range keys {
+		var resource []byte
+		for _, attr := range [][2]string{
+			{"host.name", key.host},
+			{"com.splunk.source", key.source},
+			{"com.splunk.sourcetype", key.sourceType},
+			{"com.splunk.index", key.index},
+		} {
+			if attr[1] != "" {
+				resource = appendOtlpKeyValue(resource, 1, attr[0], attr[1])
+			}
+		}
+		var scope []byte
+		scope = protowire.AppendTag(scope, 1, protowire.BytesType)
+		scope = protowire.AppendString(scope, "hermes")
+		var scopeLogs []byte
+		scopeLogs = protowire.AppendTag(scopeLogs, 1, protowire.BytesType)
+		scopeLogs = protowire.AppendBytes(scopeLogs, scope)
+		scopeLogs = append(scopeLogs, records[key]...)
+
+		var resourceLogs []byte
+		resourceLogs = protowire.AppendTag(resourceLogs, 1, protowire.BytesType)
+		resourceLogs = protowire.AppendBytes(resourceLogs, resource)
+		resourceLogs = protowire.AppendTag(resourceLogs, 2, protowire.BytesType)
+		resourceLogs = protowire.AppendBytes(resourceLogs, scopeLogs)
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, resourceLogs)
+	}
+	return req
+}
+
+// encodeLogRecord encodes
+//
+//	LogRecord { fixed64 time_unix_nano = 1; SeverityNumber severity_number = 2; string severity_text = 3;
+//	            AnyValue body = 5; repeated KeyValue attributes = 6; fixed64 observed_time_unix_nano = 11; }
+//
+// Without a body field the whole event (json) is the body and there are no attributes.
+func (s *OtlpSink) encodeLogRecord(eve *EventJson, observedNs int64) []byte {
+	var rec []byte
+	if eve.Time != 0 {
+		rec = protowire.AppendTag(rec, 1, protowire.Fixed64Type)
+		rec = protowire.AppendFixed64(rec, uint64(eve.Time*int64(time.Millisecond)))
+	}
+	if number, text := s.severity(eve); number > 0 {
+		rec = protowire.AppendTag(rec, 2, protowire.VarintType)
+		rec = protowire.AppendVarint(rec, uint64(number))
+		rec = protowire.AppendTag(rec, 3, protowire.BytesType)
+		rec = protowire.AppendString(rec, text)
+	}
+
+	bodyField := ""
+	for _, field := range s.bodyFields {
+		if _, ok := eve.Event[field]; ok {
+			bodyField = field
+			break
+		}
+	}
+	rec = protowire.AppendTag(rec, 5, protowire.BytesType)
+	if bodyField == "" {
+		jsonData, err := json.Marshal(eve.Event)
+		if err != nil {
+			panic(kerror.Wrap(err, "MarshallingFailed", "", false))
+		}
+		rec = protowire.AppendBytes(rec, appendOtlpAnyValue(nil, string(jsonData)))
+	} else {
+		rec = protowire.AppendBytes(rec, appendOtlpAnyValue(nil, eve.Event[bodyField]))
+		names := make([]string, 0, len(eve.Event))
+		for name := range eve.Event {
+			if name != bodyField {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			rec = appendOtlpKeyValue(rec, 6, name, eve.Event[name])
+		}
+	}
+	rec = protowire.AppendTag(rec, 11, protowire.Fixed64Type)
+	rec = protowire.AppendFixed64(rec, uint64(observedNs))
+	return rec
+}
+
+// severity detects the OTLP severity number from the first of OTLP_SEVERITY_FIELDS; numbers are syslog severities
+// (0 emergency .. 7 debug). Returns 0 if unknown.
+func (s *OtlpSink) severity(eve *EventJson) (int, string) {
+	for _, field := range s.severityFields {
+		value, ok := eve.Event[field]
+		if !ok {
+			continue
+		}
+		switch v := value.(type) {
+		case string:
+			if number := otlpSeverityNumbers[strings.ToLower(v)]; number > 0 {
+				return number, v
+			}
+		case float64, int, int64:
+			level, _ := toInt64(v)
+			if level >= 0 && level < int64(len(syslogSeverityNames)) {
+				name := syslogSeverityNames[level]
+				return otlpSeverityNumbers[name], name
+			}
+		}
+	}
+	return 0, ""
+}
+
+var syslogSeverityNames = []string{"emergency", "alert", "critical", "error", "warning", "notice", "info", "debug"}
+
+// SeverityNumber: TRACE=1 DEBUG=5 INFO=9 WARN=13 ERROR=17 FATAL=21 (+1..3 for finer levels)
+var otlpSeverityNumbers = map[string]int{
+	"trace": 1, "debug": 5, "info": 9, "information": 9, "informational": 9, "notice": 10,
+	"warn": 13, "warning": 13, "error": 17, "err": 17, "critical": 18, "crit": 18,
+	"alert": 19, "fatal": 21, "panic": 21, "emergency": 21, "emerg": 21,
+}
+
+func toInt64(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return int64(v), v == math.Trunc(v)
+	case int:
+		return int64(v), true
+	case int64:
+		return v, true
+	}
+	return 0, false
+}
+
+// appendOtlpKeyValue appends KeyValue { string key = 1; AnyValue value = 2; } as field num.
+func appendOtlpKeyValue(buf []byte, num protowire.Number, key string, value interface{}) []byte {
+	var kv []byte
+	kv = protowire.AppendTag(kv, 1, protowire.BytesType)
+	kv = protowire.AppendString(kv, key)
+	kv = protowire.AppendTag(kv, 2, protowire.BytesType)
+	kv = protowire.AppendBytes(kv, appendOtlpAnyValue(nil, value))
+	buf = protowire.AppendTag(buf, num, protowire.BytesType)
+	return protowire.AppendBytes(buf, kv)
+}
+
+// appendOtlpAnyValue encodes a json value as
+//
+//	AnyValue { oneof { string string_value = 1; bool bool_value = 2; int64 int_value = 3; double double_value = 4;
+//	           ArrayValue array_value = 5; KeyValueList kvlist_value = 6; } }
+//	ArrayValue { repeated AnyValue values = 1; }  KeyValueList { repeated KeyValue values = 1; }
+func appendOtlpAnyValue(buf []byte, value interface{}) []byte {
+	switch v := value.(type) {
+	case nil:
+		return buf
+	case string:
+		buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+		return protowire.AppendString(buf, v)
+	case bool:
+		buf = protowire.AppendTag(buf, 2, protowire.VarintType)
+		return protowire.AppendVarint(buf, protowire.EncodeBool(v))
+	case float64:
+		if i, ok := toInt64(v); ok && math.Abs(v) < 1<<53 {
+			buf = protowire.AppendTag(buf, 3, protowire.VarintType)
+			return protowire.AppendVarint(buf, uint64(i))
+		}
+		buf = protowire.AppendTag(buf, 4, protowire.Fixed64Type)
+		return protowire.AppendFixed64(buf, math.Float64bits(v))
+	case int, int64:
+		i, _ := toInt64(v)
+		buf = protowire.AppendTag(buf, 3, protowire.VarintType)
+		return protowire.AppendVarint(buf, uint64(i))
+	case []interface{}:
+		var arr []byte
+		for _, item := range v {
+			arr = protowire.AppendTag(arr, 1, protowire.BytesType)
+			arr = protowire.AppendBytes(arr, appendOtlpAnyValue(nil, item))
+		}
+		buf = protowire.AppendTag(buf, 5, protowire.BytesType)
+		return protowire.AppendBytes(buf, arr)
+	case map[string]interface{}:
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var list []byte
+		for _, name := range names {
+			list = appendOtlpKeyValue(list, 1, name, v[name])
+		}
+		buf = protowire.AppendTag(buf, 6, protowire.BytesType)
+		return protowire.AppendBytes(buf, list)
+	default:
+		// other types (exp: json.Number) as their json text
+		jsonData, err := json.Marshal(v)
+		if err != nil {
+			panic(kerror.Wrap(err, "MarshallingFailed", "", false))
+		}
+		buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+		return protowire.AppendBytes(buf, jsonData)
+	}
+}
+
+// decodeOtlpPartialSuccess reads ExportLogsServiceResponse { ExportLogsPartialSuccess partial_success = 1; },
+// ExportLogsPartialSuccess { int64 rejected_log_records = 1; string error_message = 2; }.
+func decodeOtlpPartialSuccess(body []byte) (int64, string) {
+	partial := otlpField(body, 1)
+	if partial == nil {
+		return 0, ""
+	}
+	var rejected int64
+	var message string
+	for len(partial) > 0 {
+		num, typ, n := protowire.ConsumeTag(partial)
+		if n < 0 {
+			break
+		}
+		partial = partial[n:]
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			v, m := protowire.ConsumeVarint(partial)
+			if m < 0 {
+				return rejected, message
+			}
+			rejected, partial = int64(v), partial[m:]
+		case num == 2 && typ == protowire.BytesType:
+			v, m := protowire.ConsumeBytes(partial)
+			if m < 0 {
+				return rejected, message
+			}
+			message, partial = string(v), partial[m:]
+		default:
+			m := protowire.ConsumeFieldValue(num, typ, partial)
+			if m < 0 {
+				return rejected, message
+			}
+			partial = partial[m:]
+		}
+	}
+	return rejected, message
+}
+
+// otlpField returns the content of the first length delimited field num, nil if missing or invalid.
+func otlpField(msg []byte, num protowire.Number) []byte {
+	for len(msg) > 0 {
+		n, typ, m := protowire.ConsumeTag(msg)
+		if m < 0 {
+			return nil
+		}
+		msg = msg[m:]
+		if n == num && typ == protowire.BytesType {
+			v, m := protowire.ConsumeBytes(msg)
+			if m < 0 {
+				return nil
+			}
+			return v
+		}
+		m = protowire.ConsumeFieldValue(n, typ, msg)
+		if m < 0 {
+			return nil
+		}
+		msg = msg[m:]
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package dao
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kerror"
+)
+
+// s3Client is the small part of the S3 API the archive sink needs (PutObject and multipart uploads), signed with
+// AWS Signature Version 4. Works with AWS S3 and S3-compatible stores (MinIO, Ceph, R2, ...).
+type s3Client struct {
+	client       *http.Client
+	endpoint     *url.URL // exp: http://localhost:9000
+	region       string
+	bucket       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	pathStyle    bool // http://host/bucket/key instead of http://bucket.host/key
+}
+
+func (c *s3Client) objectUrl(key string, query url.Values) *url.URL {
+	u := *c.endpoint
+	if c.pathStyle {
+		u.Path = "/" + c.bucket + "/" + key
+	} else {
+		u.Host = c.bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = s3CanonicalQuery(query)
+	return &u
+}
+
+// do sends a signed request, non 2xx responses are returned as error.
+func (c *s3Client) do(method string, key string, query url.Values, body []byte, contentType string) (*http.Response, []byte, error) {
+	request, err := http.NewRequest(method, c.objectUrl(key, query).String(), bytes.NewReader(body))
+	if err != nil {
+		panic(kerror.Wrap(err, "NewRequestFailed", "", false))
+	}
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	c.sign(request, body, time.Now())
+	response, err := c.client.Do(request)
+	if err != nil {
+		return nil, nil, kerror.Wrap(err, "SendRequestFailed", "", false)
+	}
+	defer response.Body.Close()
+	respBody, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, nil, kerror.Wrap(err, "ReadResponseFailed", "", false)
+	}
+	if response.StatusCode/100 != 2 {
+		return nil, nil, kerror.Create("S3RequestFailed", response.Status).With("method", method).With("key", key).With("body", truncate(string(respBody), 512))
+	}
+	return response, respBody, nil
+}
+
+func (c *s3Client) PutObject(key string, body []byte, contentType string) error {
+	_, _, err := c.do("PUT", key, nil, body, contentType)
+	return err
+}
+
+func (c *s3Client) CreateMultipartUpload(key string, contentType string) (string, error) {
+	_, respBody, err := c.do("POST", key, url.Values{"uploads": {""}}, nil, contentType)
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		UploadId string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(respBody, &result); err != nil || result.UploadId == "" {
+		return "", kerror.Create("S3InvalidResponse", "no UploadId in CreateMultipartUpload response").With("key", key)
+	}
+	return result.UploadId, nil
+}
+
+// UploadPart returns the ETag of the part.
+func (c *s3Client) UploadPart(key string, uploadId string, partNumber int, body []byte) (string, error) {
+	response, _, err := c.do("PUT", key, url.Values{"partNumber": {fmt.Sprint(partNumber)}, "uploadId": {uploadId}}, body, "")
+	if err != nil {
+		return "", err
+	}
+	return response.Header.Get("ETag"), nil
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (c *s3Client) CompleteMultipartUpload(key string, uploadId string, parts []s3CompletedPart) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		panic(kerror.Wrap(err, "MarshallingFailed", "", false))
+	}
+	_, respBody, err := c.do("POST", key, url.Values{"uploadId": {uploadId}}, body, "application/xml")
+	if err != nil {
+		return err
+	}
+	// S3 may answer 200 with an <Error> body
+	if bytes.Contains(respBody, []byte("<Error>")) {
+		return kerror.Create("S3RequestFailed", "CompleteMultipartUpload failed").With("key", key).With("body", truncate(string(respBody), 512))
+	}
+	return nil
+}
+
+// AbortMultipartUpload frees the uploaded parts of an object that is given up.
+func (c *s3Client) AbortMultipartUpload(key string, uploadId string) error {
+	_, _, err := c.do("DELETE", key, url.Values{"uploadId": {uploadId}}, nil, "")
+	return err
+}
+
+// sign adds the SigV4 headers, all headers already set on the request are signed.
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (c *s3Client) sign(request *http.Request, body []byte, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	payloadHash := sha256Hex(body)
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.sessionToken != "" {
+		request.Header.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+
+	headers := map[string]string{"host": request.URL.Host}
+	for name, values := range request.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		request.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSha256([]byte("AWS4"+c.secretKey), date)
+	key = hmacSha256(key, c.region)
+	key = hmacSha256(key, "s3")
+	key = hmacSha256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(key, stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", c.accessKey, scope, signedHeaders, signature))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape is the URI encoding of SigV4: everything but A-Z a-z 0-9 - _ . ~ is %XX (and '/' in paths).
+func s3Escape(str string, escapeSlash bool) string {
+	var sb strings.Builder
+	for i := 0; i < len(str); i++ {
+		c := str[i]
+		switch {
+		case (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~':
+			sb.WriteByte(c)
+		case c == '/' && !escapeSlash:
+			sb.WriteByte(c)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			pairs = append(pairs, s3Escape(key, true)+"="+s3Escape(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
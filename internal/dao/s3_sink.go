@@ -0,0 +1,460 @@
+package dao
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kcommon"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kerror"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/klogging"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kmetrics"
+)
+
+var (
+	S3ObjectsMetric      = kmetrics.CreateKmetric(context.Background(), "s3_archive_objects", "desc", []string{})
+	S3UploadBytesMetric  = kmetrics.CreateKmetric(context.Background(), "s3_archive_upload_bytes", "desc", []string{})
+	S3UploadErrorsMetric = kmetrics.CreateKmetric(context.Background(), "s3_archive_upload_errors", "desc", []string{"op"})
+)
+
+const s3MinPartSize = 5 * 1024 * 1024 // S3 rejects smaller parts, except the last one
+
+// S3Sink archives events as gzip NDJSON objects in an S3-compatible bucket. Events go to one open object per rendered
+// S3_PATH_TEMPLATE (exp: per index and hour), at most S3_MAX_OPEN_OBJECTS of them; to open another one the oldest is
+// completed early. Objects are uploaded in multipart parts as they fill up, and completed once they reach
+// S3_OBJECT_MAX_BYTES or S3_OBJECT_MAX_AGE_SEC; then a manifest entry is written.
+// It is a BufferingSink: a batch is done only once every object holding its events is completed, so its acks (exp:
+// kafka offsets) wait for the archive. Uploads run in uploadLoop, Send only buffers. When more than
+// S3_MAX_BUFFER_BYTES are waiting Send fails, so the batch is retried (and eventually nacked) instead. An object that
+// fails to complete S3_MAX_COMPLETE_ATTEMPTS times in a row is given up, and its batches fail.
+type S3Sink struct {
+	ctx            context.Context
+	client         *s3Client
+	pathTemplate   *eventTemplate
+	manifestPrefix string
+	hostname       string
+	partSize       int
+	maxObjectBytes int
+	maxObjectAge   time.Duration
+	maxBuffered    int
+	maxOpenObjects int
+	maxAttempts    int
+
+	mu      sync.Mutex
+	objects map[string]*s3Object // open objects by rendered path
+	closing []*s3Object          // no longer open, waiting to be completed by uploadLoop
+	unsent  int                  // bytes cut from the buffers, not uploaded yet
+	seq     int
+	closed  bool
+
+	wake    chan struct{}
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+type s3Object struct {
+	path      string // rendered S3_PATH_TEMPLATE
+	key       string
+	createdAt time.Time
+
+	// under S3Sink.mu
+	buf      bytes.Buffer // compressed data, not cut for upload yet
+	gz       *gzip.Writer // nil once the object is closed
+	events   int
+	rawBytes int
+	minTime  int64
+	maxTime  int64
+	waiters  []func(err error) // done of the batches with events in the object
+
+	// owned by uploadLoop
+	unsent   []byte // the next part, kept until it is uploaded
+	uploadId string // multipart upload, created with the first full part
+	parts    []s3CompletedPart
+	uploaded int // compressed bytes in parts
+	failures int // failed attempts to complete
+	retryAt  time.Time
+}
+
+// s3Manifest is written to S3_MANIFEST_PREFIX + <object key> + ".json" for each completed object.
+type s3Manifest struct {
+	Bucket            string `json:"bucket"`
+	Key               string `json:"key"`
+	Events            int    `json:"events"`
+	Bytes             int    `json:"bytes"`
+	UncompressedBytes int    `json:"uncompressed_bytes"`
+	MinTime           int64  `json:"min_time"` // epoch ms
+	MaxTime           int64  `json:"max_time"`
+	Parts             int    `json:"parts"`
+	CreatedAt         string `json:"created_at"`
+	CompletedAt       string `json:"completed_at"`
+	Writer            string `json:"writer"`
+}
+
+// NewS3SinkFromEnv reads S3_ENDPOINT, S3_REGION, S3_BUCKET, S3_ACCESS_KEY, S3_SECRET_KEY, S3_SESSION_TOKEN,
+// S3_PATH_STYLE, S3_PATH_TEMPLATE, S3_MANIFEST_PREFIX and the rollover limits.
+func NewS3SinkFromEnv(ctx context.Context) *S3Sink {
+	region := kcommon.GetEnvString("S3_REGION", "us-east-1")
+	endpoint, err := url.Parse(kcommon.GetEnvString("S3_ENDPOINT", fmt.Sprintf("https://s3.%s.amazonaws.com", region)))
+	if err != nil || endpoint.Host == "" {
+		panic(kerror.Create("S3SinkConfigInvalid", "invalid S3_ENDPOINT"))
+	}
+	bucket := kcommon.GetEnvString("S3_BUCKET", "")
+	if bucket == "" {
+		panic(kerror.Create("S3SinkConfigInvalid", "S3_BUCKET is required"))
+	}
+	hostname, _ := os.Hostname()
+	sink := &S3Sink{
+		ctx: ctx,
+		client: &s3Client{
+			client:       &http.Client{Timeout: time.Duration(kcommon.GetEnvInt("S3_TIMEOUT_SEC", 60)) * time.Second},
+			endpoint:     endpoint,
+			region:       region,
+			bucket:       bucket,
+			accessKey:    kcommon.GetEnvString("S3_ACCESS_KEY", ""),
+			secretKey:    kcommon.GetEnvString("S3_SECRET_KEY", ""),
+			sessionToken: kcommon.GetEnvString("S3_SESSION_TOKEN", ""),
+			pathStyle:    kcommon.GetEnvString("S3_PATH_STYLE", "true") == "true",
+		},
+		pathTemplate:   parseEventTemplate(kcommon.GetEnvString("S3_PATH_TEMPLATE", "logs/{index}/{yyyy}/{MM}/{dd}/{HH}")),
+		manifestPrefix: kcommon.GetEnvString("S3_MANIFEST_PREFIX", "_manifest/"),
+		hostname:       hostname,
+		partSize:       max(kcommon.GetEnvInt("S3_PART_SIZE_BYTES", 8*1024*1024), s3MinPartSize),
+		maxObjectBytes: kcommon.GetEnvInt("S3_OBJECT_MAX_BYTES", 128*1024*1024),
+		maxObjectAge:   time.Duration(kcommon.GetEnvInt("S3_OBJECT_MAX_AGE_SEC", 300)) * time.Second,
+		maxBuffered:    kcommon.GetEnvInt("S3_MAX_BUFFER_BYTES", 256*1024*1024),
+		maxOpenObjects: max(kcommon.GetEnvInt("S3_MAX_OPEN_OBJECTS", 100), 1),
+		maxAttempts:    max(kcommon.GetEnvInt("S3_MAX_COMPLETE_ATTEMPTS", 10), 1),
+		objects:        make(map[string]*s3Object),
+		wake:           make(chan struct{}, 1),
+		stop:           make(chan struct{}),
+		stopped:        make(chan struct{}),
+	}
+	klogging.Info(ctx).With("endpoint", endpoint.String()).With("bucket", bucket).With("pathTemplate", sink.pathTemplate.raw).With("maxObjectBytes", sink.maxObjectBytes).With("maxObjectAge", sink.maxObjectAge.String()).Log("S3Sink", "created")
+	go sink.uploadLoop()
+	return sink
+}
+
+func (s *S3Sink) Name() string {
+	return "s3"
+}
+
+// Close completes all open objects. Objects that can not be completed within S3_MAX_COMPLETE_ATTEMPTS are given up.
+func (s *S3Sink) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mu.Unlock()
+	close(s.stop)
+	<-s.stopped
+	return nil
+}
+
+// Send is SendBuffered without waiting for the objects, BatchUploader uses SendBuffered.
+func (s *S3Sink) Send(batch []*EventJson) error {
+	return s.SendBuffered(batch, func(err error) {})
+}
+
+func (s *S3Sink) SendBuffered(batch []*EventJson, done func(err error)) error {
+	lines := make([][]byte, len(batch))
+	for i, eve := range batch {
+		jsonData, err := json.Marshal(eve)
+		if err != nil {
+			panic(kerror.Wrap(err, "MarshallingFailed", "", false))
+		}
+		lines[i] = append(jsonData, '\n')
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return kerror.Create("S3ArchiveClosed", "sink is closed")
+	}
+	if buffered := s.buffered(); buffered > s.maxBuffered {
+		return kerror.Create("S3ArchiveBackpressure", "too much data waiting for upload").With("buffered", buffered)
+	}
+	acks := newAckGroup(done)
+	touched := make(map[*s3Object]struct{})
+	wake := false
+	for i, eve := range batch {
+		path := s.pathTemplate.render(eve)
+		obj, ok := s.objects[path]
+		if !ok {
+			if len(s.objects) >= s.maxOpenObjects {
+				s.closeOldest()
+				wake = true
+			}
+			obj = s.newObject(path)
+			s.objects[path] = obj
+		}
+		obj.gz.Write(lines[i])
+		obj.events++
+		obj.rawBytes += len(lines[i])
+		if obj.minTime == 0 || eve.Time < obj.minTime {
+			obj.minTime = eve.Time
+		}
+		obj.maxTime = max(obj.maxTime, eve.Time)
+		if _, ok := touched[obj]; !ok {
+			touched[obj] = struct{}{}
+			obj.waiters = append(obj.waiters, acks.hold())
+		}
+		if obj.buf.Len() >= s.partSize {
+			wake = true
+		}
+	}
+	acks.release(nil)
+	if wake {
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (s *S3Sink) newObject(path string) *s3Object {
+	s.seq++
+	now := time.Now().UTC()
+	obj := &s3Object{
+		path:      path,
+		key:       fmt.Sprintf("%s/%s-%s-%d.ndjson.gz", path, s.hostname, now.Format("20060102T150405Z"), s.seq),
+		createdAt: now,
+	}
+	obj.gz = gzip.NewWriter(&obj.buf)
+	return obj
+}
+
+// buffered is the data not uploaded yet, s.mu must be held.
+func (s *S3Sink) buffered() int {
+	total := s.unsent
+	for _, obj := range s.objects {
+		total += obj.buf.Len()
+	}
+	for _, obj := range s.closing {
+		total += obj.buf.Len()
+	}
+	return total
+}
+
+// closeObject ends the gzip stream and hands the object to uploadLoop for completion, s.mu must be held.
+func (s *S3Sink) closeObject(obj *s3Object) {
+	delete(s.objects, obj.path)
+	obj.gz.Close()
+	obj.gz = nil
+	s.closing = append(s.closing, obj)
+}
+
+func (s *S3Sink) closeOldest() {
+	var oldest *s3Object
+	for _, obj := range s.objects {
+		if oldest == nil || obj.createdAt.Before(oldest.createdAt) {
+			oldest = obj
+		}
+	}
+	if oldest != nil {
+		s.closeObject(oldest)
+	}
+}
+
+// cut moves the buffered data into the next part, s.mu must be held.
+func (s *S3Sink) cut(obj *s3Object) {
+	obj.unsent = append(obj.unsent, obj.buf.Bytes()...)
+	s.unsent += obj.buf.Len()
+	obj.buf.Reset()
+}
+
+// uploadLoop does all the uploads, so that Send never waits for S3. It runs a round every second or when Send
+// filled a part, and on Close completes every object.
+func (s *S3Sink) uploadLoop() {
+	defer close(s.stopped)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			for !s.uploadRound(true) {
+				time.Sleep(time.Second)
+			}
+			return
+		case <-s.wake:
+		case <-ticker.C:
+		}
+		s.uploadRound(false)
+	}
+}
+
+// uploadRound uploads the full parts and completes the objects that are due, all objects if final. Returns true
+// if no object is waiting for completion any more.
+func (s *S3Sink) uploadRound(final bool) bool {
+	idle := false
+	kcommon.TryCatchRun(s.ctx, func() {
+		s.mu.Lock()
+		var parts []*s3Object
+		for _, obj := range s.objects {
+			if final || time.Since(obj.createdAt) >= s.maxObjectAge || obj.uploaded+len(obj.unsent)+obj.buf.Len() >= s.maxObjectBytes {
+				s.closeObject(obj)
+				continue
+			}
+			if obj.buf.Len() >= s.partSize {
+				s.cut(obj)
+			}
+			if len(obj.unsent) > 0 {
+				parts = append(parts, obj)
+			}
+		}
+		var closing []*s3Object
+		for _, obj := range s.closing {
+			s.cut(obj)
+			if final || !time.Now().Before(obj.retryAt) {
+				closing = append(closing, obj)
+			}
+		}
+		s.mu.Unlock()
+
+		for _, obj := range parts {
+			s.uploadPart(obj)
+		}
+		var finished []*s3Object
+		for _, obj := range closing {
+			if s.complete(obj) {
+				finished = append(finished, obj)
+			}
+		}
+
+		s.mu.Lock()
+		remaining := s.closing[:0]
+		for _, obj := range s.closing {
+			if !slices.Contains(finished, obj) {
+				remaining = append(remaining, obj)
+			}
+		}
+		s.closing = remaining
+		idle = len(s.closing) == 0
+		s.mu.Unlock()
+	})
+	return idle
+}
+
+// uploadPart uploads obj.unsent as the next part; on error it is kept for the next attempt.
+func (s *S3Sink) uploadPart(obj *s3Object) bool {
+	if obj.uploadId == "" {
+		uploadId, err := s.client.CreateMultipartUpload(obj.key, "application/x-ndjson")
+		if err != nil {
+			S3UploadErrorsMetric.GetTimeSequence(s.ctx, "CreateMultipartUpload").Add(1)
+			klogging.Error(s.ctx).With("key", obj.key).With("error", err.Error()).Log("S3UploadError", "create multipart upload failed")
+			return false
+		}
+		obj.uploadId = uploadId
+	}
+	partNumber := len(obj.parts) + 1
+	etag, err := s.client.UploadPart(obj.key, obj.uploadId, partNumber, obj.unsent)
+	if err != nil {
+		S3UploadErrorsMetric.GetTimeSequence(s.ctx, "UploadPart").Add(1)
+		klogging.Error(s.ctx).With("key", obj.key).With("part", partNumber).With("error", err.Error()).Log("S3UploadError", "upload part failed")
+		return false
+	}
+	S3UploadBytesMetric.GetTimeSequence(s.ctx).Add(int64(len(obj.unsent)))
+	obj.parts = append(obj.parts, s3CompletedPart{PartNumber: partNumber, ETag: etag})
+	obj.uploaded += len(obj.unsent)
+	s.release(obj)
+	return true
+}
+
+// release drops obj.unsent once it is uploaded (or given up).
+func (s *S3Sink) release(obj *s3Object) {
+	s.mu.Lock()
+	s.unsent -= len(obj.unsent)
+	s.mu.Unlock()
+	obj.unsent = nil
+}
+
+// complete uploads the rest of a closed object and completes it, then its batches are done. Returns false if it
+// has to be tried again.
+func (s *S3Sink) complete(obj *s3Object) bool {
+	var err error
+	if obj.uploadId == "" {
+		// small object, a single put
+		if err = s.client.PutObject(obj.key, obj.unsent, "application/x-ndjson"); err != nil {
+			S3UploadErrorsMetric.GetTimeSequence(s.ctx, "PutObject").Add(1)
+			klogging.Error(s.ctx).With("key", obj.key).With("error", err.Error()).Log("S3UploadError", "put object failed")
+		} else {
+			S3UploadBytesMetric.GetTimeSequence(s.ctx).Add(int64(len(obj.unsent)))
+			obj.uploaded += len(obj.unsent)
+			s.release(obj)
+		}
+	} else if len(obj.unsent) > 0 && !s.uploadPart(obj) {
+		err = kerror.Create("S3UploadFailed", "upload part failed").With("key", obj.key)
+	} else if err = s.client.CompleteMultipartUpload(obj.key, obj.uploadId, obj.parts); err != nil {
+		S3UploadErrorsMetric.GetTimeSequence(s.ctx, "CompleteMultipartUpload").Add(1)
+		klogging.Error(s.ctx).With("key", obj.key).With("error", err.Error()).Log("S3UploadError", "complete multipart upload failed")
+	}
+	if err != nil {
+		obj.failures++
+		if obj.failures < s.maxAttempts {
+			obj.retryAt = time.Now().Add(min(time.Second<<obj.failures, time.Minute))
+			return false
+		}
+		s.giveUp(obj, err)
+		return true
+	}
+	S3ObjectsMetric.GetTimeSequence(s.ctx).Add(1)
+	klogging.Info(s.ctx).With("key", obj.key).With("events", obj.events).With("bytes", obj.uploaded).With("parts", len(obj.parts)).Log("S3ObjectCompleted", "archived")
+	s.writeManifest(obj)
+	for _, done := range obj.waiters {
+		done(nil)
+	}
+	return true
+}
+
+// giveUp drops an object that could not be completed, its batches fail (and are retried by inputs with acks).
+func (s *S3Sink) giveUp(obj *s3Object, err error) {
+	S3UploadErrorsMetric.GetTimeSequence(s.ctx, "GiveUp").Add(1)
+	klogging.Error(s.ctx).With("key", obj.key).With("events", obj.events).With("attempts", obj.failures).With("error", err.Error()).Log("S3ObjectGivenUp", "object not archived")
+	if obj.uploadId != "" {
+		if abortErr := s.client.AbortMultipartUpload(obj.key, obj.uploadId); abortErr != nil {
+			S3UploadErrorsMetric.GetTimeSequence(s.ctx, "AbortMultipartUpload").Add(1)
+		}
+	}
+	s.release(obj)
+	ke := kerror.Wrap(err, "S3ArchiveFailed", "object not archived", false).With("key", obj.key)
+	for _, done := range obj.waiters {
+		done(ke)
+	}
+}
+
+// writeManifest failures are only logged, the object itself is already archived.
+func (s *S3Sink) writeManifest(obj *s3Object) {
+	if s.manifestPrefix == "" {
+		return
+	}
+	manifest, err := json.Marshal(s3Manifest{
+		Bucket:            s.client.bucket,
+		Key:               obj.key,
+		Events:            obj.events,
+		Bytes:             obj.uploaded,
+		UncompressedBytes: obj.rawBytes,
+		MinTime:           obj.minTime,
+		MaxTime:           obj.maxTime,
+		Parts:             max(len(obj.parts), 1),
+		CreatedAt:         obj.createdAt.Format(time.RFC3339),
+		CompletedAt:       time.Now().UTC().Format(time.RFC3339),
+		Writer:            s.hostname,
+	})
+	if err != nil {
+		panic(kerror.Wrap(err, "MarshallingFailed", "", false))
+	}
+	if err := s.client.PutObject(s.manifestPrefix+obj.key+".json", manifest, "application/json"); err != nil {
+		S3UploadErrorsMetric.GetTimeSequence(s.ctx, "Manifest").Add(1)
+		klogging.Error(s.ctx).With("key", obj.key).With("error", err.Error()).Log("S3UploadError", "manifest put failed")
+	}
+}
@@ -0,0 +1,216 @@
+package dao
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kcommon"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kerror"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/klogging"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kmetrics"
+)
+
+var (
+	SinkBatchesMetric   = kmetrics.CreateKmetric(context.Background(), "sink_batches", "desc", []string{"sink", "result"})
+	SinkEventsMetric    = kmetrics.CreateKmetric(context.Background(), "sink_events", "desc", []string{"sink", "result"})
+	SinkRetriesMetric   = kmetrics.CreateKmetric(context.Background(), "sink_retries", "desc", []string{"sink"})
+	SinkElapsedMsMetric = kmetrics.CreateKmetric(context.Background(), "sink_elapsed_ms", "desc", []string{"sink"})
+)
+
+// Sink is an output that BatchUploader delivers every batch to. Send either delivers the whole batch or returns
+// an error; it may panic with a kerror, which is treated as an error. BatchUploader retries failed sends.
+// Close is called once on shutdown after the last Send, it delivers whatever the sink still buffers.
+type Sink interface {
+	Name() string
+	Send(batch []*EventJson) error
+	Close() error
+}
+
+// BufferingSink is a Sink which accepts batches before they are stored (exp: s3 collects events into large objects).
+// BatchUploader calls SendBuffered instead of Send. Once SendBuffered returned nil, the sink calls done when the
+// batch is stored (nil) or lost, and the acks of the batch wait for that.
+type BufferingSink interface {
+	Sink
+	SendBuffered(batch []*EventJson, done func(err error)) error
+}
+
+// ackGroup calls done with the first error, once its creator and every hold have been released.
+type ackGroup struct {
+	mu      sync.Mutex
+	pending int
+	err     error
+	done    func(err error)
+}
+
+func newAckGroup(done func(err error)) *ackGroup {
+	return &ackGroup{pending: 1, done: done}
+}
+
+// hold returns the release of one more holder, calling it again has no effect.
+func (g *ackGroup) hold() func(err error) {
+	g.mu.Lock()
+	g.pending++
+	g.mu.Unlock()
+	var once sync.Once
+	return func(err error) {
+		once.Do(func() {
+			g.release(err)
+		})
+	}
+}
+
+// release is the creator's release.
+func (g *ackGroup) release(err error) {
+	g.mu.Lock()
+	if err != nil && g.err == nil {
+		g.err = err
+	}
+	g.pending--
+	finished := g.pending == 0
+	g.mu.Unlock()
+	if finished {
+		g.done(g.err)
+	}
+}
+
+// PartialSendError is returned by sinks that accepted part of a batch, only Failed is retried.
+type PartialSendError struct {
+	Failed []*EventJson
+	Err    error
+}
+
+func (e *PartialSendError) Error() string {
+	return fmt.Sprintf("%d events failed: %v", len(e.Failed), e.Err)
+}
+
+func (e *PartialSendError) Unwrap() error {
+	return e.Err
+}
+
+// NewSinksFromEnv builds the sinks listed in OUTPUT_SINKS (exp: "splunk,kafka"), default is splunk only.
+func NewSinksFromEnv(ctx context.Context) []Sink {
+	var sinks []Sink
+	for _, name := range strings.Split(kcommon.GetEnvString("OUTPUT_SINKS", "splunk"), ",") {
+		switch name = strings.TrimSpace(name); name {
+		case "":
+			continue
+		case "splunk":
+			sinks = append(sinks, NewSplunkSink(ctx))
+		case "kafka":
+			sinks = append(sinks, NewKafkaSinkFromEnv(ctx))
+		case "opensearch":
+			sinks = append(sinks, NewOpenSearchSinkFromEnv(ctx))
+		case "loki":
+			sinks = append(sinks, NewLokiSinkFromEnv(ctx))
+		case "s3":
+			sinks = append(sinks, NewS3SinkFromEnv(ctx))
+		case "file":
+			sinks = append(sinks, NewFileSinkFromEnv(ctx))
+		case "clickhouse":
+			sinks = append(sinks, NewClickHouseSinkFromEnv(ctx))
+		case "webhook":
+			sinks = append(sinks, NewWebhookSinkFromEnv(ctx))
+		case "otlp":
+			sinks = append(sinks, NewOtlpSinkFromEnv(ctx))
+		default:
+			panic(kerror.Create("OutputSinkInvalid", "unknown sink in OUTPUT_SINKS").With("sink", name))
+		}
+	}
+	if len(sinks) == 0 {
+		panic(kerror.Create("OutputSinkInvalid", "OUTPUT_SINKS is empty"))
+	}
+	return sinks
+}
+
+// sinkRetry is the retry policy shared by all sinks: SINK_MAX_RETRIES attempts after the first one, waiting
+// SINK_RETRY_BACKOFF_MS, doubled after each attempt and capped at SINK_RETRY_MAX_BACKOFF_MS.
+type sinkRetry struct {
+	maxRetries int
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+func newSinkRetryFromEnv() sinkRetry {
+	return sinkRetry{
+		maxRetries: kcommon.GetEnvInt("SINK_MAX_RETRIES", 3),
+		backoff:    time.Duration(kcommon.GetEnvInt("SINK_RETRY_BACKOFF_MS", 500)) * time.Millisecond,
+		maxBackoff: time.Duration(kcommon.GetEnvInt("SINK_RETRY_MAX_BACKOFF_MS", 10000)) * time.Millisecond,
+	}
+}
+
+// send delivers one batch to one sink, retrying with backoff. Returns the last error if all attempts failed.
+// After a PartialSendError only the failed events are sent again. A BufferingSink holds acks until it stored the batch.
+func (r sinkRetry) send(ctx context.Context, sink Sink, batch []*EventJson, acks *ackGroup) error {
+	backoff := r.backoff
+	for attempt := 0; ; attempt++ {
+		startTimeMs := kcommon.GetMonoTimeMs()
+		var err error
+		var done func(err error)
+		ke := kcommon.TryCatchRun(ctx, func() {
+			if buffering, ok := sink.(BufferingSink); ok {
+				done = acks.hold()
+				err = buffering.SendBuffered(batch, done)
+			} else {
+				err = sink.Send(batch)
+			}
+		})
+		if ke != nil {
+			err = ke
+		}
+		if err != nil && done != nil {
+			done(nil) // not accepted, the error is reported below
+		}
+		SinkElapsedMsMetric.GetTimeSequence(ctx, sink.Name()).Add(kcommon.GetMonoTimeMs() - startTimeMs)
+		if err == nil {
+			SinkBatchesMetric.GetTimeSequence(ctx, sink.Name(), "success").Add(1)
+			SinkEventsMetric.GetTimeSequence(ctx, sink.Name(), "success").Add(int64(len(batch)))
+			return nil
+		}
+		var partial *PartialSendError
+		if errors.As(err, &partial) {
+			SinkEventsMetric.GetTimeSequence(ctx, sink.Name(), "success").Add(int64(len(batch) - len(partial.Failed)))
+			batch = partial.Failed
+		}
+		if attempt >= r.maxRetries {
+			SinkBatchesMetric.GetTimeSequence(ctx, sink.Name(), "failure").Add(1)
+			SinkEventsMetric.GetTimeSequence(ctx, sink.Name(), "failure").Add(int64(len(batch)))
+			klogging.Error(ctx).With("sink", sink.Name()).With("count", len(batch)).With("attempts", attempt+1).With("error", err.Error()).Log("SinkSendFailed", "giving up")
+			return err
+		}
+		SinkRetriesMetric.GetTimeSequence(ctx, sink.Name()).Add(1)
+		klogging.Info(ctx).With("sink", sink.Name()).With("count", len(batch)).With("attempt", attempt+1).With("backoff", backoff.String()).With("error", err.Error()).Log("SinkSendRetry", "retrying")
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, r.maxBackoff)
+	}
+}
+
+// sendAll delivers one batch to every sink in parallel, the batch fails if any sink failed.
+func (r sinkRetry) sendAll(ctx context.Context, sinks []Sink, batch []*EventJson, acks *ackGroup) error {
+	if len(sinks) == 1 {
+		return r.send(ctx, sinks[0], batch, acks)
+	}
+	errs := make([]error, len(sinks))
+	var wg sync.WaitGroup
+	for i, sink := range sinks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = r.send(ctx, sink, batch, acks)
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package dao
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kcommon"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kerror"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/klogging"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kmetrics"
+)
+
+var (
+	UploadBytesMetric     = kmetrics.CreateKmetric(context.Background(), "splunk_upload_bytes", "desc", []string{})
+	UploadElapsedMsMetric = kmetrics.CreateKmetric(context.Background(), "splunk_upload_elapsed_ms", "desc", []string{})
+)
+
+// SplunkSink uploads batches to Splunk HEC as newline separated events.
+type SplunkSink struct {
+	ctx    context.Context
+	client *http.Client
+}
+
+func NewSplunkSink(ctx context.Context) *SplunkSink {
+	return &SplunkSink{
+		ctx:    ctx,
+		client: &http.Client{},
+	}
+}
+
+func (s *SplunkSink) Name() string {
+	return "splunk"
+}
+
+func (s *SplunkSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+func (s *SplunkSink) Send(batch []*EventJson) error {
+	var sb strings.Builder
+	for i, eve := range batch {
+		if i > 0 {
+			sb.WriteString("\n")
+		}
+		jsonData, err := json.Marshal(eve)
+		if err != nil {
+			ke := kerror.Wrap(err, "MarshallingFailed", "", false)
+			panic(ke)
+		}
+		sb.Write(jsonData)
+	}
+	status := s.Upload(sb.String(), len(batch))
+	if !strings.HasPrefix(status, "2") {
+		return kerror.Create("UploadRejected", status)
+	}
+	return nil
+}
+
+func (s *SplunkSink) Upload(payload string, count int) string { // count is the number of events in the payload, for metrics/logging purpose only
+	size := len(payload)
+	startTimeMs := kcommon.GetMonoTimeMs()
+	klogging.Debug(s.ctx).WithDebug("payload", payload).With("count", count).Log("Upload", "started")
+	// prepare data
+	url := fmt.Sprintf("%s/services/collector/event", GetSplunkEndpoint())
+	token := GetSplunkToken()
+
+	// prepare request
+	request, err := http.NewRequest("POST", url, bytes.NewBuffer([]byte(payload)))
+	if err != nil {
+		ke := kerror.Wrap(err, "NewRequestFailed", "", false)
+		panic(ke)
+	}
+	request.Header.Set("Authorization", fmt.Sprintf("Splunk %s", token))
+	request.Header.Set("Content-Type", "application/json")
+
+	// send request
+	response, err := s.client.Do(request)
+	if err != nil {
+		ke := kerror.Wrap(err, "SendRequestFailed", "", false)
+		panic(ke)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 4096))
+		klogging.Error(s.ctx).With("response", response.Status).With("body", string(body)).With("count", count).Log("UploadRejected", "splunk error response")
+	}
+
+	elapsedMs := kcommon.GetMonoTimeMs() - startTimeMs
+	UploadBytesMetric.GetTimeSequence(s.ctx).Add(int64(size))
+	UploadElapsedMsMetric.GetTimeSequence(s.ctx).Add(int64(elapsedMs))
+	klogging.Info(s.ctx).With("response", response.Status).With("size", size).With("elapsedMs", elapsedMs).With("count", count).Log("Upload", "Completed")
+	return response.Status
+}
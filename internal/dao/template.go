@@ -0,0 +1,110 @@
+package dao
+
+import (
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kerror"
+)
+
+// eventTemplate renders names like "logs-{index}-{yyyy.MM.dd}" (index names, object paths). Placeholders are EventJson
+// fields (index, host, source, sourcetype) or a date pattern (yyyy, MM, dd, HH) applied to the event time in UTC.
+type eventTemplate struct {
+	raw    string
+	parts  []eventTemplatePart
+	escape func(string) string // optional, applied to field values
+}
+
+type eventTemplatePart struct {
+	literal string
+	field   string // index, host, source, sourcetype
+	layout  string // go time layout
+}
+
+func parseEventTemplate(raw string) *eventTemplate {
+	tmpl := &eventTemplate{raw: raw}
+	rest := raw
+	for rest != "" {
+		start := strings.IndexByte(rest, '{')
+		if start < 0 {
+			tmpl.parts = append(tmpl.parts, eventTemplatePart{literal: rest})
+			break
+		}
+		end := strings.IndexByte(rest[start:], '}')
+		if end < 0 {
+			panic(kerror.Create("EventTemplateInvalid", "unclosed {").With("template", raw))
+		}
+		if start > 0 {
+			tmpl.parts = append(tmpl.parts, eventTemplatePart{literal: rest[:start]})
+		}
+		name := rest[start+1 : start+end]
+		switch name {
+		case "index", "host", "source", "sourcetype":
+			tmpl.parts = append(tmpl.parts, eventTemplatePart{field: name})
+		default:
+			layout := strings.NewReplacer("yyyy", "2006", "MM", "01", "dd", "02", "HH", "15").Replace(name)
+			if layout == name {
+				panic(kerror.Create("EventTemplateInvalid", "unknown placeholder").With("placeholder", name).With("template", raw))
+			}
+			tmpl.parts = append(tmpl.parts, eventTemplatePart{layout: layout})
+		}
+		rest = rest[start+end+1:]
+	}
+	return tmpl
+}
+
+func (t *eventTemplate) render(eve *EventJson) string {
+	var sb strings.Builder
+	for _, part := range t.parts {
+		switch {
+		case part.field != "":
+			value := eventKey(eve, part.field)
+			if t.escape != nil {
+				value = t.escape(value)
+			}
+			sb.WriteString(value)
+		case part.layout != "":
+			timeMs := eve.Time
+			if timeMs == 0 {
+				timeMs = time.Now().UnixMilli()
+			}
+			sb.WriteString(time.UnixMilli(timeMs).UTC().Format(part.layout))
+		default:
+			sb.WriteString(part.literal)
+		}
+	}
+	return sb.String()
+}
+
+// flatDoc is the event with @timestamp from EventJson.Time; host/source/sourcetype are added unless the event has its
+// own fields of the same name. Used by sinks that store plain documents instead of HEC events.
+func flatDoc(eve *EventJson) map[string]interface{} {
+	doc := make(map[string]interface{}, len(eve.Event)+4)
+	for k, v := range eve.Event {
+		doc[k] = v
+	}
+	timeMs := eve.Time
+	if timeMs == 0 {
+		timeMs = time.Now().UnixMilli()
+	}
+	doc["@timestamp"] = time.UnixMilli(timeMs).UTC().Format("2006-01-02T15:04:05.000Z07:00")
+	for k, v := range map[string]string{"host": eve.Host, "source": eve.Source, "sourcetype": eve.SourceType} {
+		if _, ok := doc[k]; !ok && v != "" {
+			doc[k] = v
+		}
+	}
+	return doc
+}
+
+// TruncateUtf8 cuts str to at most max bytes without splitting a rune.
+func TruncateUtf8(str string, max int) string {
+	if len(str) <= max {
+		return str
+	}
+	// do not cut a multi byte rune in half
+	for max > 0 && !utf8.RuneStart(str[max]) {
+		max--
+	}
+	return str[:max]
+}
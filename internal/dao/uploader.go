@@ -2,6 +2,7 @@ package dao
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -9,6 +10,7 @@ import (
 	"os"
 
 	"github.com/xinkaiwang/shardmanager/libs/xklib/kerror"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/klogging"
 )
 
 var (
@@ -22,6 +24,10 @@ type EventJson struct {
 	Source     string                 `json:"source,omitempty"`     // exp: /var/log/syslog
 	SourceType string                 `json:"sourcetype,omitempty"` // exp: syslog
 	Index      string                 `json:"index,omitempty"`      // exp: main
+
+	// Ack (optional) is called by BatchUploader once the batch containing this event has been uploaded (err == nil)
+	// or has failed. Inputs that need at-least-once delivery (exp: kafka) use it to commit their position.
+	Ack func(err error) `json:"-"`
 }
 
 func GetUploader() Uploader {
@@ -87,7 +93,7 @@ func (uploader *SplunkUploader) Upload(eve *EventJson) string {
 		ke := kerror.Wrap(err, "MarshallingFailed", "", false)
 		panic(ke)
 	}
-	fmt.Println(string(jsonData))
+	klogging.Debug(context.Background()).WithDebug("payload", string(jsonData)).Log("Upload", "started")
 
 	// prepare request
 	request, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
@@ -106,12 +112,9 @@ func (uploader *SplunkUploader) Upload(eve *EventJson) string {
 	}
 	defer response.Body.Close()
 
-	// Read response body for debugging
 	if response.StatusCode != 200 {
-		body, readErr := io.ReadAll(response.Body)
-		if readErr == nil {
-			fmt.Printf("Splunk error response: %s\n", string(body))
-		}
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 4096))
+		klogging.Error(context.Background()).With("response", response.Status).With("body", string(body)).Log("UploadRejected", "splunk error response")
 	}
 
 	return response.Status
@@ -0,0 +1,209 @@
+package dao
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kcommon"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kerror"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/klogging"
+)
+
+const (
+	WebhookModeBatch = "batch" // one request per batch, the template gets []*EventJson
+	WebhookModeEvent = "event" // one request per event, the template gets *EventJson
+)
+
+// WebhookSink sends batches (or single events) as HTTP requests with a body rendered by a text/template. In event mode
+// only the events whose request failed are retried.
+type WebhookSink struct {
+	ctx         context.Context
+	client      *http.Client
+	url         string
+	method      string
+	headers     map[string]string
+	body        *template.Template
+	mode        string
+	concurrency int
+}
+
+// NewWebhookSinkFromEnv reads WEBHOOK_URL, WEBHOOK_METHOD, WEBHOOK_HEADERS, WEBHOOK_CONTENT_TYPE,
+// WEBHOOK_BODY_TEMPLATE (or WEBHOOK_BODY_TEMPLATE_FILE), WEBHOOK_MODE and WEBHOOK_CONCURRENCY. The url and header
+// values may reference secrets as ${ENV_NAME} or ${file:/path/to/secret}.
+func NewWebhookSinkFromEnv(ctx context.Context) *WebhookSink {
+	rawUrl := kcommon.GetEnvString("WEBHOOK_URL", "")
+	if rawUrl == "" {
+		panic(kerror.Create("WebhookSinkConfigInvalid", "WEBHOOK_URL is required"))
+	}
+	sink := &WebhookSink{
+		ctx:         ctx,
+		client:      &http.Client{Timeout: time.Duration(kcommon.GetEnvInt("WEBHOOK_TIMEOUT_SEC", 30)) * time.Second},
+		url:         interpolateSecrets(rawUrl),
+		method:      strings.ToUpper(kcommon.GetEnvString("WEBHOOK_METHOD", "POST")),
+		headers:     map[string]string{"Content-Type": kcommon.GetEnvString("WEBHOOK_CONTENT_TYPE", "application/json")},
+		mode:        kcommon.GetEnvString("WEBHOOK_MODE", WebhookModeBatch),
+		concurrency: max(kcommon.GetEnvInt("WEBHOOK_CONCURRENCY", 4), 1),
+	}
+	if sink.mode != WebhookModeBatch && sink.mode != WebhookModeEvent {
+		panic(kerror.Create("WebhookSinkConfigInvalid", "WEBHOOK_MODE must be batch or event").With("mode", sink.mode))
+	}
+	if rawHeaders := kcommon.GetEnvString("WEBHOOK_HEADERS", ""); rawHeaders != "" {
+		var headers map[string]string
+		if err := json.Unmarshal([]byte(rawHeaders), &headers); err != nil {
+			panic(kerror.Wrap(err, "WebhookSinkConfigInvalid", "WEBHOOK_HEADERS must be a json object", false))
+		}
+		for name, value := range headers {
+			sink.headers[name] = interpolateSecrets(value)
+		}
+	}
+
+	text := kcommon.GetEnvString("WEBHOOK_BODY_TEMPLATE", "")
+	if path := kcommon.GetEnvString("WEBHOOK_BODY_TEMPLATE_FILE", ""); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			panic(kerror.Wrap(err, "WebhookSinkConfigInvalid", "can not read WEBHOOK_BODY_TEMPLATE_FILE", false).With("path", path))
+		}
+		text = string(data)
+	}
+	if text == "" {
+		text = "{{json .}}"
+	}
+	body, err := template.New("webhook").Funcs(webhookTemplateFuncs).Parse(text)
+	if err != nil {
+		panic(kerror.Wrap(err, "WebhookSinkConfigInvalid", "invalid WEBHOOK_BODY_TEMPLATE", false))
+	}
+	sink.body = body
+	// log the raw url, the interpolated one may contain secrets
+	klogging.Info(ctx).With("url", rawUrl).With("method", sink.method).With("mode", sink.mode).Log("WebhookSink", "created")
+	return sink
+}
+
+var webhookTemplateFuncs = template.FuncMap{
+	// json encodes any value, exp: {{json .}} or {{json .Event}}
+	"json": func(v interface{}) (string, error) {
+		jsonData, err := json.Marshal(v)
+		return string(jsonData), err
+	},
+	// doc is the event as a flat document with @timestamp, exp: {{json (doc .)}}
+	"doc": flatDoc,
+	// time formats the event time (epoch ms) as RFC 3339
+	"time": func(ms int64) string {
+		if ms == 0 {
+			ms = time.Now().UnixMilli()
+		}
+		return time.UnixMilli(ms).UTC().Format(time.RFC3339Nano)
+	},
+}
+
+var secretRef = regexp.MustCompile(`\$\{([^}]+)\}`)
+
+// interpolateSecrets replaces ${NAME} with the env var NAME and ${file:/path} with the trimmed content of the file.
+// Missing secrets are a config error, sending requests without credentials would only fail later.
+func interpolateSecrets(str string) string {
+	return secretRef.ReplaceAllStringFunc(str, func(ref string) string {
+		name := secretRef.FindStringSubmatch(ref)[1]
+		if path, ok := strings.CutPrefix(name, "file:"); ok {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				panic(kerror.Wrap(err, "WebhookSinkConfigInvalid", "can not read secret file", false).With("path", path))
+			}
+			return strings.TrimSpace(string(data))
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			panic(kerror.Create("WebhookSinkConfigInvalid", "secret env var is not set").With("name", name))
+		}
+		return value
+	})
+}
+
+func (s *WebhookSink) Name() string {
+	return "webhook"
+}
+
+func (s *WebhookSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+func (s *WebhookSink) Send(batch []*EventJson) error {
+	if s.mode == WebhookModeBatch {
+		return s.post(batch)
+	}
+
+	// event mode: up to concurrency requests in flight, only the failed events are retried
+	var mu sync.Mutex
+	var failed []*EventJson
+	var lastErr error
+	sem := make(chan struct{}, s.concurrency)
+	var wg sync.WaitGroup
+	for _, eve := range batch {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			var err error
+			ke := kcommon.TryCatchRun(s.ctx, func() {
+				err = s.post(eve)
+			})
+			if ke != nil {
+				err = ke
+			}
+			if err != nil {
+				mu.Lock()
+				failed = append(failed, eve)
+				lastErr = err
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if lastErr == nil {
+		return nil
+	}
+	if len(failed) == len(batch) {
+		return lastErr
+	}
+	return &PartialSendError{Failed: failed, Err: lastErr}
+}
+
+// post renders the body for data (a batch or a single event) and sends it, non 2xx responses are errors.
+func (s *WebhookSink) post(data interface{}) error {
+	var body bytes.Buffer
+	if err := s.body.Execute(&body, data); err != nil {
+		panic(kerror.Wrap(err, "TemplateFailed", "", false))
+	}
+	request, err := http.NewRequest(s.method, s.url, &body)
+	if err != nil {
+		panic(kerror.Wrap(err, "NewRequestFailed", "", false))
+	}
+	for name, value := range s.headers {
+		request.Header.Set(name, value)
+	}
+	response, err := s.client.Do(request)
+	if err != nil {
+		// *url.Error contains the url, which may contain secrets
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		return kerror.Wrap(err, "SendRequestFailed", "", false)
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 == 2 {
+		io.Copy(io.Discard, response.Body)
+		return nil
+	}
+	respBody, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+	return kerror.Create("UploadRejected", response.Status).With("body", string(respBody))
+}
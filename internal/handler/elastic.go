@@ -0,0 +1,198 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/xinkaiwang/hermes/api"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kerror"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/klogging"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kmetrics"
+)
+
+// registerElasticRoutes 注册 Elasticsearch 兼容路由 (filebeat/logstash 的 elasticsearch output)
+func (h *Handler) registerElasticRoutes(mux *http.ServeMux) {
+	wrap := func(f http.HandlerFunc) http.Handler {
+		return ErrorHandlingMiddleware(elasticProductMiddleware(f))
+	}
+	// 握手/探测
+	mux.Handle("GET /{$}", wrap(h.ElasticInfoHandler))
+	mux.Handle("GET /_license", wrap(h.ElasticLicenseHandler))
+	mux.Handle("GET /_xpack", wrap(h.ElasticLicenseHandler))
+	// 模板/ILM：假装已存在，直接确认
+	for _, prefix := range []string{"/_template/{name}", "/_index_template/{name}", "/_ilm/policy/{name}"} {
+		mux.Handle("GET "+prefix, wrap(h.ElasticAckHandler))
+		mux.Handle("PUT "+prefix, wrap(h.ElasticAckHandler))
+	}
+	// 写入
+	mux.Handle("POST /_bulk", wrap(h.ElasticBulkHandler))
+	mux.Handle("POST /{index}/_bulk", wrap(h.ElasticBulkHandler))
+	mux.Handle("POST /{index}/_doc", wrap(h.ElasticDocHandler))
+	mux.Handle("POST /{index}/_doc/{id}", wrap(h.ElasticDocHandler))
+	mux.Handle("PUT /{index}/_doc/{id}", wrap(h.ElasticDocHandler))
+	mux.Handle("POST /{index}/_create/{id}", wrap(h.ElasticDocHandler))
+	mux.Handle("PUT /{index}/_create/{id}", wrap(h.ElasticDocHandler))
+}
+
+// elasticProductMiddleware 新版 ES 客户端 (>= 7.14) 会校验该响应头
+func elasticProductMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// curl http://localhost:8080/
+func (h *Handler) ElasticInfoHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	writeJson(w, http.StatusOK, h.app.ElasticInfo(r.Context()))
+}
+
+func (h *Handler) ElasticLicenseHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	writeJson(w, http.StatusOK, map[string]interface{}{
+		"license": map[string]interface{}{
+			"status": "active",
+			"type":   "basic",
+		},
+		"features": map[string]interface{}{},
+	})
+}
+
+func (h *Handler) ElasticAckHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	writeJson(w, http.StatusOK, map[string]interface{}{
+		"acknowledged": true,
+	})
+}
+
+// curl http://localhost:8080/_bulk -H 'Content-Type: application/x-ndjson' --data-binary $'{"index":{"_index":"filebeat-1"}}\n{"message":"hello"}\n'
+func (h *Handler) ElasticBulkHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	body := requestBody(w, r, h.esMaxBodyBytes)
+	defer body.Close()
+	req := parseBulkBody(body, r.PathValue("index"))
+
+	klogging.Verbose(r.Context()).
+		With("ops", len(req.Ops)).
+		Log("ElasticBulkRequest", "received bulk request")
+
+	var resp api.ElasticBulkResponse
+	kmetrics.InstrumentSummaryRunVoid(r.Context(), "biz.Bulk", func() {
+		resp = h.app.Bulk(r.Context(), req, r.RemoteAddr)
+	}, "")
+
+	klogging.Info(r.Context()).
+		With("items", len(resp.Items)).
+		With("errors", resp.Errors).
+		Log("ElasticBulkResponse", "sending bulk response")
+
+	writeJson(w, http.StatusOK, resp)
+}
+
+// curl http://localhost:8080/my-index/_doc -d '{"message":"hello"}'
+func (h *Handler) ElasticDocHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	body := requestBody(w, r, h.esMaxBodyBytes)
+	defer body.Close()
+	var doc map[string]interface{}
+	if err := json.NewDecoder(body).Decode(&doc); err != nil {
+		panic(kerror.Create("DecodingError", "failed to decode document").
+			WithErrorCode(kerror.EC_INVALID_PARAMETER).
+			With("error", err.Error()))
+	}
+
+	var resp api.ElasticItemResult
+	kmetrics.InstrumentSummaryRunVoid(r.Context(), "biz.ElasticIndex", func() {
+		resp = h.app.ElasticIndex(r.Context(), r.PathValue("index"), r.PathValue("id"), doc, r.RemoteAddr)
+	}, "")
+	writeJson(w, resp.Status, resp)
+}
+
+// requestBody 处理 Content-Encoding: gzip (filebeat 8.x 默认开启压缩)
+// 压缩前和解压后都最多读 maxBytes, 超过时读取返回 *http.MaxBytesError
+func requestBody(w http.ResponseWriter, r *http.Request, maxBytes int64) io.ReadCloser {
+	body := http.MaxBytesReader(w, r.Body, maxBytes)
+	if r.Header.Get("Content-Encoding") != "gzip" {
+		return body
+	}
+	gz, err := gzip.NewReader(body)
+	if err != nil {
+		panic(kerror.Create("DecodingError", "invalid gzip body").
+			WithErrorCode(kerror.EC_INVALID_PARAMETER).
+			With("error", err.Error()))
+	}
+	return http.MaxBytesReader(w, gz, maxBytes)
+}
+
+// parseBulkBody 解析 NDJSON：每个 action 行后跟一个文档行 (delete 除外)
+func parseBulkBody(body io.Reader, defaultIndex string) api.ElasticBulkRequest {
+	var req api.ElasticBulkRequest
+	reader := bufio.NewReader(body)
+	nextLine := func() ([]byte, bool) {
+		for {
+			line, err := reader.ReadBytes('\n')
+			if err != nil && err != io.EOF {
+				// 不能只处理读到的部分, 客户端会以为后面的文档也写入了
+				panic(kerror.Create("DecodingError", "failed to read request body").
+					WithErrorCode(kerror.EC_INVALID_PARAMETER).
+					With("error", err.Error()))
+			}
+			line = bytes.TrimSpace(line)
+			if len(line) > 0 {
+				return line, true
+			}
+			if err != nil {
+				return nil, false
+			}
+		}
+	}
+	for {
+		line, ok := nextLine()
+		if !ok {
+			break
+		}
+		var action map[string]struct {
+			Index string `json:"_index"`
+			Id    string `json:"_id"`
+		}
+		if err := json.Unmarshal(line, &action); err != nil || len(action) != 1 {
+			req.Ops = append(req.Ops, api.ElasticBulkOp{Action: "index", Index: defaultIndex, Err: "malformed action line"})
+			continue
+		}
+		for name, meta := range action {
+			op := api.ElasticBulkOp{Action: name, Index: meta.Index, Id: meta.Id}
+			if op.Index == "" {
+				op.Index = defaultIndex
+			}
+			if name != "delete" {
+				src, ok := nextLine()
+				if !ok {
+					op.Err = "missing source line"
+				} else if err := json.Unmarshal(src, &op.Doc); err != nil {
+					op.Err = "failed to parse source: " + err.Error()
+				}
+			}
+			if op.Err == "" && op.Index == "" {
+				op.Err = "index is missing"
+			}
+			req.Ops = append(req.Ops, op)
+		}
+	}
+	return req
+}
+
+func writeJson(w http.ResponseWriter, status int, resp interface{}) {
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		panic(kerror.Create("EncodingError", "failed to encode response").
+			WithErrorCode(kerror.EC_INTERNAL_ERROR).
+			With("error", err.Error()))
+	}
+}
@@ -0,0 +1,105 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/xinkaiwang/hermes/api"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kcommon"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kerror"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/klogging"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kmetrics"
+)
+
+// FirehoseHandler 实现 Kinesis Data Firehose HTTP endpoint delivery
+// (https://docs.aws.amazon.com/firehose/latest/dev/httpdeliveryrequestresponse.html)
+// 错误也必须返回 firehose 格式的响应体, 所以这里不依赖 ErrorHandlingMiddleware
+func (h *Handler) FirehoseHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	requestId := r.Header.Get("X-Amz-Firehose-Request-Id")
+
+	// 只允许 POST 方法
+	if r.Method != http.MethodPost {
+		writeFirehoseResponse(w, http.StatusMethodNotAllowed, requestId, "only POST method is allowed")
+		return
+	}
+
+	// 校验 access key, 未配置 FIREHOSE_ACCESS_KEY 时拒绝所有请求
+	accessKey := kcommon.GetEnvString("FIREHOSE_ACCESS_KEY", "")
+	if accessKey == "" || subtle.ConstantTimeCompare([]byte(accessKey), []byte(r.Header.Get("X-Amz-Firehose-Access-Key"))) != 1 {
+		klogging.Info(r.Context()).With("requestId", requestId).With("remote", r.RemoteAddr).Log("FirehoseUnauthorized", "invalid access key")
+		writeFirehoseResponse(w, http.StatusUnauthorized, requestId, "invalid access key")
+		return
+	}
+
+	var count int
+	ke := kcommon.TryCatchRun(r.Context(), func() {
+		body := requestBody(w, r, h.firehoseMaxBodyBytes)
+		defer body.Close()
+		var req api.FirehoseRequest
+		if err := json.NewDecoder(body).Decode(&req); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				panic(kerror.Create("FirehoseRequestTooLarge", "request body is too large").
+					WithErrorCode(kerror.EC_INVALID_PARAMETER).
+					With("limit", tooLarge.Limit))
+			}
+			panic(kerror.Create("DecodingError", "failed to decode request").
+				WithErrorCode(kerror.EC_INVALID_PARAMETER).
+				With("error", err.Error()))
+		}
+		if req.RequestId != "" {
+			requestId = req.RequestId
+		}
+		attributes := firehoseCommonAttributes(r)
+
+		kmetrics.InstrumentSummaryRunVoid(r.Context(), "biz.Firehose", func() {
+			count = h.app.Firehose(r.Context(), req, attributes, r.RemoteAddr)
+		}, "")
+	})
+	if ke != nil {
+		status := http.StatusInternalServerError
+		if ke.Type == "DecodingError" || ke.Type == "FirehoseInvalidRecord" {
+			status = http.StatusBadRequest
+		} else if ke.Type == "FirehoseRequestTooLarge" {
+			status = http.StatusRequestEntityTooLarge
+		}
+		klogging.Error(r.Context()).With("requestId", requestId).WithError(ke).Log("FirehoseRequestFailed", "delivery rejected")
+		writeFirehoseResponse(w, status, requestId, ke.Msg)
+		return
+	}
+
+	klogging.Info(r.Context()).
+		With("requestId", requestId).
+		With("count", count).
+		Log("FirehoseResponse", "sending firehose response")
+	writeFirehoseResponse(w, http.StatusOK, requestId, "")
+}
+
+// firehoseCommonAttributes 解析 X-Amz-Firehose-Common-Attributes: {"commonAttributes": {"k": "v"}}
+func firehoseCommonAttributes(r *http.Request) map[string]string {
+	header := r.Header.Get("X-Amz-Firehose-Common-Attributes")
+	if header == "" {
+		return nil
+	}
+	var parsed struct {
+		CommonAttributes map[string]string `json:"commonAttributes"`
+	}
+	if err := json.Unmarshal([]byte(header), &parsed); err != nil {
+		panic(kerror.Create("DecodingError", "invalid X-Amz-Firehose-Common-Attributes").
+			WithErrorCode(kerror.EC_INVALID_PARAMETER).
+			With("error", err.Error()))
+	}
+	return parsed.CommonAttributes
+}
+
+func writeFirehoseResponse(w http.ResponseWriter, status int, requestId string, errorMessage string) {
+	writeJson(w, status, api.FirehoseResponse{
+		RequestId:    requestId,
+		Timestamp:    time.Now().UnixMilli(),
+		ErrorMessage: errorMessage,
+	})
+}
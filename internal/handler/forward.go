@@ -0,0 +1,385 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/xinkaiwang/hermes/api"
+	"github.com/xinkaiwang/hermes/internal/biz"
+	"github.com/xinkaiwang/hermes/internal/msgpack"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kcommon"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kerror"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/klogging"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kmetrics"
+)
+
+var (
+	ForwardEntriesMetric = kmetrics.CreateKmetric(context.Background(), "forward_entries", "desc", []string{"mode"})
+	ForwardErrorsMetric  = kmetrics.CreateKmetric(context.Background(), "forward_errors", "desc", []string{"reason"})
+)
+
+// ForwardServer 实现 fluentd forward 协议 (https://github.com/fluent/fluentd/wiki/Forward-Protocol-Specification-v1)
+// 支持 Message / Forward / PackedForward / CompressedPackedForward 四种模式, 可选 shared key 握手和 chunk ack
+type ForwardServer struct {
+	ctx          context.Context
+	app          *biz.App
+	addr         string
+	sharedKey    string // FORWARD_SHARED_KEY, 为空则跳过握手
+	selfHostname string
+	idleTimeout  time.Duration
+	maxBytes     int // FORWARD_MAX_MESSAGE_BYTES, 单个 str/bin 的长度上限 (PackedForward 的 entries 是一个 bin)
+	maxUnzipped  int // FORWARD_MAX_DECOMPRESSED_BYTES, CompressedPackedForward 解压后的长度上限
+	maxEntries   int // FORWARD_MAX_ENTRIES, 每个消息的 entry 数上限
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+}
+
+func NewForwardServer(ctx context.Context, app *biz.App, addr string) *ForwardServer {
+	hostname, _ := os.Hostname()
+	return &ForwardServer{
+		ctx:          ctx,
+		app:          app,
+		addr:         addr,
+		sharedKey:    kcommon.GetEnvString("FORWARD_SHARED_KEY", ""),
+		selfHostname: kcommon.GetEnvString("FORWARD_SELF_HOSTNAME", hostname),
+		idleTimeout:  time.Duration(kcommon.GetEnvInt("FORWARD_IDLE_TIMEOUT_SEC", 300)) * time.Second,
+		maxBytes:     kcommon.GetEnvInt("FORWARD_MAX_MESSAGE_BYTES", msgpack.DefaultMaxBytes),
+		maxUnzipped:  kcommon.GetEnvInt("FORWARD_MAX_DECOMPRESSED_BYTES", 64*1024*1024),
+		maxEntries:   kcommon.GetEnvInt("FORWARD_MAX_ENTRIES", 100000),
+		conns:        make(map[net.Conn]struct{}),
+	}
+}
+
+func (s *ForwardServer) Addr() string {
+	return s.addr
+}
+
+// ListenAndServe 阻塞直到 Shutdown 被调用
+func (s *ForwardServer) ListenAndServe() error {
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		listener.Close()
+		return net.ErrClosed
+	}
+	s.listener = listener
+	s.mu.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return net.ErrClosed
+			}
+			klogging.Error(s.ctx).With("error", err.Error()).Log("ForwardAcceptError", "accept failed")
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+func (s *ForwardServer) Shutdown() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func (s *ForwardServer) serveConn(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	remoteAddr := remoteHost(conn.RemoteAddr())
+	ke := kcommon.TryCatchRun(s.ctx, func() {
+		reader := bufio.NewReader(&deadlineReader{conn: conn, timeout: s.idleTimeout})
+		decoder := msgpack.NewDecoderSize(reader, s.maxBytes)
+		if s.sharedKey != "" {
+			s.handshake(conn, decoder)
+		}
+		for {
+			obj, err := decoder.Decode()
+			if err != nil {
+				if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+					ForwardErrorsMetric.GetTimeSequence(s.ctx, "decode").Add(1)
+					klogging.Info(s.ctx).With("remote", remoteAddr).With("error", err.Error()).Log("ForwardConnClosed", "decode failed")
+				}
+				return
+			}
+			s.handleMessage(conn, obj, remoteAddr)
+		}
+	})
+	if ke != nil {
+		ForwardErrorsMetric.GetTimeSequence(s.ctx, ke.Type).Add(1)
+		klogging.Error(s.ctx).With("remote", remoteAddr).WithError(ke).Log("ForwardConnError", "closing connection")
+	}
+}
+
+// handshake: server 发送 HELO, client 回复 PING, server 校验后回复 PONG
+func (s *ForwardServer) handshake(conn net.Conn, decoder *msgpack.Decoder) {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	writeMsgpack(conn, []interface{}{"HELO", map[string]interface{}{
+		"nonce":     nonce,
+		"auth":      "", // 不做用户名/密码认证
+		"keepalive": true,
+	}})
+
+	obj, err := decoder.Decode()
+	if err != nil {
+		panic(kerror.Wrap(err, "ForwardHandshakeFailed", "failed to read PING", false))
+	}
+	ping, ok := obj.([]interface{})
+	if !ok || len(ping) < 4 || asString(ping[0]) != "PING" {
+		panic(kerror.Create("ForwardHandshakeFailed", "expect PING"))
+	}
+	clientHostname := asString(ping[1])
+	salt := asString(ping[2])
+	digest := asString(ping[3])
+
+	expected := forwardDigest(salt, clientHostname, string(nonce), s.sharedKey)
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(digest)) != 1 {
+		writeMsgpack(conn, []interface{}{"PONG", false, "shared_key mismatch", s.selfHostname, ""})
+		panic(kerror.Create("ForwardAuthFailed", "shared_key mismatch").With("clientHostname", clientHostname))
+	}
+	writeMsgpack(conn, []interface{}{"PONG", true, "", s.selfHostname, forwardDigest(salt, s.selfHostname, string(nonce), s.sharedKey)})
+}
+
+func forwardDigest(salt, hostname, nonce, sharedKey string) string {
+	sum := sha512.Sum512([]byte(salt + hostname + nonce + sharedKey))
+	return hex.EncodeToString(sum[:])
+}
+
+// handleMessage 根据第二个元素的类型区分模式:
+// Message: [tag, time, record, option?]
+// Forward: [tag, [[time, record], ...], option?]
+// PackedForward: [tag, <msgpack stream bin/str>, option?], option.compressed == "gzip" 时为 CompressedPackedForward
+func (s *ForwardServer) handleMessage(conn net.Conn, obj interface{}, remoteAddr string) {
+	msg, ok := obj.([]interface{})
+	if !ok || len(msg) < 2 {
+		panic(kerror.Create("ForwardInvalidMessage", fmt.Sprintf("expect array, got %T", obj)))
+	}
+	tag := asString(msg[0])
+	var option map[string]interface{}
+	var entries []api.ForwardEntry
+	var mode string
+
+	switch body := msg[1].(type) {
+	case []interface{}:
+		mode = "forward"
+		if len(body) > s.maxEntries {
+			panic(kerror.Create("ForwardTooLarge", fmt.Sprintf("%d entries exceed limit %d", len(body), s.maxEntries)))
+		}
+		for _, item := range body {
+			pair, ok := item.([]interface{})
+			if !ok || len(pair) < 2 {
+				panic(kerror.Create("ForwardInvalidMessage", "forward entry must be [time, record]"))
+			}
+			entries = append(entries, toForwardEntry(pair[0], pair[1]))
+		}
+		option = optionAt(msg, 2)
+	case []byte, string:
+		mode = "packed"
+		option = optionAt(msg, 2)
+		var stream io.Reader = bytes.NewReader(toBytes(body))
+		var unzipped *io.LimitedReader
+		if compressed, _ := option["compressed"].(string); compressed == "gzip" {
+			mode = "compressed"
+			gz, err := gzip.NewReader(stream)
+			if err != nil {
+				panic(kerror.Wrap(err, "ForwardInvalidMessage", "bad gzip payload", false))
+			}
+			defer gz.Close()
+			// 多读一个字节, 用来区分刚好到上限和超过上限
+			unzipped = &io.LimitedReader{R: gz, N: int64(s.maxUnzipped) + 1}
+			stream = unzipped
+		}
+		decoder := msgpack.NewDecoderSize(stream, s.maxBytes)
+		for {
+			item, err := decoder.Decode()
+			if unzipped != nil && unzipped.N == 0 {
+				panic(kerror.Create("ForwardTooLarge", fmt.Sprintf("decompressed payload exceeds limit %d", s.maxUnzipped)))
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				panic(kerror.Wrap(err, "ForwardInvalidMessage", "bad packed entry stream", false))
+			}
+			if len(entries) >= s.maxEntries {
+				panic(kerror.Create("ForwardTooLarge", fmt.Sprintf("entries exceed limit %d", s.maxEntries)))
+			}
+			pair, ok := item.([]interface{})
+			if !ok || len(pair) < 2 {
+				panic(kerror.Create("ForwardInvalidMessage", "packed entry must be [time, record]"))
+			}
+			entries = append(entries, toForwardEntry(pair[0], pair[1]))
+		}
+	default:
+		mode = "message"
+		if len(msg) < 3 {
+			panic(kerror.Create("ForwardInvalidMessage", "message mode must be [tag, time, record]"))
+		}
+		entries = append(entries, toForwardEntry(msg[1], msg[2]))
+		option = optionAt(msg, 3)
+	}
+
+	count := s.app.Forward(s.ctx, tag, entries, remoteAddr)
+	ForwardEntriesMetric.GetTimeSequence(s.ctx, mode).Add(int64(count))
+	klogging.Verbose(s.ctx).With("tag", tag).With("mode", mode).With("count", count).Log("ForwardMessage", "enqueued")
+
+	// 事件已进入批量上传队列后再 ack
+	if chunk, ok := option["chunk"]; ok {
+		writeMsgpack(conn, map[string]interface{}{"ack": chunk})
+	}
+}
+
+func toForwardEntry(timeVal interface{}, recordVal interface{}) api.ForwardEntry {
+	record, ok := normalizeMsgpack(recordVal).(map[string]interface{})
+	if !ok {
+		panic(kerror.Create("ForwardInvalidMessage", fmt.Sprintf("record must be a map, got %T", recordVal)))
+	}
+	return api.ForwardEntry{
+		Time:   forwardTimeMs(timeVal),
+		Record: record,
+	}
+}
+
+// forwardTimeMs 支持整数秒和 EventTime (ext type 0: 4 字节秒 + 4 字节纳秒)
+func forwardTimeMs(val interface{}) int64 {
+	switch t := val.(type) {
+	case int64:
+		return t * 1000
+	case uint64:
+		return int64(t) * 1000
+	case float64:
+		if !math.IsNaN(t) && !math.IsInf(t, 0) {
+			return int64(t * 1000)
+		}
+	case msgpack.Ext:
+		if t.Type == 0 && len(t.Data) == 8 {
+			sec := binary.BigEndian.Uint32(t.Data[0:4])
+			nsec := binary.BigEndian.Uint32(t.Data[4:8])
+			return int64(sec)*1000 + int64(nsec)/int64(time.Millisecond)
+		}
+	}
+	return time.Now().UnixMilli()
+}
+
+// normalizeMsgpack 把 bin 转成 string, 否则 json 序列化会变成 base64
+// NaN 和 ±Inf 转成 string ("NaN", "+Inf", "-Inf"), json 不能表示它们
+func normalizeMsgpack(val interface{}) interface{} {
+	switch v := val.(type) {
+	case []byte:
+		return string(v)
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return strconv.FormatFloat(v, 'g', -1, 64)
+		}
+		return v
+	case []interface{}:
+		for i := range v {
+			v[i] = normalizeMsgpack(v[i])
+		}
+		return v
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = normalizeMsgpack(v[k])
+		}
+		return v
+	case msgpack.Ext:
+		return fmt.Sprintf("ext(%d):%s", v.Type, hex.EncodeToString(v.Data))
+	}
+	return val
+}
+
+func optionAt(msg []interface{}, idx int) map[string]interface{} {
+	if len(msg) > idx {
+		if option, ok := msg[idx].(map[string]interface{}); ok {
+			return option
+		}
+	}
+	return map[string]interface{}{}
+}
+
+func asString(val interface{}) string {
+	switch v := val.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return ""
+}
+
+func toBytes(val interface{}) []byte {
+	if s, ok := val.(string); ok {
+		return []byte(s)
+	}
+	return val.([]byte)
+}
+
+func writeMsgpack(conn net.Conn, val interface{}) {
+	if _, err := conn.Write(msgpack.Encode(val)); err != nil {
+		panic(kerror.Wrap(err, "ForwardWriteFailed", "", false))
+	}
+}
+
+// remoteHost 去掉端口, 与 http 请求的 RemoteAddr 不同, tcp/udp 输入只记录 ip
+func remoteHost(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// deadlineReader 每次读之前刷新 read deadline, 空闲连接超时后关闭
+type deadlineReader struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (r *deadlineReader) Read(p []byte) (int, error) {
+	if r.timeout > 0 {
+		r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+	}
+	return r.conn.Read(p)
+}
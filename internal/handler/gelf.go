@@ -0,0 +1,393 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xinkaiwang/hermes/api"
+	"github.com/xinkaiwang/hermes/internal/biz"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kcommon"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kerror"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/klogging"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kmetrics"
+)
+
+var (
+	GelfMessagesMetric = kmetrics.CreateKmetric(context.Background(), "gelf_messages", "desc", []string{"transport"})
+	GelfErrorsMetric   = kmetrics.CreateKmetric(context.Background(), "gelf_errors", "desc", []string{"transport", "reason"})
+)
+
+const (
+	gelfChunkHeaderLen = 12  // magic(2) + message id(8) + seq num(1) + seq count(1)
+	gelfMaxChunks      = 128 // GELF spec limit
+	gelfChunkTimeout   = 5 * time.Second
+	gelfMaxPending     = 10000 // 最多同时重组的分片消息数
+)
+
+// GelfServer 接收 GELF: UDP (支持分片, gzip/zlib 压缩) 和 TCP (以 \0 分隔, 不压缩)
+type GelfServer struct {
+	ctx             context.Context
+	app             *biz.App
+	udpAddr         string // 为空则不启用
+	tcpAddr         string // 为空则不启用
+	maxMessageBytes int
+	maxPendingBytes int // 所有重组中分片的总字节数上限
+
+	mu       sync.Mutex
+	udpConn  net.PacketConn
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+}
+
+func NewGelfServer(ctx context.Context, app *biz.App, udpAddr string, tcpAddr string) *GelfServer {
+	maxMessageBytes := kcommon.GetEnvInt("GELF_MAX_MESSAGE_BYTES", 8*1024*1024)
+	return &GelfServer{
+		ctx:             ctx,
+		app:             app,
+		udpAddr:         udpAddr,
+		tcpAddr:         tcpAddr,
+		maxMessageBytes: maxMessageBytes,
+		maxPendingBytes: kcommon.GetEnvInt("GELF_MAX_PENDING_BYTES", 4*maxMessageBytes),
+		conns:           make(map[net.Conn]struct{}),
+	}
+}
+
+// ListenAndServe 启动已配置的 UDP/TCP 监听, 阻塞直到 Shutdown 被调用
+func (s *GelfServer) ListenAndServe() error {
+	errCh := make(chan error, 2)
+	count := 0
+	if s.udpAddr != "" {
+		count++
+		go func() { errCh <- s.serveUDP() }()
+	}
+	if s.tcpAddr != "" {
+		count++
+		go func() { errCh <- s.serveTCP() }()
+	}
+	var firstErr error
+	for i := 0; i < count; i++ {
+		if err := <-errCh; err != nil && firstErr == nil {
+			firstErr = err
+			// 任意一个监听失败则整体退出
+			s.Shutdown()
+		}
+	}
+	return firstErr
+}
+
+func (s *GelfServer) Shutdown() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.udpConn != nil {
+		s.udpConn.Close()
+	}
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func (s *GelfServer) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *GelfServer) serveUDP() error {
+	conn, err := net.ListenPacket("udp", s.udpAddr)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		conn.Close()
+		return net.ErrClosed
+	}
+	s.udpConn = conn
+	s.mu.Unlock()
+
+	assembler := newGelfChunkAssembler(s.maxPendingBytes)
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if s.isClosed() {
+				return net.ErrClosed
+			}
+			klogging.Error(s.ctx).With("error", err.Error()).Log("GelfUdpReadError", "read failed")
+			continue
+		}
+		packet := buf[:n]
+		if isGelfChunk(packet) {
+			// 分片需要拷贝, buf 会被下一次读覆盖
+			packet = assembler.add(append([]byte(nil), packet...), time.Now())
+			if packet == nil {
+				continue
+			}
+		}
+		s.handlePayload("udp", packet, remoteHost(addr))
+	}
+}
+
+func (s *GelfServer) serveTCP() error {
+	listener, err := net.Listen("tcp", s.tcpAddr)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		listener.Close()
+		return net.ErrClosed
+	}
+	s.listener = listener
+	s.mu.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return net.ErrClosed
+			}
+			klogging.Error(s.ctx).With("error", err.Error()).Log("GelfAcceptError", "accept failed")
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		go s.serveTCPConn(conn)
+	}
+}
+
+func (s *GelfServer) serveTCPConn(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	remoteAddr := remoteHost(conn.RemoteAddr())
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 64*1024), s.maxMessageBytes)
+	scanner.Split(splitNull)
+	for scanner.Scan() {
+		frame := bytes.TrimSpace(scanner.Bytes())
+		if len(frame) == 0 {
+			continue
+		}
+		s.handlePayload("tcp", frame, remoteAddr)
+	}
+	if err := scanner.Err(); err != nil && !errors.Is(err, net.ErrClosed) {
+		GelfErrorsMetric.GetTimeSequence(s.ctx, "tcp", "read").Add(1)
+		klogging.Info(s.ctx).With("remote", remoteAddr).With("error", err.Error()).Log("GelfConnClosed", "read failed")
+	}
+}
+
+// splitNull 是以 \0 分隔的 bufio.SplitFunc
+func splitNull(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+func (s *GelfServer) handlePayload(transport string, payload []byte, remoteAddr string) {
+	ke := kcommon.TryCatchRun(s.ctx, func() {
+		msg := parseGelf(decompressGelf(payload, s.maxMessageBytes))
+		s.app.Gelf(s.ctx, msg, remoteAddr)
+	})
+	if ke != nil {
+		GelfErrorsMetric.GetTimeSequence(s.ctx, transport, ke.Type).Add(1)
+		klogging.Info(s.ctx).With("remote", remoteAddr).WithError(ke).Log("GelfInvalidMessage", "message dropped")
+		return
+	}
+	GelfMessagesMetric.GetTimeSequence(s.ctx, transport).Add(1)
+}
+
+// decompressGelf 根据魔数识别 gzip (1f 8b) 和 zlib (78 xx), 否则视为未压缩
+func decompressGelf(payload []byte, maxBytes int) []byte {
+	var reader io.ReadCloser
+	var err error
+	switch {
+	case len(payload) >= 2 && payload[0] == 0x1f && payload[1] == 0x8b:
+		reader, err = gzip.NewReader(bytes.NewReader(payload))
+	case len(payload) >= 2 && payload[0] == 0x78:
+		reader, err = zlib.NewReader(bytes.NewReader(payload))
+	default:
+		return payload
+	}
+	if err != nil {
+		panic(kerror.Wrap(err, "GelfDecompressFailed", "", false))
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(io.LimitReader(reader, int64(maxBytes)+1))
+	if err != nil {
+		panic(kerror.Wrap(err, "GelfDecompressFailed", "", false))
+	}
+	if len(data) > maxBytes {
+		panic(kerror.Create("GelfMessageTooLarge", "decompressed message exceeds GELF_MAX_MESSAGE_BYTES"))
+	}
+	return data
+}
+
+func parseGelf(data []byte) api.GelfMessage {
+	var raw map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&raw); err != nil {
+		panic(kerror.Wrap(err, "GelfDecodingError", "invalid json", false))
+	}
+	msg := api.GelfMessage{
+		Level:      -1,
+		Additional: make(map[string]interface{}),
+	}
+	for k, v := range raw {
+		switch k {
+		case "version":
+			msg.Version, _ = v.(string)
+		case "host":
+			msg.Host, _ = v.(string)
+		case "short_message":
+			msg.ShortMessage, _ = v.(string)
+		case "full_message":
+			msg.FullMessage, _ = v.(string)
+		case "timestamp":
+			msg.Timestamp, _ = gelfNumber(v)
+		case "level":
+			if level, ok := gelfNumber(v); ok {
+				msg.Level = int(level)
+			}
+		case "_id":
+			// GELF 规范禁止 _id
+		default:
+			// facility/line/file 在 GELF 1.1 已废弃, 按附加字段处理
+			name := strings.TrimPrefix(k, "_")
+			if n, ok := v.(json.Number); ok {
+				if i, err := n.Int64(); err == nil {
+					v = i
+				} else if f, err := n.Float64(); err == nil {
+					v = f
+				}
+			}
+			msg.Additional[name] = v
+		}
+	}
+	if msg.ShortMessage == "" {
+		panic(kerror.Create("GelfDecodingError", "short_message is required"))
+	}
+	return msg
+}
+
+func gelfNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func isGelfChunk(packet []byte) bool {
+	return len(packet) >= gelfChunkHeaderLen && packet[0] == 0x1e && packet[1] == 0x0f
+}
+
+type gelfPendingMessage struct {
+	chunks    [][]byte
+	received  int
+	bytes     int
+	firstSeen time.Time
+}
+
+// gelfChunkAssembler 重组 UDP 分片, 只在 UDP 读 goroutine 中使用, 无需加锁
+// 分片总字节数超过 maxBytes 时丢弃新分片, 超时的消息被清理后才能继续接收
+type gelfChunkAssembler struct {
+	pending   map[string]*gelfPendingMessage
+	bytes     int
+	maxBytes  int
+	lastSweep time.Time
+}
+
+func newGelfChunkAssembler(maxBytes int) *gelfChunkAssembler {
+	return &gelfChunkAssembler{
+		pending:  make(map[string]*gelfPendingMessage),
+		maxBytes: maxBytes,
+	}
+}
+
+// add 返回完整消息, 尚未收齐时返回 nil
+func (a *gelfChunkAssembler) add(packet []byte, now time.Time) []byte {
+	if now.Sub(a.lastSweep) >= time.Second {
+		a.sweep(now)
+	}
+	id := string(packet[2:10])
+	seq := int(packet[10])
+	count := int(packet[11])
+	if count == 0 || count > gelfMaxChunks || seq >= count {
+		GelfErrorsMetric.GetTimeSequence(context.Background(), "udp", "BadChunk").Add(1)
+		return nil
+	}
+	chunk := packet[gelfChunkHeaderLen:]
+	if a.bytes+len(chunk) > a.maxBytes {
+		GelfErrorsMetric.GetTimeSequence(context.Background(), "udp", "TooManyPendingBytes").Add(1)
+		return nil
+	}
+	msg, ok := a.pending[id]
+	if !ok {
+		if len(a.pending) >= gelfMaxPending {
+			GelfErrorsMetric.GetTimeSequence(context.Background(), "udp", "TooManyPending").Add(1)
+			return nil
+		}
+		msg = &gelfPendingMessage{chunks: make([][]byte, count), firstSeen: now}
+		a.pending[id] = msg
+	}
+	if len(msg.chunks) != count || msg.chunks[seq] != nil {
+		return nil
+	}
+	msg.chunks[seq] = chunk
+	msg.received++
+	msg.bytes += len(chunk)
+	a.bytes += len(chunk)
+	if msg.received < count {
+		return nil
+	}
+	a.remove(id, msg)
+	return bytes.Join(msg.chunks, nil)
+}
+
+func (a *gelfChunkAssembler) sweep(now time.Time) {
+	a.lastSweep = now
+	for id, msg := range a.pending {
+		if now.Sub(msg.firstSeen) > gelfChunkTimeout {
+			a.remove(id, msg)
+			GelfErrorsMetric.GetTimeSequence(context.Background(), "udp", "ChunkTimeout").Add(1)
+		}
+	}
+}
+
+func (a *gelfChunkAssembler) remove(id string, msg *gelfPendingMessage) {
+	delete(a.pending, id)
+	a.bytes -= msg.bytes
+}
@@ -6,17 +6,24 @@ import (
 
 	"github.com/xinkaiwang/hermes/api"
 	"github.com/xinkaiwang/hermes/internal/biz"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kcommon"
 	"github.com/xinkaiwang/shardmanager/libs/xklib/kerror"
 	"github.com/xinkaiwang/shardmanager/libs/xklib/klogging"
 	"github.com/xinkaiwang/shardmanager/libs/xklib/kmetrics"
 )
 
 type Handler struct {
-	app *biz.App
+	app                  *biz.App
+	esMaxBodyBytes       int64 // ES_MAX_BODY_BYTES, _bulk 和 _doc 的 body 上限 (解压后)
+	firehoseMaxBodyBytes int64 // FIREHOSE_MAX_BODY_BYTES, firehose 最多缓冲 64MB, base64 之后大约 86MB
 }
 
 func NewHandler(app *biz.App) *Handler {
-	return &Handler{app: app}
+	return &Handler{
+		app:                  app,
+		esMaxBodyBytes:       int64(kcommon.GetEnvInt("ES_MAX_BODY_BYTES", 100*1024*1024)),
+		firehoseMaxBodyBytes: int64(kcommon.GetEnvInt("FIREHOSE_MAX_BODY_BYTES", 128*1024*1024)),
+	}
 }
 
 // RegisterRoutes 注册路由
@@ -24,6 +31,9 @@ func (h *Handler) RegisterRoutes(mux *http.ServeMux) {
 	// 包装所有处理器以添加错误处理中间件
 	mux.Handle("/api/ping", ErrorHandlingMiddleware(http.HandlerFunc(h.PingHandler)))
 	mux.Handle("/api/post", ErrorHandlingMiddleware(http.HandlerFunc(h.PostHandler)))
+	mux.Handle("/api/drains/logplex", ErrorHandlingMiddleware(http.HandlerFunc(h.LogplexHandler)))
+	mux.Handle("/api/firehose", ErrorHandlingMiddleware(http.HandlerFunc(h.FirehoseHandler)))
+	h.registerElasticRoutes(mux)
 }
 
 // PingHandler 处理 /api/ping 请求
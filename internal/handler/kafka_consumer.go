@@ -0,0 +1,275 @@
+package handler
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/xinkaiwang/hermes/internal/biz"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kcommon"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kerror"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/klogging"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kmetrics"
+)
+
+var (
+	KafkaConsumedMetric  = kmetrics.CreateKmetric(context.Background(), "kafka_consumed_records", "desc", []string{"topic"})
+	KafkaCommittedMetric = kmetrics.CreateKmetric(context.Background(), "kafka_committed_records", "desc", []string{})
+	KafkaRestartsMetric  = kmetrics.CreateKmetric(context.Background(), "kafka_consumer_restarts", "desc", []string{"reason"})
+)
+
+const (
+	kafkaAckQueueSize   = 10000
+	kafkaRestartBackoff = 5 * time.Second
+)
+
+// KafkaReader 是 consumer 用到的 *kafka.Reader 子集, 测试时可以替换成进程内的 fake
+type KafkaReader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// KafkaConsumer 从 consumer group 消费, 只有记录所在的批次上传成功后才提交 offset (at-least-once)
+// 某个批次上传失败时停止提交, 关闭 reader 并从已提交的 offset 重新消费
+type KafkaConsumer struct {
+	ctx            context.Context
+	cancel         context.CancelFunc
+	process        func(ctx context.Context, topic string, value []byte, ack func(err error)) // biz.App.Kafka
+	newReader      func() KafkaReader
+	restartBackoff time.Duration
+}
+
+// NewKafkaConsumerFromEnv 读取 KAFKA_BROKERS, KAFKA_TOPICS, KAFKA_GROUP_ID, KAFKA_COMMIT_INTERVAL_MS
+func NewKafkaConsumerFromEnv(ctx context.Context, app *biz.App) *KafkaConsumer {
+	brokers := splitList(kcommon.GetEnvString("KAFKA_BROKERS", ""))
+	topics := splitList(kcommon.GetEnvString("KAFKA_TOPICS", ""))
+	if len(brokers) == 0 || len(topics) == 0 {
+		panic(kerror.Create("KafkaConfigInvalid", "KAFKA_BROKERS and KAFKA_TOPICS are required"))
+	}
+	config := kafka.ReaderConfig{
+		Brokers:        brokers,
+		GroupID:        kcommon.GetEnvString("KAFKA_GROUP_ID", "hermes"),
+		GroupTopics:    topics,
+		MinBytes:       1,
+		MaxBytes:       kcommon.GetEnvInt("KAFKA_FETCH_MAX_BYTES", 10*1024*1024),
+		CommitInterval: time.Duration(kcommon.GetEnvInt("KAFKA_COMMIT_INTERVAL_MS", 1000)) * time.Millisecond,
+		StartOffset:    kafka.FirstOffset,
+	}
+	klogging.Info(ctx).With("brokers", brokers).With("topics", topics).With("groupId", config.GroupID).Log("KafkaConsumerConfig", "loaded")
+	return NewKafkaConsumer(ctx, app, func() KafkaReader {
+		return kafka.NewReader(config)
+	})
+}
+
+func NewKafkaConsumer(ctx context.Context, app *biz.App, newReader func() KafkaReader) *KafkaConsumer {
+	return newKafkaConsumer(ctx, app.Kafka, newReader)
+}
+
+func newKafkaConsumer(ctx context.Context, process func(ctx context.Context, topic string, value []byte, ack func(err error)), newReader func() KafkaReader) *KafkaConsumer {
+	ctx, cancel := context.WithCancel(ctx)
+	return &KafkaConsumer{
+		ctx:            ctx,
+		cancel:         cancel,
+		process:        process,
+		newReader:      newReader,
+		restartBackoff: kafkaRestartBackoff,
+	}
+}
+
+// Run 阻塞直到 Shutdown 被调用
+func (c *KafkaConsumer) Run() {
+	for c.ctx.Err() == nil {
+		c.runSession()
+		select {
+		case <-c.ctx.Done():
+		case <-time.After(c.restartBackoff):
+		}
+	}
+}
+
+func (c *KafkaConsumer) Shutdown() {
+	c.cancel()
+}
+
+// kafkaPartition 标识一个 topic 的一个 partition
+type kafkaPartition struct {
+	topic     string
+	partition int
+}
+
+type kafkaRecord struct {
+	msg   kafka.Message
+	acked bool
+}
+
+// kafkaOffsets 记录每个 partition 已 fetch 但还没有可以提交的记录 (按 fetch 顺序)
+// 记录的 ack 顺序可能和 fetch 顺序不同 (exp: multiline 合并, 多个 sink), 只能提交连续 ack 的最高 offset
+type kafkaOffsets struct {
+	mu          sync.Mutex
+	outstanding map[kafkaPartition][]*kafkaRecord
+	records     map[kafkaPartition]map[int64]*kafkaRecord
+}
+
+func newKafkaOffsets() *kafkaOffsets {
+	return &kafkaOffsets{
+		outstanding: make(map[kafkaPartition][]*kafkaRecord),
+		records:     make(map[kafkaPartition]map[int64]*kafkaRecord),
+	}
+}
+
+// fetched 必须在记录交给 app 之前调用
+func (o *kafkaOffsets) fetched(msg kafka.Message) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	key := kafkaPartition{topic: msg.Topic, partition: msg.Partition}
+	record := &kafkaRecord{msg: msg}
+	o.outstanding[key] = append(o.outstanding[key], record)
+	if o.records[key] == nil {
+		o.records[key] = make(map[int64]*kafkaRecord)
+	}
+	o.records[key][msg.Offset] = record
+}
+
+// acked 返回这个 partition 现在可以提交的最后一条记录和新增的可提交记录数, 前面还有没 ack 的记录时返回 0
+func (o *kafkaOffsets) acked(msg kafka.Message) (kafka.Message, int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	key := kafkaPartition{topic: msg.Topic, partition: msg.Partition}
+	record, ok := o.records[key][msg.Offset]
+	if !ok {
+		return kafka.Message{}, 0
+	}
+	record.acked = true
+	queue := o.outstanding[key]
+	var commit kafka.Message
+	done := 0
+	for done < len(queue) && queue[done].acked {
+		commit = queue[done].msg
+		delete(o.records[key], commit.Offset)
+		queue[done] = nil
+		done++
+	}
+	o.outstanding[key] = queue[done:]
+	return commit, done
+}
+
+// runSession 使用一个 reader 消费, 直到 Shutdown, fetch 失败或者有批次上传失败
+func (c *KafkaConsumer) runSession() {
+	reader := c.newReader()
+	offsets := newKafkaOffsets()
+	sessionCtx, cancelSession := context.WithCancel(c.ctx)
+	failed := make(chan struct{})
+	var failOnce sync.Once
+	fail := func() {
+		failOnce.Do(func() {
+			close(failed)
+			cancelSession()
+		})
+	}
+	acked := make(chan kafka.Message, kafkaAckQueueSize)
+	committerDone := make(chan struct{})
+	go func() {
+		defer close(committerDone)
+		c.commitLoop(sessionCtx, reader, offsets, acked, failed, fail)
+	}()
+	defer func() {
+		cancelSession()
+		<-committerDone
+		if err := reader.Close(); err != nil {
+			klogging.Error(c.ctx).With("error", err.Error()).Log("KafkaReaderCloseError", "close failed")
+		}
+	}()
+
+	for {
+		msg, err := reader.FetchMessage(sessionCtx)
+		if err != nil {
+			select {
+			case <-failed:
+				KafkaRestartsMetric.GetTimeSequence(c.ctx, "UploadFailed").Add(1)
+				klogging.Error(c.ctx).Log("KafkaConsumerRestart", "upload failed, restarting from committed offsets")
+			default:
+				if c.ctx.Err() == nil {
+					KafkaRestartsMetric.GetTimeSequence(c.ctx, "FetchFailed").Add(1)
+					klogging.Error(c.ctx).With("error", err.Error()).Log("KafkaConsumerRestart", "fetch failed")
+				}
+			}
+			return
+		}
+		KafkaConsumedMetric.GetTimeSequence(c.ctx, msg.Topic).Add(1)
+		offsets.fetched(msg)
+		c.process(c.ctx, msg.Topic, msg.Value, func(err error) {
+			if err != nil {
+				fail()
+				return
+			}
+			select {
+			case acked <- msg:
+			case <-sessionCtx.Done():
+			}
+		})
+	}
+}
+
+// commitLoop 只提交每个 partition 连续 ack 的最高 offset, 失败或者还没 ack 的记录之后的 offset 不会被提交
+// 一旦有失败, 之后的 ack 都不再提交, 否则会越过失败的记录
+func (c *KafkaConsumer) commitLoop(ctx context.Context, reader KafkaReader, offsets *kafkaOffsets, acked chan kafka.Message, failed chan struct{}, fail func()) {
+	for {
+		var msgs []kafka.Message
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-acked:
+			msgs = append(msgs, msg)
+		}
+		// 顺便取走已经排队的 ack, 合并成一次提交
+		for len(msgs) < 1000 {
+			select {
+			case msg := <-acked:
+				msgs = append(msgs, msg)
+				continue
+			default:
+			}
+			break
+		}
+		// 只在这个 goroutine 里推进, 提交的 offset 不会后退
+		commits := make(map[kafkaPartition]kafka.Message)
+		count := 0
+		for _, msg := range msgs {
+			if commit, n := offsets.acked(msg); n > 0 {
+				commits[kafkaPartition{topic: commit.Topic, partition: commit.Partition}] = commit
+				count += n
+			}
+		}
+		if len(commits) == 0 {
+			continue
+		}
+		select {
+		case <-failed:
+			return
+		default:
+		}
+		toCommit := make([]kafka.Message, 0, len(commits))
+		for _, msg := range commits {
+			toCommit = append(toCommit, msg)
+		}
+		if err := reader.CommitMessages(c.ctx, toCommit...); err != nil {
+			klogging.Error(c.ctx).With("error", err.Error()).With("count", len(toCommit)).Log("KafkaCommitError", "commit failed")
+			fail()
+			return
+		}
+		KafkaCommittedMetric.GetTimeSequence(c.ctx).Add(int64(count))
+	}
+}
+
+func splitList(str string) []string {
+	var list []string
+	for _, item := range strings.Split(str, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
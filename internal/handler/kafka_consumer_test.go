@@ -0,0 +1,215 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// fakeKafka hands out one fakeReader per session, each fetching its messages and then blocking until the session ends.
+type fakeKafka struct {
+	mu        sync.Mutex
+	sessions  [][]kafka.Message // messages fetched by each session, in order
+	readers   []*fakeReader
+	committed []int64 // every committed offset, in commit order
+}
+
+type fakeReader struct {
+	kafka    *fakeKafka
+	messages []kafka.Message
+	mu       sync.Mutex
+	closed   bool
+}
+
+func (f *fakeKafka) newReader() KafkaReader {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	reader := &fakeReader{kafka: f}
+	if len(f.readers) < len(f.sessions) {
+		reader.messages = f.sessions[len(f.readers)]
+	}
+	f.readers = append(f.readers, reader)
+	return reader
+}
+
+func (f *fakeKafka) commits() []int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]int64(nil), f.committed...)
+}
+
+func (f *fakeKafka) readerCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.readers)
+}
+
+func (r *fakeReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	r.mu.Lock()
+	if len(r.messages) > 0 {
+		msg := r.messages[0]
+		r.messages = r.messages[1:]
+		r.mu.Unlock()
+		return msg, nil
+	}
+	r.mu.Unlock()
+	<-ctx.Done()
+	return kafka.Message{}, ctx.Err()
+}
+
+func (r *fakeReader) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	r.kafka.mu.Lock()
+	defer r.kafka.mu.Unlock()
+	for _, msg := range msgs {
+		r.kafka.committed = append(r.kafka.committed, msg.Offset)
+	}
+	return nil
+}
+
+func (r *fakeReader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	return nil
+}
+
+func (r *fakeReader) isClosed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closed
+}
+
+func kafkaMessages(from int64, to int64) []kafka.Message {
+	var msgs []kafka.Message
+	for offset := from; offset <= to; offset++ {
+		msgs = append(msgs, kafka.Message{Topic: "logs", Partition: 0, Offset: offset, Value: []byte("{}")})
+	}
+	return msgs
+}
+
+// startKafkaConsumer runs a consumer on fake, the acks of the fetched records arrive on the returned channel in
+// fetch order (exp: offset 3 is the 4th ack of the first session).
+func startKafkaConsumer(t *testing.T, fake *fakeKafka) (*KafkaConsumer, chan func(err error)) {
+	acks := make(chan func(err error), 100)
+	consumer := newKafkaConsumer(context.Background(), func(ctx context.Context, topic string, value []byte, ack func(err error)) {
+		acks <- ack
+	}, fake.newReader)
+	consumer.restartBackoff = 10 * time.Millisecond
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		consumer.Run()
+	}()
+	t.Cleanup(func() {
+		consumer.Shutdown()
+		<-done
+	})
+	return consumer, acks
+}
+
+func nextAcks(t *testing.T, acks chan func(err error), count int) []func(err error) {
+	var result []func(err error)
+	for len(result) < count {
+		select {
+		case ack := <-acks:
+			result = append(result, ack)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %d of %d records", len(result), count)
+		}
+	}
+	return result
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// settle gives the commit loop time to commit what it (wrongly) could.
+func settle() {
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestKafkaConsumerCommitsContiguousAcks(t *testing.T) {
+	fake := &fakeKafka{sessions: [][]kafka.Message{kafkaMessages(0, 4)}}
+	_, acks := startKafkaConsumer(t, fake)
+	records := nextAcks(t, acks, 5)
+
+	// 1 and 2 are acked before 0, nothing can be committed yet
+	records[1](nil)
+	records[2](nil)
+	settle()
+	if commits := fake.commits(); len(commits) != 0 {
+		t.Fatalf("committed %v before offset 0 was acked", commits)
+	}
+
+	records[0](nil)
+	waitFor(t, "commit of offset 2", func() bool {
+		commits := fake.commits()
+		return len(commits) > 0 && commits[len(commits)-1] == 2
+	})
+
+	// 3 is not acked, the ack of 4 must not move the offset past it
+	records[4](nil)
+	settle()
+	if commits := fake.commits(); commits[len(commits)-1] != 2 {
+		t.Fatalf("committed %v past the un-acked offset 3", commits)
+	}
+
+	records[3](nil)
+	waitFor(t, "commit of offset 4", func() bool {
+		commits := fake.commits()
+		return commits[len(commits)-1] == 4
+	})
+	if fake.readerCount() != 1 {
+		t.Fatalf("restarted without a failure, %d readers", fake.readerCount())
+	}
+}
+
+func TestKafkaConsumerRestartsAfterFailedUpload(t *testing.T) {
+	fake := &fakeKafka{sessions: [][]kafka.Message{
+		kafkaMessages(0, 2),
+		kafkaMessages(1, 2), // fetched again from the committed offset
+	}}
+	_, acks := startKafkaConsumer(t, fake)
+	records := nextAcks(t, acks, 3)
+
+	records[0](nil)
+	waitFor(t, "commit of offset 0", func() bool {
+		return len(fake.commits()) == 1
+	})
+	records[2](nil)
+	records[1](errors.New("upload failed"))
+
+	waitFor(t, "restart", func() bool {
+		return fake.readerCount() == 2
+	})
+	fake.mu.Lock()
+	first := fake.readers[0]
+	fake.mu.Unlock()
+	if !first.isClosed() {
+		t.Fatal("reader of the failed session is not closed")
+	}
+	if commits := fake.commits(); !reflect.DeepEqual(commits, []int64{0}) {
+		t.Fatalf("committed %v past the failed offset 1", commits)
+	}
+
+	// the failed and the following records are consumed again
+	for _, ack := range nextAcks(t, acks, 2) {
+		ack(nil)
+	}
+	waitFor(t, "commit of offset 2", func() bool {
+		commits := fake.commits()
+		return commits[len(commits)-1] == 2
+	})
+}
@@ -0,0 +1,162 @@
+package handler
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/xinkaiwang/hermes/api"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kcommon"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kerror"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/klogging"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kmetrics"
+)
+
+// curl http://localhost:8080/api/drains/logplex -H 'Content-Type: application/logplex-1' -H 'Logplex-Drain-Token: d.xxx' -H 'Logplex-Msg-Count: 1' -H 'Logplex-Frame-Id: 1' --data-binary '83 <40>1 2012-11-30T06:45:29+00:00 host app web.3 - State changed from starting to up'
+func (h *Handler) LogplexHandler(w http.ResponseWriter, r *http.Request) {
+	// 设置响应头
+	w.Header().Set("Content-Type", "application/json")
+
+	// 只允许 POST 方法
+	if r.Method != http.MethodPost {
+		panic(kerror.Create("MethodNotAllowed", "only POST method is allowed").
+			WithErrorCode(kerror.EC_INVALID_PARAMETER))
+	}
+
+	// 校验 drain token (Logplex-Drain-Token 头, 或 drain url 中 basic auth 的密码)
+	token := r.Header.Get("Logplex-Drain-Token")
+	if _, password, ok := r.BasicAuth(); ok && password != "" {
+		token = password
+	}
+	index, ok := h.app.LogplexDrainIndex(token)
+	if !ok {
+		klogging.Info(r.Context()).With("remote", r.RemoteAddr).Log("LogplexUnauthorized", "unknown drain token")
+		writeJson(w, http.StatusUnauthorized, map[string]interface{}{
+			"error": "Unauthorized",
+			"msg":   "unknown drain token",
+		})
+		return
+	}
+
+	maxBytes := int64(kcommon.GetEnvInt("LOGPLEX_MAX_BODY_BYTES", 10*1024*1024))
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBytes))
+	if err != nil {
+		panic(kerror.Create("DecodingError", "failed to read request body").
+			WithErrorCode(kerror.EC_INVALID_PARAMETER).
+			With("error", err.Error()))
+	}
+	lines := parseLogplexBody(body)
+
+	// Logplex-Msg-Count 不一致说明请求被截断, 拒绝整帧让 logplex 重试
+	if countHeader := r.Header.Get("Logplex-Msg-Count"); countHeader != "" {
+		if count, err := strconv.Atoi(countHeader); err != nil || count != len(lines) {
+			panic(kerror.Create("LogplexMsgCountMismatch", "frame count does not match Logplex-Msg-Count").
+				WithErrorCode(kerror.EC_INVALID_PARAMETER).
+				With("header", countHeader).
+				With("parsed", len(lines)))
+		}
+	}
+
+	klogging.Verbose(r.Context()).
+		With("count", len(lines)).
+		Log("LogplexRequest", "received logplex request")
+
+	var resp api.PostResponse
+	kmetrics.InstrumentSummaryRunVoid(r.Context(), "biz.Logplex", func() {
+		resp = h.app.Logplex(r.Context(), token, index, r.Header.Get("Logplex-Frame-Id"), lines, r.RemoteAddr)
+	}, "")
+
+	writeJson(w, http.StatusOK, resp)
+}
+
+// parseLogplexBody 解析 octet counting 帧: "<len> <syslog msg><len> <syslog msg>..."
+func parseLogplexBody(body []byte) []api.LogplexLine {
+	var lines []api.LogplexLine
+	for pos := 0; pos < len(body); {
+		// 跳过帧之间可能出现的换行
+		if body[pos] == '\n' || body[pos] == '\r' {
+			pos++
+			continue
+		}
+		space := bytes.IndexByte(body[pos:min(pos+12, len(body))], ' ')
+		if space <= 0 {
+			panic(kerror.Create("LogplexInvalidFrame", "expect octet count").
+				WithErrorCode(kerror.EC_INVALID_PARAMETER).
+				With("offset", pos))
+		}
+		size, err := strconv.Atoi(string(body[pos : pos+space]))
+		if err != nil || size <= 0 || pos+space+1+size > len(body) {
+			panic(kerror.Create("LogplexInvalidFrame", "bad octet count").
+				WithErrorCode(kerror.EC_INVALID_PARAMETER).
+				With("offset", pos))
+		}
+		start := pos + space + 1
+		lines = append(lines, parseSyslog5424(string(body[start:start+size])))
+		pos = start + size
+	}
+	return lines
+}
+
+// parseSyslog5424 解析 "<PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID [SD] MSG"
+// logplex 通常省略 STRUCTURED-DATA, 所以只有以 '[' 开头时才当作 SD 跳过
+func parseSyslog5424(frame string) api.LogplexLine {
+	frame = strings.TrimRight(frame, "\r\n")
+	if !strings.HasPrefix(frame, "<") {
+		panic(kerror.Create("LogplexInvalidFrame", "missing syslog priority").
+			WithErrorCode(kerror.EC_INVALID_PARAMETER))
+	}
+	end := strings.IndexByte(frame, '>')
+	if end < 0 {
+		panic(kerror.Create("LogplexInvalidFrame", "missing syslog priority").
+			WithErrorCode(kerror.EC_INVALID_PARAMETER))
+	}
+	priority, err := strconv.Atoi(frame[1:end])
+	if err != nil {
+		panic(kerror.Create("LogplexInvalidFrame", "bad syslog priority").
+			WithErrorCode(kerror.EC_INVALID_PARAMETER))
+	}
+	// VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID REST
+	fields := strings.SplitN(frame[end+1:], " ", 7)
+	if len(fields) < 6 {
+		panic(kerror.Create("LogplexInvalidFrame", "truncated syslog header").
+			WithErrorCode(kerror.EC_INVALID_PARAMETER))
+	}
+	line := api.LogplexLine{
+		Priority:  priority,
+		Timestamp: fields[1],
+		Hostname:  fields[2],
+		AppName:   fields[3],
+		ProcId:    fields[4],
+		MsgId:     fields[5],
+	}
+	if len(fields) == 7 {
+		line.Message = skipStructuredData(fields[6])
+	}
+	return line
+}
+
+func skipStructuredData(rest string) string {
+	if !strings.HasPrefix(rest, "[") {
+		return rest
+	}
+	escaped := false
+	inValue := false
+	for i := 0; i < len(rest); i++ {
+		switch c := rest[i]; {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '"':
+			inValue = !inValue
+		case c == ']' && !inValue:
+			if i+1 < len(rest) && rest[i+1] == '[' {
+				continue
+			}
+			return strings.TrimPrefix(rest[i+1:], " ")
+		}
+	}
+	return rest
+}
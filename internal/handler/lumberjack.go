@@ -0,0 +1,393 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/xinkaiwang/hermes/internal/biz"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kcommon"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kerror"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/klogging"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kmetrics"
+)
+
+var (
+	LumberjackEventsMetric = kmetrics.CreateKmetric(context.Background(), "lumberjack_events", "desc", []string{})
+	LumberjackErrorsMetric = kmetrics.CreateKmetric(context.Background(), "lumberjack_errors", "desc", []string{"reason"})
+)
+
+const (
+	lumberjackVersion    = '2'
+	lumberjackWindow     = 'W'
+	lumberjackCompressed = 'C'
+	lumberjackJson       = 'J'
+	lumberjackData       = 'D'
+	lumberjackAck        = 'A'
+
+	lumberjackInflightWindows = 8               // 等待上传的 window 数, 超过后不再读取 (背压)
+	lumberjackKeepAlive       = 5 * time.Second // 等待上传期间发送 seq 0 的 ACK 保活, 和 logstash 一样
+)
+
+// LumberjackServer 实现 Lumberjack v2 协议 (filebeat/winlogbeat 的 logstash output)
+// 每个 window 的事件全部被输出接收后才按顺序回复 ACK, 上传失败时关闭连接, beats 会重发没有 ACK 的事件
+type LumberjackServer struct {
+	ctx          context.Context
+	app          *biz.App
+	addr         string
+	tlsConfig    *tls.Config // 为 nil 则使用明文
+	maxFrameSize int
+	maxWindow    uint32 // LUMBERJACK_MAX_WINDOW, 客户端声明的 window 更大时按这个大小分批 ACK
+	idleTimeout  time.Duration
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+}
+
+// NewLumberjackServer 读取 LUMBERJACK_TLS_CERT/LUMBERJACK_TLS_KEY 启用 TLS, LUMBERJACK_TLS_CLIENT_CA 额外要求客户端证书
+func NewLumberjackServer(ctx context.Context, app *biz.App, addr string) *LumberjackServer {
+	return &LumberjackServer{
+		ctx:          ctx,
+		app:          app,
+		addr:         addr,
+		tlsConfig:    lumberjackTlsConfig(),
+		maxFrameSize: kcommon.GetEnvInt("LUMBERJACK_MAX_FRAME_BYTES", 64*1024*1024),
+		maxWindow:    uint32(max(kcommon.GetEnvInt("LUMBERJACK_MAX_WINDOW", 4096), 1)),
+		idleTimeout:  time.Duration(kcommon.GetEnvInt("LUMBERJACK_IDLE_TIMEOUT_SEC", 300)) * time.Second,
+		conns:        make(map[net.Conn]struct{}),
+	}
+}
+
+func lumberjackTlsConfig() *tls.Config {
+	certFile := kcommon.GetEnvString("LUMBERJACK_TLS_CERT", "")
+	keyFile := kcommon.GetEnvString("LUMBERJACK_TLS_KEY", "")
+	if certFile == "" && keyFile == "" {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		panic(kerror.Wrap(err, "LumberjackTlsConfigInvalid", "failed to load LUMBERJACK_TLS_CERT/LUMBERJACK_TLS_KEY", false))
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if caFile := kcommon.GetEnvString("LUMBERJACK_TLS_CLIENT_CA", ""); caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			panic(kerror.Wrap(err, "LumberjackTlsConfigInvalid", "failed to read LUMBERJACK_TLS_CLIENT_CA", false))
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			panic(kerror.Create("LumberjackTlsConfigInvalid", "no certificate found in LUMBERJACK_TLS_CLIENT_CA"))
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config
+}
+
+func (s *LumberjackServer) Addr() string {
+	return s.addr
+}
+
+func (s *LumberjackServer) IsTls() bool {
+	return s.tlsConfig != nil
+}
+
+// ListenAndServe 阻塞直到 Shutdown 被调用
+func (s *LumberjackServer) ListenAndServe() error {
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	if s.tlsConfig != nil {
+		listener = tls.NewListener(listener, s.tlsConfig)
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		listener.Close()
+		return net.ErrClosed
+	}
+	s.listener = listener
+	s.mu.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return net.ErrClosed
+			}
+			klogging.Error(s.ctx).With("error", err.Error()).Log("LumberjackAcceptError", "accept failed")
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+func (s *LumberjackServer) Shutdown() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// lumberjackConn 记录一个连接上当前 window 的状态
+type lumberjackConn struct {
+	s          *LumberjackServer
+	conn       net.Conn
+	remoteAddr string
+	window     uint32
+	received   uint32 // 当前 window 已收到的事件数
+	pending    []map[string]interface{}
+	lastSeq    uint32
+	windows    chan *lumberjackAckWindow // 已入队等待上传的 window, 按顺序 ACK
+	stop       chan struct{}             // 读取结束
+	ackerDone  chan struct{}
+}
+
+// lumberjackAckWindow 是一次 flush 的事件, 全部 ack 后 done 收到第一个错误 (或 nil)
+type lumberjackAckWindow struct {
+	seq       uint32
+	mu        sync.Mutex
+	remaining int
+	err       error
+	done      chan error
+}
+
+func (w *lumberjackAckWindow) ack(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	w.remaining--
+	if w.remaining == 0 {
+		w.done <- w.err
+	}
+}
+
+func (s *LumberjackServer) serveConn(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	c := &lumberjackConn{
+		s:          s,
+		conn:       conn,
+		remoteAddr: remoteHost(conn.RemoteAddr()),
+		windows:    make(chan *lumberjackAckWindow, lumberjackInflightWindows),
+		stop:       make(chan struct{}),
+		ackerDone:  make(chan struct{}),
+	}
+	go c.ackLoop()
+	defer close(c.stop)
+	ke := kcommon.TryCatchRun(s.ctx, func() {
+		reader := bufio.NewReader(&deadlineReader{conn: conn, timeout: s.idleTimeout})
+		for {
+			if !c.readFrame(reader) {
+				return
+			}
+			// 客户端没有发送 window 帧时, 每帧都立即 ack
+			if c.window == 0 {
+				c.flush()
+			}
+		}
+	})
+	if ke != nil {
+		LumberjackErrorsMetric.GetTimeSequence(s.ctx, ke.Type).Add(1)
+		klogging.Error(s.ctx).With("remote", c.remoteAddr).WithError(ke).Log("LumberjackConnError", "closing connection")
+	}
+}
+
+// readFrame 读取并处理一帧, 连接正常关闭时返回 false
+func (c *lumberjackConn) readFrame(reader *bufio.Reader) bool {
+	var header [2]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		if err == io.EOF || errors.Is(err, net.ErrClosed) {
+			return false
+		}
+		panic(kerror.Wrap(err, "LumberjackReadFailed", "", false))
+	}
+	if header[0] != lumberjackVersion {
+		panic(kerror.Create("LumberjackUnsupportedVersion", fmt.Sprintf("unsupported protocol version %q", header[0])))
+	}
+	switch header[1] {
+	case lumberjackWindow:
+		c.window = c.readUint32(reader)
+		c.received = 0
+	case lumberjackCompressed:
+		size := c.readUint32(reader)
+		if int(size) > c.s.maxFrameSize {
+			panic(kerror.Create("LumberjackFrameTooLarge", fmt.Sprintf("compressed frame of %d bytes", size)))
+		}
+		frame := io.LimitReader(reader, int64(size))
+		zr, err := zlib.NewReader(frame)
+		if err != nil {
+			panic(kerror.Wrap(err, "LumberjackDecompressFailed", "", false))
+		}
+		payload, err := io.ReadAll(io.LimitReader(zr, int64(c.s.maxFrameSize)+1))
+		zr.Close()
+		if err != nil {
+			panic(kerror.Wrap(err, "LumberjackDecompressFailed", "", false))
+		}
+		// zlib 流之后可能还有字节, 读完整个帧, 下一帧才能对齐
+		if _, err := io.Copy(io.Discard, frame); err != nil {
+			panic(kerror.Wrap(err, "LumberjackReadFailed", "", false))
+		}
+		if len(payload) > c.s.maxFrameSize {
+			panic(kerror.Create("LumberjackFrameTooLarge", "decompressed frame exceeds LUMBERJACK_MAX_FRAME_BYTES"))
+		}
+		inner := bufio.NewReader(bytes.NewReader(payload))
+		for c.readFrame(inner) {
+		}
+	case lumberjackJson:
+		seq := c.readUint32(reader)
+		payload := c.readBytes(reader, c.readUint32(reader))
+		var event map[string]interface{}
+		if err := json.Unmarshal(payload, &event); err != nil {
+			panic(kerror.Wrap(err, "LumberjackDecodingError", "invalid json data frame", false))
+		}
+		c.addEvent(seq, event)
+	case lumberjackData:
+		seq := c.readUint32(reader)
+		pairs := c.readUint32(reader)
+		event := make(map[string]interface{}, min(pairs, 1024))
+		for i := uint32(0); i < pairs; i++ {
+			key := c.readBytes(reader, c.readUint32(reader))
+			value := c.readBytes(reader, c.readUint32(reader))
+			event[string(key)] = string(value)
+		}
+		c.addEvent(seq, event)
+	default:
+		panic(kerror.Create("LumberjackUnknownFrame", fmt.Sprintf("unknown frame type %q", header[1])))
+	}
+	return true
+}
+
+// addEvent 收集事件, window 收齐或者攒够 maxWindow 个时 flush
+func (c *lumberjackConn) addEvent(seq uint32, event map[string]interface{}) {
+	c.pending = append(c.pending, event)
+	c.lastSeq = seq
+	c.received++
+	if c.window > 0 && (c.received >= c.window || uint32(len(c.pending)) >= c.s.maxWindow) {
+		c.flush()
+	}
+}
+
+// flush 把当前 window 交给 biz 入队, ackLoop 在所有事件上传后 ack 最后一个 seq
+func (c *lumberjackConn) flush() {
+	if len(c.pending) == 0 {
+		return
+	}
+	window := &lumberjackAckWindow{seq: c.lastSeq, remaining: len(c.pending), done: make(chan error, 1)}
+	select {
+	case c.windows <- window:
+	case <-c.ackerDone:
+		panic(kerror.Create("LumberjackConnClosed", "upload failed or connection closed"))
+	}
+	count := c.s.app.Beats(c.s.ctx, c.pending, c.remoteAddr, window.ack)
+	LumberjackEventsMetric.GetTimeSequence(c.s.ctx).Add(int64(count))
+	klogging.Verbose(c.s.ctx).With("remote", c.remoteAddr).With("count", count).With("seq", c.lastSeq).Log("LumberjackWindow", "window enqueued")
+	c.pending = nil
+}
+
+// ackLoop 按顺序等待每个 window 上传完成并回复 ACK, 等待期间定时发送 seq 0 的 ACK, 避免 beats 超时
+// 上传失败时关闭连接, 不再 ACK 之后的 window
+func (c *lumberjackConn) ackLoop() {
+	defer close(c.ackerDone)
+	ticker := time.NewTicker(lumberjackKeepAlive)
+	defer ticker.Stop()
+	for {
+		var window *lumberjackAckWindow
+		select {
+		case window = <-c.windows:
+		case <-c.stop:
+			return
+		}
+		for waiting := true; waiting; {
+			select {
+			case err := <-window.done:
+				if err != nil {
+					LumberjackErrorsMetric.GetTimeSequence(c.s.ctx, "UploadFailed").Add(1)
+					klogging.Error(c.s.ctx).With("remote", c.remoteAddr).With("seq", window.seq).With("error", err.Error()).Log("LumberjackUploadFailed", "closing connection, beats will resend")
+					c.conn.Close()
+					return
+				}
+				if !c.writeAck(window.seq) {
+					return
+				}
+				klogging.Verbose(c.s.ctx).With("remote", c.remoteAddr).With("seq", window.seq).Log("LumberjackAck", "window uploaded")
+				waiting = false
+			case <-ticker.C:
+				if !c.writeAck(0) {
+					return
+				}
+			case <-c.stop:
+				return
+			}
+		}
+	}
+}
+
+func (c *lumberjackConn) writeAck(seq uint32) bool {
+	ack := []byte{lumberjackVersion, lumberjackAck, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(ack[2:], seq)
+	if _, err := c.conn.Write(ack); err != nil {
+		if !errors.Is(err, net.ErrClosed) {
+			LumberjackErrorsMetric.GetTimeSequence(c.s.ctx, "LumberjackWriteFailed").Add(1)
+			klogging.Info(c.s.ctx).With("remote", c.remoteAddr).With("error", err.Error()).Log("LumberjackWriteFailed", "closing connection")
+		}
+		c.conn.Close()
+		return false
+	}
+	return true
+}
+
+func (c *lumberjackConn) readUint32(reader io.Reader) uint32 {
+	var buf [4]byte
+	if _, err := io.ReadFull(reader, buf[:]); err != nil {
+		panic(kerror.Wrap(err, "LumberjackReadFailed", "", false))
+	}
+	return binary.BigEndian.Uint32(buf[:])
+}
+
+func (c *lumberjackConn) readBytes(reader io.Reader, size uint32) []byte {
+	if int(size) > c.s.maxFrameSize {
+		panic(kerror.Create("LumberjackFrameTooLarge", fmt.Sprintf("field of %d bytes", size)))
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		panic(kerror.Wrap(err, "LumberjackReadFailed", "", false))
+	}
+	return buf
+}
@@ -0,0 +1,349 @@
+// Package msgpack is a minimal MessagePack codec, just enough for the fluentd forward protocol.
+// Decoded values are: nil, bool, int64, uint64, float64, string, []byte, []interface{}, map[string]interface{} and Ext.
+package msgpack
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kerror"
+)
+
+const (
+	maxContainerLen = 16 * 1024 * 1024 // guard against hostile length prefixes
+	maxDepth        = 100              // nested arrays and maps, deeper input would overflow the stack
+	DefaultMaxBytes = 16 * 1024 * 1024 // str, bin and ext length limit of NewDecoder
+	readChunkSize   = 64 * 1024        // longer values are read in chunks, so a length prefix alone allocates nothing
+)
+
+// Ext is an application specific extension type, exp: fluentd EventTime is type 0.
+type Ext struct {
+	Type int8
+	Data []byte
+}
+
+type Decoder struct {
+	r        *bufio.Reader
+	maxBytes int
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return NewDecoderSize(r, DefaultMaxBytes)
+}
+
+// NewDecoderSize returns a Decoder which rejects str, bin and ext values longer than maxBytes.
+func NewDecoderSize(r io.Reader, maxBytes int) *Decoder {
+	if br, ok := r.(*bufio.Reader); ok {
+		return &Decoder{r: br, maxBytes: maxBytes}
+	}
+	return &Decoder{r: bufio.NewReader(r), maxBytes: maxBytes}
+}
+
+// Decode reads the next object from the stream. It returns io.EOF only if the stream ends cleanly between objects.
+func (d *Decoder) Decode() (interface{}, error) {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	v, err := d.decodeWithPrefix(b, 0)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return v, err
+}
+
+func (d *Decoder) decodeNext(depth int) (interface{}, error) {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	return d.decodeWithPrefix(b, depth)
+}
+
+// decodeWithPrefix decodes the value starting with b, depth is the number of arrays and maps it is nested in.
+func (d *Decoder) decodeWithPrefix(b byte, depth int) (interface{}, error) {
+	switch {
+	case b <= 0x7f:
+		return int64(b), nil
+	case b >= 0xe0:
+		return int64(int8(b)), nil
+	case b&0xf0 == 0x80:
+		return d.decodeMap(int(b&0x0f), depth)
+	case b&0xf0 == 0x90:
+		return d.decodeArray(int(b&0x0f), depth)
+	case b&0xe0 == 0xa0:
+		return d.readString(int(b & 0x1f))
+	}
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.readByteLen(b - 0xc4)
+		if err != nil {
+			return nil, err
+		}
+		return d.readBytes(n)
+	case 0xc7, 0xc8, 0xc9:
+		n, err := d.readByteLen(b - 0xc7)
+		if err != nil {
+			return nil, err
+		}
+		return d.readExt(n)
+	case 0xca:
+		buf, err := d.readBytes(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(buf))), nil
+	case 0xcb:
+		buf, err := d.readBytes(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(buf)), nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		buf, err := d.readBytes(1 << (b - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		u := readUint(buf)
+		if u <= math.MaxInt64 {
+			return int64(u), nil
+		}
+		return u, nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		buf, err := d.readBytes(1 << (b - 0xd0))
+		if err != nil {
+			return nil, err
+		}
+		u := readUint(buf)
+		shift := 64 - 8*uint(len(buf))
+		return int64(u<<shift) >> shift, nil
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return d.readExt(1 << (b - 0xd4))
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.readByteLen(b - 0xd9)
+		if err != nil {
+			return nil, err
+		}
+		return d.readString(n)
+	case 0xdc, 0xdd:
+		n, err := d.readLen(b - 0xdc + 1)
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeArray(n, depth)
+	case 0xde, 0xdf:
+		n, err := d.readLen(b - 0xde + 1)
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeMap(n, depth)
+	}
+	return nil, kerror.Create("MsgpackInvalidPrefix", fmt.Sprintf("unknown prefix byte 0x%02x", b))
+}
+
+// readLen reads a 1/2/4 byte big endian length, sizeIdx is 0/1/2.
+func (d *Decoder) readLen(sizeIdx byte) (int, error) {
+	buf, err := d.readBytes(1 << sizeIdx)
+	if err != nil {
+		return 0, err
+	}
+	n := readUint(buf)
+	if n > maxContainerLen {
+		return 0, kerror.Create("MsgpackTooLarge", fmt.Sprintf("length %d exceeds limit", n))
+	}
+	return int(n), nil
+}
+
+// readByteLen is readLen for str, bin and ext, limited to maxBytes.
+func (d *Decoder) readByteLen(sizeIdx byte) (int, error) {
+	buf, err := d.readBytes(1 << sizeIdx)
+	if err != nil {
+		return 0, err
+	}
+	n := readUint(buf)
+	if n > uint64(d.maxBytes) {
+		return 0, kerror.Create("MsgpackTooLarge", fmt.Sprintf("length %d exceeds limit %d", n, d.maxBytes))
+	}
+	return int(n), nil
+}
+
+// readBytes reads n bytes. Long values grow with the data actually received instead of being allocated up front.
+func (d *Decoder) readBytes(n int) ([]byte, error) {
+	if n <= readChunkSize {
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(d.r, buf); err != nil {
+			return nil, err
+		}
+		return buf, nil
+	}
+	var buf bytes.Buffer
+	buf.Grow(readChunkSize)
+	if _, err := io.CopyN(&buf, d.r, int64(n)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (d *Decoder) readString(n int) (string, error) {
+	buf, err := d.readBytes(n)
+	return string(buf), err
+}
+
+func (d *Decoder) readExt(n int) (Ext, error) {
+	t, err := d.r.ReadByte()
+	if err != nil {
+		return Ext{}, err
+	}
+	buf, err := d.readBytes(n)
+	return Ext{Type: int8(t), Data: buf}, err
+}
+
+func (d *Decoder) decodeArray(n int, depth int) (interface{}, error) {
+	if n > maxContainerLen {
+		return nil, kerror.Create("MsgpackTooLarge", fmt.Sprintf("array length %d exceeds limit", n))
+	}
+	if depth >= maxDepth {
+		return nil, kerror.Create("MsgpackTooDeep", fmt.Sprintf("nesting exceeds %d levels", maxDepth))
+	}
+	arr := make([]interface{}, 0, min(n, 1024))
+	for i := 0; i < n; i++ {
+		v, err := d.decodeNext(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		arr = append(arr, v)
+	}
+	return arr, nil
+}
+
+func (d *Decoder) decodeMap(n int, depth int) (interface{}, error) {
+	if n > maxContainerLen {
+		return nil, kerror.Create("MsgpackTooLarge", fmt.Sprintf("map length %d exceeds limit", n))
+	}
+	if depth >= maxDepth {
+		return nil, kerror.Create("MsgpackTooDeep", fmt.Sprintf("nesting exceeds %d levels", maxDepth))
+	}
+	m := make(map[string]interface{}, min(n, 1024))
+	for i := 0; i < n; i++ {
+		k, err := d.decodeNext(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		v, err := d.decodeNext(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		switch key := k.(type) {
+		case string:
+			m[key] = v
+		case []byte:
+			m[string(key)] = v
+		default:
+			m[fmt.Sprint(key)] = v
+		}
+	}
+	return m, nil
+}
+
+func readUint(buf []byte) uint64 {
+	var u uint64
+	for _, b := range buf {
+		u = u<<8 | uint64(b)
+	}
+	return u
+}
+
+// Encode serializes nil, bool, ints, float64, string, []byte, []interface{}, map[string]interface{} and Ext.
+// Map keys are written in sorted order so the output is deterministic.
+func Encode(v interface{}) []byte {
+	return appendValue(nil, v)
+}
+
+func appendValue(buf []byte, v interface{}) []byte {
+	switch val := v.(type) {
+	case nil:
+		return append(buf, 0xc0)
+	case bool:
+		if val {
+			return append(buf, 0xc3)
+		}
+		return append(buf, 0xc2)
+	case int:
+		return appendInt(buf, int64(val))
+	case int64:
+		return appendInt(buf, val)
+	case uint64:
+		if val <= math.MaxInt64 {
+			return appendInt(buf, int64(val))
+		}
+		return binary.BigEndian.AppendUint64(append(buf, 0xcf), val)
+	case float64:
+		return binary.BigEndian.AppendUint64(append(buf, 0xcb), math.Float64bits(val))
+	case string:
+		buf = appendHeader(buf, len(val), 0xa0, 31, 0xd9, 0xda, 0xdb)
+		return append(buf, val...)
+	case []byte:
+		buf = appendHeader(buf, len(val), 0, -1, 0xc4, 0xc5, 0xc6)
+		return append(buf, val...)
+	case []interface{}:
+		buf = appendHeader(buf, len(val), 0x90, 15, 0, 0xdc, 0xdd)
+		for _, item := range val {
+			buf = appendValue(buf, item)
+		}
+		return buf
+	case map[string]interface{}:
+		buf = appendHeader(buf, len(val), 0x80, 15, 0, 0xde, 0xdf)
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			buf = appendValue(buf, k)
+			buf = appendValue(buf, val[k])
+		}
+		return buf
+	case Ext:
+		buf = appendHeader(buf, len(val.Data), 0, -1, 0xc7, 0xc8, 0xc9)
+		buf = append(buf, byte(val.Type))
+		return append(buf, val.Data...)
+	}
+	panic(kerror.Create("MsgpackUnsupportedType", fmt.Sprintf("cannot encode %T", v)))
+}
+
+func appendInt(buf []byte, i int64) []byte {
+	switch {
+	case i >= 0 && i <= 0x7f:
+		return append(buf, byte(i))
+	case i < 0 && i >= -32:
+		return append(buf, byte(int8(i)))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		return binary.BigEndian.AppendUint32(append(buf, 0xd2), uint32(int32(i)))
+	}
+	return binary.BigEndian.AppendUint64(append(buf, 0xd3), uint64(i))
+}
+
+// appendHeader writes a fix header (fixBase|n) when n <= fixMax, otherwise the smallest of the 8/16/32 bit
+// length variants. prefix8 is 0 for types without an 8 bit variant (array, map).
+func appendHeader(buf []byte, n int, fixBase byte, fixMax int, prefix8, prefix16, prefix32 byte) []byte {
+	switch {
+	case n <= fixMax:
+		return append(buf, fixBase|byte(n))
+	case prefix8 != 0 && n <= math.MaxUint8:
+		return append(buf, prefix8, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, prefix16), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(buf, prefix32), uint32(n))
+}
@@ -0,0 +1,268 @@
+package pipeline
+
+import (
+	"container/list"
+	"context"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/xinkaiwang/hermes/internal/dao"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kerror"
+)
+
+// dedupStage forwards the first limit events with the same fingerprint per window and drops the rest. Once the
+// window is over a summary event with the suppressed count is emitted, exp:
+//
+//	{"type": "dedup", "fields": ["@host", "message"], "window": "1m", "limit": 3}
+//
+// The summary has the fingerprint fields of the first event plus summary_field: {"suppressed": 1234,
+// "first_seen": <epoch ms>, "last_seen": <epoch ms>, "window_sec": 60}. At most max_keys fingerprints are tracked,
+// the least recently seen one is summarized and forgotten first. The summary keeps at most max_field_bytes of each
+// fingerprint field, so a key costs the same whatever the size of the events. Suppressed events count as dropped in
+// pipeline_stage_events.
+type dedupStage struct {
+	Fields        []string `json:"fields"`          // default @host, @source, message
+	Window        string   `json:"window"`          // go duration, default 60s
+	Limit         int      `json:"limit"`           // events forwarded per fingerprint and window, default 1
+	MaxKeys       int      `json:"max_keys"`        // default 10000
+	MaxFieldBytes int      `json:"max_field_bytes"` // per fingerprint field kept for the summary, default 1024
+	SummaryField  string   `json:"summary_field"`   // default dedup
+	window        time.Duration
+
+	mu      sync.Mutex
+	entries map[[16]byte]*list.Element
+	lru     *list.List // of *dedupEntry, most recently seen first
+	emit    func(eve *dao.EventJson)
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+type dedupEntry struct {
+	key        [16]byte
+	start      time.Time
+	last       time.Time
+	count      int
+	suppressed int
+	template   *dao.EventJson // metadata and fingerprint fields of the first event
+}
+
+func newDedupStage(config StageConfig) Stage {
+	stage := &dedupStage{}
+	decodeStageConfig(config, stage)
+	if len(stage.Fields) == 0 {
+		stage.Fields = []string{"@host", "@source", "message"}
+	}
+	if stage.Window == "" {
+		stage.Window = "60s"
+	}
+	stage.window = parseStageDuration(stage.Window, "window")
+	if stage.window <= 0 {
+		panic(kerror.Create("PipelineConfigInvalid", "dedup window must be > 0"))
+	}
+	if stage.Limit <= 0 {
+		stage.Limit = 1
+	}
+	if stage.MaxKeys <= 0 {
+		stage.MaxKeys = 10000
+	}
+	if stage.MaxFieldBytes <= 0 {
+		stage.MaxFieldBytes = 1024
+	}
+	if stage.SummaryField == "" {
+		stage.SummaryField = "dedup"
+	}
+	stage.entries = make(map[[16]byte]*list.Element)
+	stage.lru = list.New()
+	stage.stop = make(chan struct{})
+	stage.stopped = make(chan struct{})
+	return stage
+}
+
+func (s *dedupStage) Process(ctx context.Context, eve *dao.EventJson) (*dao.EventJson, error) {
+	h := fnv.New128a()
+	for _, field := range s.Fields {
+		if value, ok := GetField(eve, field); ok {
+			h.Write([]byte(valueString(value)))
+		}
+		h.Write([]byte{0})
+	}
+	var key [16]byte
+	copy(key[:], h.Sum(nil))
+
+	now := time.Now()
+	var summaries []*dao.EventJson
+	s.mu.Lock()
+	var entry *dedupEntry
+	if elem, ok := s.entries[key]; ok {
+		entry = elem.Value.(*dedupEntry)
+		s.lru.MoveToFront(elem)
+		if now.Sub(entry.start) >= s.window {
+			if entry.suppressed > 0 {
+				summaries = append(summaries, s.summary(entry))
+			}
+			entry.start, entry.count, entry.suppressed = now, 0, 0
+		}
+	} else {
+		entry = &dedupEntry{key: key, start: now, template: s.template(eve)}
+		s.entries[key] = s.lru.PushFront(entry)
+		if s.lru.Len() > s.MaxKeys {
+			oldest := s.lru.Remove(s.lru.Back()).(*dedupEntry)
+			delete(s.entries, oldest.key)
+			if oldest.suppressed > 0 {
+				summaries = append(summaries, s.summary(oldest))
+			}
+		}
+	}
+	entry.count++
+	entry.last = now
+	keep := entry.count <= s.Limit
+	if !keep {
+		entry.suppressed++
+	}
+	emit := s.emit
+	s.mu.Unlock()
+
+	if emit != nil {
+		for _, summary := range summaries {
+			emit(summary)
+		}
+	}
+	if !keep {
+		return nil, nil
+	}
+	return eve, nil
+}
+
+func (s *dedupStage) readOnly() {}
+
+func (s *dedupStage) Start(ctx context.Context, emit func(eve *dao.EventJson)) {
+	s.mu.Lock()
+	s.emit = emit
+	s.mu.Unlock()
+	go s.run(ctx, emit)
+}
+
+// Stop emits the summaries of all windows and returns once they are emitted.
+func (s *dedupStage) Stop() {
+	close(s.stop)
+	<-s.stopped
+}
+
+// run emits the summaries of finished windows, and of all windows once stopped or ctx is done.
+func (s *dedupStage) run(ctx context.Context, emit func(eve *dao.EventJson)) {
+	defer close(s.stopped)
+	interval := s.window / 4
+	if interval < 100*time.Millisecond {
+		interval = 100 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			for _, summary := range s.expire(time.Time{}) {
+				emit(summary)
+			}
+			return
+		case <-s.stop:
+			for _, summary := range s.expire(time.Time{}) {
+				emit(summary)
+			}
+			return
+		case now := <-ticker.C:
+			for _, summary := range s.expire(now.Add(-s.window)) {
+				emit(summary)
+			}
+		}
+	}
+}
+
+// expire forgets the entries whose window started before cutoff (all if cutoff is zero) and returns their summaries.
+func (s *dedupStage) expire(cutoff time.Time) []*dao.EventJson {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var summaries []*dao.EventJson
+	for elem := s.lru.Back(); elem != nil; {
+		prev := elem.Prev()
+		entry := elem.Value.(*dedupEntry)
+		if cutoff.IsZero() || entry.start.Before(cutoff) {
+			if entry.suppressed > 0 {
+				summaries = append(summaries, s.summary(entry))
+			}
+			s.lru.Remove(elem)
+			delete(s.entries, entry.key)
+		}
+		elem = prev
+	}
+	return summaries
+}
+
+// template keeps only what the summary needs, and at most MaxFieldBytes of each field, so memory per entry stays small.
+func (s *dedupStage) template(eve *dao.EventJson) *dao.EventJson {
+	template := &dao.EventJson{
+		Event:      make(map[string]interface{}),
+		Host:       eve.Host,
+		Source:     eve.Source,
+		SourceType: eve.SourceType,
+		Index:      eve.Index,
+	}
+	for _, field := range s.Fields {
+		if field == "@time" {
+			continue
+		}
+		if value, ok := GetField(eve, field); ok {
+			budget := s.MaxFieldBytes
+			SetField(template, field, boundedCopy(value, &budget))
+		}
+	}
+	return template
+}
+
+// boundedCopy is deepCopy that keeps at most *budget bytes of strings and map keys, the rest is cut off.
+func boundedCopy(value interface{}, budget *int) interface{} {
+	switch v := value.(type) {
+	case string:
+		v = dao.TruncateUtf8(v, max(*budget, 0))
+		*budget -= len(v)
+		return v
+	case map[string]interface{}:
+		result := make(map[string]interface{})
+		for k, item := range v {
+			if *budget <= len(k) {
+				break
+			}
+			*budget -= len(k)
+			result[k] = boundedCopy(item, budget)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, 0)
+		for _, item := range v {
+			if *budget <= 0 {
+				break
+			}
+			result = append(result, boundedCopy(item, budget))
+		}
+		return result
+	}
+	return value
+}
+
+func (s *dedupStage) summary(entry *dedupEntry) *dao.EventJson {
+	eve := &dao.EventJson{
+		Event:      deepCopy(entry.template.Event).(map[string]interface{}),
+		Time:       entry.last.UnixMilli(),
+		Host:       entry.template.Host,
+		Source:     entry.template.Source,
+		SourceType: entry.template.SourceType,
+		Index:      entry.template.Index,
+	}
+	SetField(eve, s.SummaryField, map[string]interface{}{
+		"suppressed": entry.suppressed,
+		"first_seen": entry.start.UnixMilli(),
+		"last_seen":  entry.last.UnixMilli(),
+		"window_sec": s.window.Seconds(),
+	})
+	return eve
+}
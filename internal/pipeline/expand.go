@@ -0,0 +1,272 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/xinkaiwang/hermes/internal/dao"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kerror"
+)
+
+const (
+	ConflictKeep      = "keep"      // an existing field wins
+	ConflictOverwrite = "overwrite" // the expanded field wins
+	ConflictError     = "error"     // the stage fails, see on_error
+)
+
+// expandStage turns string fields holding json or logfmt (key=value) into objects, exp:
+//
+//	{"type": "expand", "fields": ["msg"], "merge": true, "prefix": "msg_", "conflict": "overwrite"}
+//
+// Without fields every top level string field is checked. Expanded values are checked again for embedded strings
+// until max_depth.
+type expandStage struct {
+	Fields         []string `json:"fields"`
+	Formats        []string `json:"formats"`          // json and/or logfmt, default both
+	Merge          bool     `json:"merge"`            // merge the keys into the parent object instead of replacing the field
+	Prefix         string   `json:"prefix"`           // for merged keys
+	Conflict       string   `json:"conflict"`         // keep (default), overwrite or error
+	KeepOriginal   bool     `json:"keep_original"`    // keep the source field when merging
+	MaxDepth       int      `json:"max_depth"`        // default 2
+	MaxBytes       int      `json:"max_bytes"`        // longer strings are not expanded, default 65536
+	MaxFields      int      `json:"max_fields"`       // objects with more keys are not expanded, default 200
+	LogfmtMinPairs int      `json:"logfmt_min_pairs"` // default 2, so that "a=b" in plain text is not taken as logfmt
+	json           bool
+	logfmt         bool
+}
+
+func newExpandStage(config StageConfig) Stage {
+	stage := &expandStage{}
+	decodeStageConfig(config, stage)
+	if stage.Formats == nil {
+		stage.Formats = []string{"json", "logfmt"}
+	}
+	for _, format := range stage.Formats {
+		switch format {
+		case "json":
+			stage.json = true
+		case "logfmt":
+			stage.logfmt = true
+		default:
+			panic(kerror.Create("PipelineConfigInvalid", "expand format must be json or logfmt").With("format", format))
+		}
+	}
+	switch stage.Conflict {
+	case "":
+		stage.Conflict = ConflictKeep
+	case ConflictKeep, ConflictOverwrite, ConflictError:
+	default:
+		panic(kerror.Create("PipelineConfigInvalid", "expand conflict must be keep, overwrite or error").With("conflict", stage.Conflict))
+	}
+	if stage.MaxDepth <= 0 {
+		stage.MaxDepth = 2
+	}
+	if stage.MaxBytes <= 0 {
+		stage.MaxBytes = 64 * 1024
+	}
+	if stage.MaxFields <= 0 {
+		stage.MaxFields = 200
+	}
+	if stage.LogfmtMinPairs <= 0 {
+		stage.LogfmtMinPairs = 2
+	}
+	return stage
+}
+
+type expandOp struct {
+	path  string
+	value interface{}
+}
+
+func (s *expandStage) Process(ctx context.Context, eve *dao.EventJson) (*dao.EventJson, error) {
+	paths := s.Fields
+	if len(paths) == 0 {
+		for _, key := range sortedKeys(eve.Event) {
+			if _, ok := eve.Event[key].(string); ok {
+				paths = append(paths, key)
+			}
+		}
+	}
+
+	// collect all changes first, so that a conflict error leaves the event unchanged
+	var sets []expandOp
+	var removes []string
+	for _, path := range paths {
+		value, ok := GetField(eve, path)
+		if !ok {
+			continue
+		}
+		str, ok := value.(string)
+		if !ok {
+			continue
+		}
+		expanded, ok := s.expand(str, 1)
+		if !ok {
+			continue
+		}
+		obj, isObj := expanded.(map[string]interface{})
+		if !s.Merge || !isObj {
+			sets = append(sets, expandOp{path, expanded})
+			continue
+		}
+		parent := ""
+		if i := strings.LastIndex(path, "."); i >= 0 && !hasTopLevelField(eve, path) {
+			parent = path[:i] + "."
+		}
+		for _, key := range sortedKeys(obj) {
+			dest := parent + s.Prefix + key
+			if dest != path {
+				if _, exists := GetField(eve, dest); exists {
+					switch s.Conflict {
+					case ConflictKeep:
+						continue
+					case ConflictError:
+						return nil, fmt.Errorf("expand %s: field %s exists", path, dest)
+					}
+				}
+			}
+			sets = append(sets, expandOp{dest, obj[key]})
+		}
+		if !s.KeepOriginal && !containsOp(sets, path) {
+			removes = append(removes, path)
+		}
+	}
+	for _, path := range removes {
+		DeleteField(eve, path)
+	}
+	for _, op := range sets {
+		if err := SetField(eve, op.path, op.value); err != nil {
+			return nil, err
+		}
+	}
+	return eve, nil
+}
+
+func hasTopLevelField(eve *dao.EventJson, path string) bool {
+	_, ok := eve.Event[path]
+	return ok
+}
+
+func containsOp(ops []expandOp, path string) bool {
+	for _, op := range ops {
+		if op.path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// expand parses str as json (object or array) or logfmt, then expands the strings inside up to max_depth.
+func (s *expandStage) expand(str string, depth int) (interface{}, bool) {
+	if len(str) > s.MaxBytes {
+		return nil, false
+	}
+	trimmed := strings.TrimSpace(str)
+	var result interface{}
+	switch {
+	case s.json && (strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[")):
+		if err := json.Unmarshal([]byte(trimmed), &result); err != nil {
+			return nil, false
+		}
+		if obj, ok := result.(map[string]interface{}); ok && len(obj) > s.MaxFields {
+			return nil, false
+		}
+	case s.logfmt:
+		obj, ok := parseLogfmt(trimmed)
+		if !ok || len(obj) < s.LogfmtMinPairs || len(obj) > s.MaxFields {
+			return nil, false
+		}
+		result = obj
+	default:
+		return nil, false
+	}
+	if depth < s.MaxDepth {
+		result = s.expandNested(result, depth+1)
+	}
+	return result, true
+}
+
+func (s *expandStage) expandNested(value interface{}, depth int) interface{} {
+	switch v := value.(type) {
+	case string:
+		if expanded, ok := s.expand(v, depth); ok {
+			return expanded
+		}
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = s.expandNested(item, depth)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = s.expandNested(item, depth)
+		}
+	}
+	return value
+}
+
+// parseLogfmt parses key=value pairs separated by spaces; values may be double quoted with \" \\ \n \t escapes.
+// Fails if any token is not a key=value pair.
+func parseLogfmt(str string) (map[string]interface{}, bool) {
+	result := make(map[string]interface{})
+	i := 0
+	for {
+		for i < len(str) && (str[i] == ' ' || str[i] == '\t') {
+			i++
+		}
+		if i >= len(str) {
+			break
+		}
+		start := i
+		for i < len(str) && str[i] != '=' && str[i] != ' ' && str[i] != '\t' && str[i] != '"' {
+			i++
+		}
+		if i == start || i >= len(str) || str[i] != '=' {
+			return nil, false
+		}
+		key := str[start:i]
+		i++ // =
+		if i < len(str) && str[i] == '"' {
+			var sb strings.Builder
+			i++
+			closed := false
+			for i < len(str) {
+				c := str[i]
+				if c == '\\' && i+1 < len(str) {
+					switch str[i+1] {
+					case 'n':
+						sb.WriteByte('\n')
+					case 't':
+						sb.WriteByte('\t')
+					default:
+						sb.WriteByte(str[i+1])
+					}
+					i += 2
+					continue
+				}
+				if c == '"' {
+					closed = true
+					i++
+					break
+				}
+				sb.WriteByte(c)
+				i++
+			}
+			if !closed || (i < len(str) && str[i] != ' ' && str[i] != '\t') {
+				return nil, false
+			}
+			result[key] = sb.String()
+			continue
+		}
+		start = i
+		for i < len(str) && str[i] != ' ' && str[i] != '\t' {
+			if str[i] == '"' {
+				return nil, false
+			}
+			i++
+		}
+		result[key] = str[start:i]
+	}
+	return result, true
+}
@@ -0,0 +1,138 @@
+package pipeline
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/xinkaiwang/hermes/internal/dao"
+)
+
+// GetField reads a field path: nested objects are separated by dots (exp: "http.status"), a top level field whose
+// name contains dots is found first. @time, @host, @source, @sourcetype and @index name the EventJson metadata.
+func GetField(eve *dao.EventJson, path string) (interface{}, bool) {
+	switch path {
+	case "@time":
+		return eve.Time, true
+	case "@host":
+		return eve.Host, eve.Host != ""
+	case "@source":
+		return eve.Source, eve.Source != ""
+	case "@sourcetype":
+		return eve.SourceType, eve.SourceType != ""
+	case "@index":
+		return eve.Index, eve.Index != ""
+	}
+	if value, ok := eve.Event[path]; ok {
+		return value, true
+	}
+	var current interface{} = eve.Event
+	for _, key := range strings.Split(path, ".") {
+		obj, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if current, ok = obj[key]; !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// SetField creates missing parent objects; it fails if a parent exists but is not an object, or a metadata value
+// has the wrong type.
+func SetField(eve *dao.EventJson, path string, value interface{}) error {
+	switch path {
+	case "@time":
+		ms, ok := toFloat(value)
+		if !ok {
+			return fmt.Errorf("@time must be epoch ms, got %T", value)
+		}
+		eve.Time = int64(ms)
+		return nil
+	case "@host", "@source", "@sourcetype", "@index":
+		str, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s must be a string, got %T", path, value)
+		}
+		switch path {
+		case "@host":
+			eve.Host = str
+		case "@source":
+			eve.Source = str
+		case "@sourcetype":
+			eve.SourceType = str
+		case "@index":
+			eve.Index = str
+		}
+		return nil
+	}
+	if eve.Event == nil {
+		eve.Event = make(map[string]interface{})
+	}
+	if _, ok := eve.Event[path]; ok || !strings.Contains(path, ".") {
+		eve.Event[path] = value
+		return nil
+	}
+	keys := strings.Split(path, ".")
+	obj := eve.Event
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := obj[key]
+		if !ok {
+			child := make(map[string]interface{})
+			obj[key] = child
+			obj = child
+			continue
+		}
+		if obj, ok = next.(map[string]interface{}); !ok {
+			return fmt.Errorf("%s: %s is not an object", path, key)
+		}
+	}
+	obj[keys[len(keys)-1]] = value
+	return nil
+}
+
+// DeleteField removes a field and returns its value. Metadata can not be deleted, it is cleared.
+func DeleteField(eve *dao.EventJson, path string) (interface{}, bool) {
+	value, ok := GetField(eve, path)
+	if !ok {
+		return nil, false
+	}
+	switch path {
+	case "@time":
+		eve.Time = 0
+		return value, true
+	case "@host", "@source", "@sourcetype", "@index":
+		SetField(eve, path, "")
+		return value, true
+	}
+	if _, ok := eve.Event[path]; ok {
+		delete(eve.Event, path)
+		return value, true
+	}
+	keys := strings.Split(path, ".")
+	var current interface{} = eve.Event
+	for _, key := range keys[:len(keys)-1] {
+		current = current.(map[string]interface{})[key]
+	}
+	delete(current.(map[string]interface{}), keys[len(keys)-1])
+	return value, true
+}
+
+// deepCopy copies json objects and arrays, so that a copied field can be modified independently.
+func deepCopy(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			result[k] = deepCopy(item)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			result[i] = deepCopy(item)
+		}
+		return result
+	}
+	return value
+}
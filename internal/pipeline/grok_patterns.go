@@ -0,0 +1,91 @@
+package pipeline
+
+// grokPatterns is the bundled grok library, adapted from the logstash patterns to RE2 (no lookarounds).
+var grokPatterns = map[string]string{
+	// basics
+	"USERNAME":     `[a-zA-Z0-9._-]+`,
+	"USER":         `%{USERNAME}`,
+	"INT":          `(?:[+-]?[0-9]+)`,
+	"BASE10NUM":    `(?:[+-]?(?:[0-9]+(?:\.[0-9]+)?|\.[0-9]+))`,
+	"NUMBER":       `(?:%{BASE10NUM})`,
+	"BASE16NUM":    `(?:[+-]?(?:0x)?[0-9A-Fa-f]+)`,
+	"POSINT":       `\b(?:[1-9][0-9]*)\b`,
+	"NONNEGINT":    `\b(?:[0-9]+)\b`,
+	"WORD":         `\b\w+\b`,
+	"NOTSPACE":     `\S+`,
+	"SPACE":        `\s*`,
+	"DATA":         `.*?`,
+	"GREEDYDATA":   `.*`,
+	"QUOTEDSTRING": `(?:"(?:[^"\\]|\\.)*"|'(?:[^'\\]|\\.)*')`,
+	"QS":           `%{QUOTEDSTRING}`,
+	"UUID":         `[A-Fa-f0-9]{8}-(?:[A-Fa-f0-9]{4}-){3}[A-Fa-f0-9]{12}`,
+	"LOGLEVEL":     `(?:[Aa]lert|ALERT|[Tt]race|TRACE|[Dd]ebug|DEBUG|[Nn]otice|NOTICE|[Ii]nfo(?:rmation)?|INFO(?:RMATION)?|[Ww]arn(?:ing)?|WARN(?:ING)?|[Ee]rr(?:or)?|ERR(?:OR)?|[Cc]rit(?:ical)?|CRIT(?:ICAL)?|[Ff]atal|FATAL|[Ss]evere|SEVERE|[Ee]merg(?:ency)?|EMERG(?:ENCY)?)`,
+
+	// network
+	"IPV4":           `(?:(?:25[0-5]|2[0-4][0-9]|1[0-9]{2}|[1-9]?[0-9])\.){3}(?:25[0-5]|2[0-4][0-9]|1[0-9]{2}|[1-9]?[0-9])`,
+	"IPV6":           `(?:[0-9A-Fa-f]{0,4}:){2,7}(?:%{IPV4}|[0-9A-Fa-f]{0,4})`,
+	"IP":             `(?:%{IPV6}|%{IPV4})`,
+	"HOSTNAME":       `\b(?:[0-9A-Za-z][0-9A-Za-z-]{0,62})(?:\.(?:[0-9A-Za-z][0-9A-Za-z-]{0,62}))*\.?`,
+	"IPORHOST":       `(?:%{IP}|%{HOSTNAME})`,
+	"HOSTPORT":       `%{IPORHOST}:%{POSINT}`,
+	"EMAILLOCALPART": `[a-zA-Z0-9._%+-]+`,
+	"EMAILADDRESS":   `%{EMAILLOCALPART}@%{HOSTNAME}`,
+
+	// paths and uris
+	"UNIXPATH":     `(?:/[\w%!$@:.,+~-]*)+`,
+	"WINPATH":      `(?:[A-Za-z]+:|\\)(?:\\[^\\?*]*)+`,
+	"PATH":         `(?:%{UNIXPATH}|%{WINPATH})`,
+	"URIPROTO":     `[A-Za-z][A-Za-z0-9+.-]*`,
+	"URIHOST":      `%{IPORHOST}(?::%{POSINT})?`,
+	"URIPATH":      `(?:/[A-Za-z0-9$.+!*'(){},~:;=@#%&_-]*)+`,
+	"URIPARAM":     `\?[A-Za-z0-9$.+!*'|(){},~@#%&/=:;_?\[\]<>-]*`,
+	"URIPATHPARAM": `%{URIPATH}(?:%{URIPARAM})?`,
+	"URI":          `%{URIPROTO}://(?:%{USER}(?::[^@]*)?@)?(?:%{URIHOST})?(?:%{URIPATHPARAM})?`,
+
+	// dates and times
+	"MONTH":             `\b(?:Jan(?:uary)?|Feb(?:ruary)?|Mar(?:ch)?|Apr(?:il)?|May|June?|July?|Aug(?:ust)?|Sep(?:tember)?|Oct(?:ober)?|Nov(?:ember)?|Dec(?:ember)?)\b`,
+	"MONTHNUM":          `(?:0?[1-9]|1[0-2])`,
+	"MONTHDAY":          `(?:0[1-9]|[12][0-9]|3[01]|[1-9])`,
+	"DAY":               `(?:Mon(?:day)?|Tue(?:sday)?|Wed(?:nesday)?|Thu(?:rsday)?|Fri(?:day)?|Sat(?:urday)?|Sun(?:day)?)`,
+	"YEAR":              `(?:\d\d){1,2}`,
+	"HOUR":              `(?:2[0123]|[01]?[0-9])`,
+	"MINUTE":            `(?:[0-5][0-9])`,
+	"SECOND":            `(?:(?:[0-5]?[0-9]|60)(?:[:.,][0-9]+)?)`,
+	"TIME":              `%{HOUR}:%{MINUTE}(?::%{SECOND})?`,
+	"ISO8601_TIMEZONE":  `(?:Z|[+-]%{HOUR}(?::?%{MINUTE}))`,
+	"TIMESTAMP_ISO8601": `%{YEAR}-%{MONTHNUM}-%{MONTHDAY}[T ]%{HOUR}:?%{MINUTE}(?::?%{SECOND})?%{ISO8601_TIMEZONE}?`,
+	"HTTPDATE":          `%{MONTHDAY}/%{MONTH}/%{YEAR}:%{TIME} %{INT}`,
+	"HTTPDERROR_DATE":   `%{DAY} %{MONTH} %{MONTHDAY} %{TIME} %{YEAR}`,
+	"SYSLOGTIMESTAMP":   `%{MONTH} +%{MONTHDAY} %{TIME}`,
+
+	// syslog, rfc 3164 and rfc 5424
+	"PROG":                 `[\x21-\x5a\x5c\x5e-\x7e]+`,
+	"SYSLOGPROG":           `%{PROG:program}(?:\[%{POSINT:pid:int}\])?`,
+	"SYSLOGHOST":           `%{IPORHOST}`,
+	"SYSLOGPRI":            `<%{NONNEGINT:priority:int}>`,
+	"SYSLOGBASE":           `(?:%{SYSLOGPRI})?%{SYSLOGTIMESTAMP:timestamp} %{SYSLOGHOST:logsource} %{SYSLOGPROG}:`,
+	"SYSLOGLINE":           `%{SYSLOGBASE} %{GREEDYDATA:message}`,
+	"SYSLOG5424PRINTASCII": `[!-~]+`,
+	"SYSLOG5424SD":         `(?:\[.*?[^\\]\])+`,
+	"SYSLOG5424BASE":       `%{SYSLOGPRI}%{NONNEGINT:version:int} +(?:-|%{TIMESTAMP_ISO8601:timestamp}) +(?:-|%{IPORHOST:logsource}) +(?:-|%{SYSLOG5424PRINTASCII:program}) +(?:-|%{SYSLOG5424PRINTASCII:proc_id}) +(?:-|%{SYSLOG5424PRINTASCII:msg_id}) +(?:-|%{SYSLOG5424SD:structured_data})`,
+	"SYSLOG5424LINE":       `%{SYSLOG5424BASE}(?: +%{GREEDYDATA:message})?`,
+
+	// apache and nginx
+	"HTTPDUSER":         `(?:%{EMAILADDRESS}|%{USER})`,
+	"COMMONAPACHELOG":   `%{IPORHOST:clientip} %{HTTPDUSER:ident} %{HTTPDUSER:auth} \[%{HTTPDATE:timestamp}\] "(?:%{WORD:verb} %{NOTSPACE:request}(?: HTTP/%{NUMBER:httpversion})?|%{DATA:rawrequest})" %{NUMBER:response:int} (?:%{NUMBER:bytes:int}|-)`,
+	"COMBINEDAPACHELOG": `%{COMMONAPACHELOG} %{QS:referrer} %{QS:agent}`,
+	"APACHEERROR":       `\[%{HTTPDERROR_DATE:timestamp}\] \[(?:%{WORD:module})?:%{LOGLEVEL:level}\] \[pid %{POSINT:pid:int}(?::tid %{NUMBER:tid:int})?\](?: \[client %{IPORHOST:clientip}(?::%{POSINT:clientport:int})?\])?(?: %{DATA:errorcode}:)? %{GREEDYDATA:message}`,
+	"NGINXACCESS":       `%{COMBINEDAPACHELOG}(?: %{QS:x_forwarded_for})?`,
+	"NGINXERRORTIME":    `%{YEAR}/%{MONTHNUM}/%{MONTHDAY} %{TIME}`,
+	"NGINXERROR":        `%{NGINXERRORTIME:timestamp} \[%{LOGLEVEL:level}\] %{POSINT:pid:int}#%{NONNEGINT:tid:int}: (?:\*%{NONNEGINT:connection_id:int} )?%{GREEDYDATA:message}`,
+
+	// java
+	"JAVACLASS":          `(?:[a-zA-Z$_][a-zA-Z$_0-9]*\.)*[a-zA-Z$_][a-zA-Z$_0-9]*`,
+	"JAVAEXCEPTIONCLASS": `(?:[a-zA-Z$_][a-zA-Z$_0-9]*\.)*[a-zA-Z$_][a-zA-Z$_0-9]*(?:Exception|Error|Throwable)`,
+	"JAVAFILE":           `(?:[a-zA-Z$_0-9. -]+)`,
+	"JAVAMETHOD":         `(?:<init>|<clinit>|[a-zA-Z$_][a-zA-Z$_0-9]*)`,
+	"JAVATHREAD":         `(?:[A-Z]{2}-Processor[0-9]+|[^\]]+)`,
+	"JAVAEXCEPTION":      `(?:Caused by: |Exception in thread "%{DATA:thread}" )?%{JAVAEXCEPTIONCLASS:exception_class}(?:: %{GREEDYDATA:exception_message})?`,
+	"JAVASTACKTRACEPART": `\s*at %{JAVACLASS:class}\.%{JAVAMETHOD:method}\((?:%{JAVAFILE:file}(?::%{INT:line:int})?|Native Method|Unknown Source)\)`,
+	"JAVALOGHEADER":      `%{TIMESTAMP_ISO8601:timestamp} +\[%{JAVATHREAD:thread}\] +%{LOGLEVEL:level} +%{JAVACLASS:logger} +- %{GREEDYDATA:message}`,
+}
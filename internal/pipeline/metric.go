@@ -0,0 +1,301 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xinkaiwang/hermes/internal/dao"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kerror"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kmetrics"
+	"go.opencensus.io/metric/metricdata"
+)
+
+var (
+	LogMetricOverflowMetric = kmetrics.CreateKmetric(context.Background(), "log_metric_overflow", "desc", []string{"metric"})
+)
+
+const (
+	LogMetricCounter   = "counter"   // counts events, or adds up field
+	LogMetricGauge     = "gauge"     // the last value of field
+	LogMetricHistogram = "histogram" // distribution of field over buckets
+)
+
+// overflowLabel replaces all label values of a metric once it has max_series series.
+const overflowLabel = "_other"
+
+var (
+	logMetricName       = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	defaultLogBuckets   = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+	currentLogMetrics   *LogMetricsRegistry
+	currentLogMetricsMu sync.Mutex
+)
+
+// LogMetricsRegistry holds the metrics derived from events by metric stages. It is an opencensus metric producer,
+// exported next to the kmetrics registry (exp: prometheus on METRICS_PORT).
+type LogMetricsRegistry struct {
+	mu      sync.Mutex
+	metrics map[string]*logMetric
+}
+
+func GetLogMetricsRegistry() *LogMetricsRegistry {
+	currentLogMetricsMu.Lock()
+	defer currentLogMetricsMu.Unlock()
+	if currentLogMetrics == nil {
+		currentLogMetrics = &LogMetricsRegistry{metrics: make(map[string]*logMetric)}
+	}
+	return currentLogMetrics
+}
+
+// Read implements metricproducer.Producer.
+func (r *LogMetricsRegistry) Read() []*metricdata.Metric {
+	r.mu.Lock()
+	metrics := make([]*logMetric, 0, len(r.metrics))
+	for _, name := range sortedKeys(r.metrics) {
+		metrics = append(metrics, r.metrics[name])
+	}
+	r.mu.Unlock()
+	now := time.Now()
+	result := make([]*metricdata.Metric, 0, len(metrics))
+	for _, metric := range metrics {
+		result = append(result, metric.read(now))
+	}
+	return result
+}
+
+// getOrCreate returns the metric with the name, stages may share a metric if kind, labels and buckets agree.
+func (r *LogMetricsRegistry) getOrCreate(metric *logMetric) (*logMetric, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	existing, ok := r.metrics[metric.name]
+	if !ok {
+		r.metrics[metric.name] = metric
+		return metric, nil
+	}
+	if existing.kind != metric.kind || strings.Join(existing.labelKeys, ",") != strings.Join(metric.labelKeys, ",") || fmt.Sprint(existing.buckets) != fmt.Sprint(metric.buckets) {
+		return nil, fmt.Errorf("metric %s exists with different kind, labels or buckets", metric.name)
+	}
+	return existing, nil
+}
+
+type logMetric struct {
+	name      string
+	desc      string
+	kind      string
+	labelKeys []string
+	buckets   []float64
+	maxSeries int
+	start     time.Time
+
+	mu     sync.Mutex
+	series map[string]*logSeries // by label values joined with \x00
+}
+
+type logSeries struct {
+	labels  []string
+	value   float64 // counter: sum, gauge: last value
+	count   int64   // histogram
+	sum     float64
+	mean    float64 // for the sum of squared deviations (welford)
+	sqDev   float64
+	buckets []int64 // len(buckets)+1, the last one is +Inf
+}
+
+func (m *logMetric) record(ctx context.Context, labels []string, value float64) {
+	key := strings.Join(labels, "\x00")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.series[key]
+	if !ok {
+		if len(m.series) >= m.maxSeries {
+			LogMetricOverflowMetric.GetTimeSequence(ctx, m.name).Add(1)
+			overflow := make([]string, len(labels))
+			for i := range overflow {
+				overflow[i] = overflowLabel
+			}
+			labels = overflow
+			key = strings.Join(labels, "\x00")
+			s, ok = m.series[key]
+		}
+		if !ok {
+			s = &logSeries{labels: labels}
+			if m.kind == LogMetricHistogram {
+				s.buckets = make([]int64, len(m.buckets)+1)
+			}
+			m.series[key] = s
+		}
+	}
+	switch m.kind {
+	case LogMetricCounter:
+		s.value += value
+	case LogMetricGauge:
+		s.value = value
+	case LogMetricHistogram:
+		s.count++
+		s.sum += value
+		delta := value - s.mean
+		s.mean += delta / float64(s.count)
+		s.sqDev += delta * (value - s.mean)
+		// prometheus buckets are upper inclusive (le)
+		s.buckets[sort.SearchFloat64s(m.buckets, value)]++
+	}
+}
+
+func (m *logMetric) read(now time.Time) *metricdata.Metric {
+	metric := &metricdata.Metric{
+		Descriptor: metricdata.Descriptor{
+			Name:        m.name,
+			Description: m.desc,
+			Unit:        metricdata.UnitDimensionless,
+		},
+	}
+	for _, key := range m.labelKeys {
+		metric.Descriptor.LabelKeys = append(metric.Descriptor.LabelKeys, metricdata.LabelKey{Key: key})
+	}
+	switch m.kind {
+	case LogMetricCounter:
+		metric.Descriptor.Type = metricdata.TypeCumulativeFloat64
+	case LogMetricGauge:
+		metric.Descriptor.Type = metricdata.TypeGaugeFloat64
+	case LogMetricHistogram:
+		metric.Descriptor.Type = metricdata.TypeCumulativeDistribution
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, key := range sortedKeys(m.series) {
+		s := m.series[key]
+		ts := &metricdata.TimeSeries{StartTime: m.start}
+		for _, value := range s.labels {
+			ts.LabelValues = append(ts.LabelValues, metricdata.NewLabelValue(value))
+		}
+		var point metricdata.Point
+		if m.kind == LogMetricHistogram {
+			buckets := make([]metricdata.Bucket, len(s.buckets))
+			for i, count := range s.buckets {
+				buckets[i] = metricdata.Bucket{Count: count}
+			}
+			point = metricdata.NewDistributionPoint(now, &metricdata.Distribution{
+				Count:                 s.count,
+				Sum:                   s.sum,
+				SumOfSquaredDeviation: s.sqDev,
+				BucketOptions:         &metricdata.BucketOptions{Bounds: m.buckets},
+				Buckets:               buckets,
+			})
+		} else {
+			point = metricdata.NewFloat64Point(now, s.value)
+		}
+		ts.Points = []metricdata.Point{point}
+		metric.TimeSeries = append(metric.TimeSeries, ts)
+	}
+	return metric
+}
+
+// metricStage records a metric for every event it sees and passes the event on unchanged, exp:
+//
+//	{"type": "metric", "metric": "log_errors_total", "kind": "counter", "labels": {"service": "service"},
+//	 "when": {"field": "level", "equals": "error"}}
+//	{"type": "metric", "metric": "request_duration_ms", "kind": "histogram", "field": "duration_ms",
+//	 "labels": {"route": "http.route", "status": "http.status"}, "buckets": [10, 50, 100, 500, 1000]}
+type metricStage struct {
+	Metric      string            `json:"metric"` // prometheus name without the hermes_ prefix
+	Description string            `json:"description"`
+	Kind        string            `json:"kind"`       // counter (default), gauge or histogram
+	Field       string            `json:"field"`      // value, required for gauge and histogram, counter adds it up instead of 1
+	Labels      map[string]string `json:"labels"`     // label name -> field path, missing fields give ""
+	Buckets     []float64         `json:"buckets"`    // histogram upper bounds, default 5 .. 10000
+	MaxSeries   int               `json:"max_series"` // label combinations, further ones go to "_other", default 1000
+	metric      *logMetric
+	labelFields []string
+}
+
+func newMetricStage(config StageConfig) Stage {
+	stage := &metricStage{}
+	decodeStageConfig(config, stage)
+	if !logMetricName.MatchString(stage.Metric) {
+		panic(kerror.Create("PipelineConfigInvalid", "metric needs a valid metric name").With("metric", stage.Metric))
+	}
+	switch stage.Kind {
+	case "":
+		stage.Kind = LogMetricCounter
+	case LogMetricCounter:
+	case LogMetricGauge, LogMetricHistogram:
+		if stage.Field == "" {
+			panic(kerror.Create("PipelineConfigInvalid", "metric kind needs field").With("metric", stage.Metric).With("kind", stage.Kind))
+		}
+	default:
+		panic(kerror.Create("PipelineConfigInvalid", "metric kind must be counter, gauge or histogram").With("kind", stage.Kind))
+	}
+	if stage.Description == "" {
+		stage.Description = "derived from events"
+	}
+	if stage.MaxSeries <= 0 {
+		stage.MaxSeries = 1000
+	}
+	metric := &logMetric{
+		name:      stage.Metric,
+		desc:      stage.Description,
+		kind:      stage.Kind,
+		maxSeries: stage.MaxSeries,
+		start:     time.Now(),
+		series:    make(map[string]*logSeries),
+	}
+	for _, label := range sortedKeys(stage.Labels) {
+		if !logMetricName.MatchString(label) {
+			panic(kerror.Create("PipelineConfigInvalid", "invalid metric label").With("metric", stage.Metric).With("label", label))
+		}
+		metric.labelKeys = append(metric.labelKeys, label)
+		stage.labelFields = append(stage.labelFields, stage.Labels[label])
+	}
+	if stage.Kind == LogMetricHistogram {
+		if stage.Buckets == nil {
+			stage.Buckets = defaultLogBuckets
+		}
+		if len(stage.Buckets) == 0 || !sort.Float64sAreSorted(stage.Buckets) {
+			panic(kerror.Create("PipelineConfigInvalid", "metric buckets must be sorted").With("metric", stage.Metric))
+		}
+		metric.buckets = stage.Buckets
+	}
+	shared, err := GetLogMetricsRegistry().getOrCreate(metric)
+	if err != nil {
+		panic(kerror.Wrap(err, "PipelineConfigInvalid", "conflicting metric", false).With("metric", stage.Metric))
+	}
+	stage.metric = shared
+	return stage
+}
+
+func (s *metricStage) Process(ctx context.Context, eve *dao.EventJson) (*dao.EventJson, error) {
+	value := 1.0
+	if s.Field != "" {
+		raw, ok := GetField(eve, s.Field)
+		if !ok {
+			return eve, nil
+		}
+		converted, err := castValue(raw, "float")
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", s.Field, err)
+		}
+		value = converted.(float64)
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return nil, fmt.Errorf("%s is not a finite number", s.Field)
+		}
+		// a counter never goes down, prometheus would take a decrease for a restart
+		if s.Kind == LogMetricCounter && value < 0 {
+			return nil, fmt.Errorf("%s is negative, counters only go up", s.Field)
+		}
+	}
+	labels := make([]string, len(s.labelFields))
+	for i, field := range s.labelFields {
+		if v, ok := GetField(eve, field); ok {
+			labels[i] = valueString(v)
+		}
+	}
+	s.metric.record(ctx, labels, value)
+	return eve, nil
+}
+
+func (s *metricStage) readOnly() {}
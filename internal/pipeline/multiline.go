@@ -0,0 +1,282 @@
+package pipeline
+
+import (
+	"container/list"
+	"context"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xinkaiwang/hermes/internal/dao"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kerror"
+)
+
+// multilinePresets are continue regexps for common stack traces.
+var multilinePresets = map[string]string{
+	// "\tat com.example.Foo.bar(Foo.java:42)", "\t... 12 more", "Caused by: ...", "java.lang.IllegalStateException: ..."
+	"java": `^(?:\s+at\s|\s+\.\.\.\s+\d+\s+more|\s*Caused by:|\s+Suppressed:|(?:[a-zA-Z$_][a-zA-Z$_0-9]*\.)+[a-zA-Z$_][a-zA-Z$_0-9]*(?:Exception|Error|Throwable)(?::|$))`,
+	// "Traceback (most recent call last):", indented frames, "During handling ...", "ValueError: ..."
+	"python": `^(?:Traceback \(most recent call last\):|\s+|\s*$|During handling of the above exception|The above exception was the direct cause|[A-Za-z_][\w.]*(?:Error|Exception|Warning|Exit|Interrupt)(?::|$))`,
+	// empty lines, "goroutine 1 [running]:", "main.main()", "\t/src/main.go:5 +0x1d", "created by ...", "exit status 2"
+	"go": `^(?:\s*$|\t|goroutine \d+ \[|created by |\[signal |exit status \d+|[\w./*()\[\]-]+\(.*\)$)`,
+}
+
+// multilineStage joins continuation lines into the event before them, per key (exp: one stream of one host), exp:
+//
+//	{"type": "multiline", "preset": "java"}
+//	{"type": "multiline", "start": "^\\d{4}-\\d{2}-\\d{2} ", "flush_timeout": "5s"}
+//
+// A line is a continuation if it matches continue, or if start is set and it does not match start. An event is
+// held until the next non continuation line of its key, max_lines / max_bytes, or flush_timeout without new lines.
+// At most max_keys events are held, the one with the oldest line is flushed first. The acks of the joined events
+// are chained to the held event.
+type multilineStage struct {
+	Field        string   `json:"field"`         // default message
+	KeyFields    []string `json:"key_fields"`    // default @host, @source, stream
+	StartRegex   string   `json:"start"`         // regexp for first lines
+	ContRegex    string   `json:"continue"`      // regexp for continuation lines
+	Preset       string   `json:"preset"`        // java, python or go, sets continue
+	MaxLines     int      `json:"max_lines"`     // default 500
+	MaxBytes     int      `json:"max_bytes"`     // default 65536
+	FlushTimeout string   `json:"flush_timeout"` // go duration, default 2s
+	MaxKeys      int      `json:"max_keys"`      // events held at once, default 10000
+	start        *regexp.Regexp
+	cont         *regexp.Regexp
+	flushTimeout time.Duration
+
+	mu      sync.Mutex
+	pending map[string]*list.Element
+	lru     *list.List // of *multilineEvent, most recent line first
+	emit    func(eve *dao.EventJson)
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+type multilineEvent struct {
+	key   string
+	eve   *dao.EventJson
+	lines []string
+	bytes int
+	last  time.Time
+	ack   func(err error) // taken off the events while held, so that the pipeline does not ack them as dropped
+}
+
+func newMultilineStage(config StageConfig) Stage {
+	stage := &multilineStage{}
+	decodeStageConfig(config, stage)
+	if stage.Field == "" {
+		stage.Field = "message"
+	}
+	if len(stage.KeyFields) == 0 {
+		stage.KeyFields = []string{"@host", "@source", "stream"}
+	}
+	if stage.Preset != "" {
+		preset, ok := multilinePresets[stage.Preset]
+		if !ok {
+			panic(kerror.Create("PipelineConfigInvalid", "multiline preset must be java, python or go").With("preset", stage.Preset))
+		}
+		if stage.ContRegex != "" {
+			panic(kerror.Create("PipelineConfigInvalid", "multiline preset and continue exclude each other"))
+		}
+		stage.ContRegex = preset
+	}
+	if stage.StartRegex == "" && stage.ContRegex == "" {
+		panic(kerror.Create("PipelineConfigInvalid", "multiline needs start, continue or preset"))
+	}
+	for _, re := range []struct {
+		expr   string
+		target **regexp.Regexp
+	}{{stage.StartRegex, &stage.start}, {stage.ContRegex, &stage.cont}} {
+		if re.expr == "" {
+			continue
+		}
+		compiled, err := regexp.Compile(re.expr)
+		if err != nil {
+			panic(kerror.Wrap(err, "PipelineConfigInvalid", "invalid multiline regex", false).With("regex", re.expr))
+		}
+		*re.target = compiled
+	}
+	if stage.MaxLines <= 0 {
+		stage.MaxLines = 500
+	}
+	if stage.MaxBytes <= 0 {
+		stage.MaxBytes = 64 * 1024
+	}
+	if stage.FlushTimeout == "" {
+		stage.FlushTimeout = "2s"
+	}
+	stage.flushTimeout = parseStageDuration(stage.FlushTimeout, "flush_timeout")
+	if stage.flushTimeout <= 0 {
+		panic(kerror.Create("PipelineConfigInvalid", "multiline flush_timeout must be > 0"))
+	}
+	if stage.MaxKeys <= 0 {
+		stage.MaxKeys = 10000
+	}
+	stage.pending = make(map[string]*list.Element)
+	stage.lru = list.New()
+	stage.stop = make(chan struct{})
+	stage.stopped = make(chan struct{})
+	return stage
+}
+
+func (s *multilineStage) isContinuation(line string) bool {
+	if s.cont != nil && s.cont.MatchString(line) {
+		return true
+	}
+	return s.start != nil && !s.start.MatchString(line)
+}
+
+func (s *multilineStage) Process(ctx context.Context, eve *dao.EventJson) (*dao.EventJson, error) {
+	value, ok := GetField(eve, s.Field)
+	if !ok {
+		return eve, nil
+	}
+	line, ok := value.(string)
+	if !ok {
+		return eve, nil
+	}
+	values := make([]string, len(s.KeyFields))
+	for i, field := range s.KeyFields {
+		if v, ok := GetField(eve, field); ok {
+			values[i] = valueString(v)
+		}
+	}
+	key := strings.Join(values, "\x00")
+	continuation := s.isContinuation(line)
+
+	var flushed []*dao.EventJson
+	s.mu.Lock()
+	elem := s.pending[key]
+	if continuation && elem != nil {
+		held := elem.Value.(*multilineEvent)
+		if len(held.lines) < s.MaxLines && held.bytes+1+len(line) <= s.MaxBytes {
+			held.lines = append(held.lines, line)
+			held.bytes += 1 + len(line)
+			held.last = time.Now()
+			held.ack = chainAck(held.ack, eve.Ack)
+			eve.Ack = nil
+			s.lru.MoveToFront(elem)
+			s.mu.Unlock()
+			return nil, nil
+		}
+	}
+	if elem != nil {
+		flushed = append(flushed, s.remove(elem))
+	}
+	if continuation {
+		// nothing to join to (or the held event is full), pass the line on as is
+		s.mu.Unlock()
+		s.emitFlushed(flushed)
+		return eve, nil
+	}
+	held := &multilineEvent{key: key, eve: eve, lines: []string{line}, bytes: len(line), last: time.Now(), ack: eve.Ack}
+	eve.Ack = nil
+	s.pending[key] = s.lru.PushFront(held)
+	if s.lru.Len() > s.MaxKeys {
+		flushed = append(flushed, s.remove(s.lru.Back()))
+	}
+	s.mu.Unlock()
+	s.emitFlushed(flushed)
+	return nil, nil
+}
+
+func (s *multilineStage) emitFlushed(events []*dao.EventJson) {
+	if len(events) == 0 {
+		return
+	}
+	s.mu.Lock()
+	emit := s.emit
+	s.mu.Unlock()
+	if emit != nil {
+		for _, eve := range events {
+			emit(eve)
+		}
+	}
+}
+
+func (s *multilineStage) Start(ctx context.Context, emit func(eve *dao.EventJson)) {
+	s.mu.Lock()
+	s.emit = emit
+	s.mu.Unlock()
+	go s.run(ctx, emit)
+}
+
+// Stop flushes all held events and returns once they are emitted.
+func (s *multilineStage) Stop() {
+	close(s.stop)
+	<-s.stopped
+}
+
+// run flushes events without new lines for flush_timeout, and all events once stopped or ctx is done.
+func (s *multilineStage) run(ctx context.Context, emit func(eve *dao.EventJson)) {
+	defer close(s.stopped)
+	interval := s.flushTimeout / 4
+	if interval < 50*time.Millisecond {
+		interval = 50 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			for _, eve := range s.expire(time.Time{}) {
+				emit(eve)
+			}
+			return
+		case <-s.stop:
+			for _, eve := range s.expire(time.Time{}) {
+				emit(eve)
+			}
+			return
+		case now := <-ticker.C:
+			for _, eve := range s.expire(now.Add(-s.flushTimeout)) {
+				emit(eve)
+			}
+		}
+	}
+}
+
+// expire removes the events whose last line came before cutoff (all if cutoff is zero) and returns them joined,
+// oldest first.
+func (s *multilineStage) expire(cutoff time.Time) []*dao.EventJson {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var events []*dao.EventJson
+	for elem := s.lru.Back(); elem != nil; elem = s.lru.Back() {
+		if !cutoff.IsZero() && !elem.Value.(*multilineEvent).last.Before(cutoff) {
+			break
+		}
+		events = append(events, s.remove(elem))
+	}
+	return events
+}
+
+// remove forgets a held event and returns it joined, s.mu must be held.
+func (s *multilineStage) remove(elem *list.Element) *dao.EventJson {
+	held := s.lru.Remove(elem).(*multilineEvent)
+	delete(s.pending, held.key)
+	return s.join(held)
+}
+
+func (s *multilineStage) join(held *multilineEvent) *dao.EventJson {
+	if len(held.lines) > 1 {
+		SetField(held.eve, s.Field, strings.Join(held.lines, "\n"))
+	}
+	held.eve.Ack = held.ack
+	return held.eve
+}
+
+// chainAck calls both acks, either may be nil.
+func chainAck(first func(err error), second func(err error)) func(err error) {
+	if first == nil {
+		return second
+	}
+	if second == nil {
+		return first
+	}
+	return func(err error) {
+		first(err)
+		second(err)
+	}
+}
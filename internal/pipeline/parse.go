@@ -0,0 +1,213 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/xinkaiwang/hermes/internal/dao"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kerror"
+)
+
+// parseStage extracts fields from a text field with grok patterns or named group regexps, exp:
+//
+//	{"type": "parse", "field": "message", "grok": ["%{NGINXACCESS}", "%{NGINXERROR}"], "overwrite": true}
+//
+// Patterns are tried in order, the first match wins. Events that match no pattern get tag_on_failure in their tags.
+type parseStage struct {
+	Field        string            `json:"field"`    // default message
+	Grok         []string          `json:"grok"`     // exp: %{IP:client} %{WORD:method} %{NUMBER:bytes:int}
+	Regex        []string          `json:"regex"`    // exp: (?P<user>\w+) logged in
+	Patterns     map[string]string `json:"patterns"` // custom grok patterns, exp: {"ORDERID": "ORD-[0-9]+"}
+	Target       string            `json:"target"`   // put the fields under this path instead of the top level
+	Overwrite    bool              `json:"overwrite"`
+	RemoveField  bool              `json:"remove_field"`   // remove the source field after a match
+	TagOnFailure *string           `json:"tag_on_failure"` // default _parse_failure, "" disables
+	matchers     []*fieldMatcher
+}
+
+// fieldMatcher is a compiled grok or regexp, fields[i] is the destination of group i.
+type fieldMatcher struct {
+	re     *regexp.Regexp
+	fields []grokField
+}
+
+type grokField struct {
+	path string // empty for unnamed groups
+	typ  string // int, float or empty for string
+}
+
+var grokRef = regexp.MustCompile(`%\{(\w+)(?::([\w.@-]+))?(?::(int|float))?\}`)
+
+func newParseStage(config StageConfig) Stage {
+	stage := &parseStage{}
+	decodeStageConfig(config, stage)
+	if stage.Field == "" {
+		stage.Field = "message"
+	}
+	if stage.TagOnFailure == nil {
+		tag := "_parse_failure"
+		stage.TagOnFailure = &tag
+	}
+	if len(stage.Grok) == 0 && len(stage.Regex) == 0 {
+		panic(kerror.Create("PipelineConfigInvalid", "parse needs grok or regex"))
+	}
+	for _, expr := range stage.Grok {
+		matcher, err := compileGrok(expr, stage.Patterns)
+		if err != nil {
+			panic(kerror.Wrap(err, "PipelineConfigInvalid", "invalid grok", false).With("grok", expr))
+		}
+		stage.matchers = append(stage.matchers, matcher)
+	}
+	for _, expr := range stage.Regex {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			panic(kerror.Wrap(err, "PipelineConfigInvalid", "invalid regex", false).With("regex", expr))
+		}
+		matcher := &fieldMatcher{re: re}
+		for _, name := range re.SubexpNames() {
+			matcher.fields = append(matcher.fields, grokField{path: name})
+		}
+		stage.matchers = append(stage.matchers, matcher)
+	}
+	return stage
+}
+
+// compileGrok expands %{NAME}, %{NAME:field} and %{NAME:field:int|float} into a regexp. custom patterns take
+// precedence over the bundled ones.
+func compileGrok(expr string, custom map[string]string) (*fieldMatcher, error) {
+	matcher := &fieldMatcher{fields: []grokField{{}}} // group 0 is the whole match
+	var expand func(expr string, depth int) (string, error)
+	expand = func(expr string, depth int) (string, error) {
+		if depth > 20 {
+			return "", fmt.Errorf("grok patterns nested too deep (recursive?)")
+		}
+		var sb strings.Builder
+		last := 0
+		for _, ref := range grokRef.FindAllStringSubmatchIndex(expr, -1) {
+			sb.WriteString(expr[last:ref[0]])
+			last = ref[1]
+			name := expr[ref[2]:ref[3]]
+			pattern, ok := custom[name]
+			if !ok {
+				pattern, ok = grokPatterns[name]
+			}
+			if !ok {
+				return "", fmt.Errorf("unknown grok pattern %s", name)
+			}
+			if ref[4] < 0 {
+				inner, err := expand(pattern, depth+1)
+				if err != nil {
+					return "", err
+				}
+				sb.WriteString("(?:" + inner + ")")
+				continue
+			}
+			// the group is numbered before the inner ones, in the order RE2 numbers opening parentheses
+			group := grokField{path: expr[ref[4]:ref[5]]}
+			if ref[6] >= 0 {
+				group.typ = expr[ref[6]:ref[7]]
+			}
+			fmt.Fprintf(&sb, "(?P<g%d>", len(matcher.fields))
+			matcher.fields = append(matcher.fields, group)
+			inner, err := expand(pattern, depth+1)
+			if err != nil {
+				return "", err
+			}
+			sb.WriteString(inner + ")")
+		}
+		sb.WriteString(expr[last:])
+		return sb.String(), nil
+	}
+	expanded, err := expand(expr, 0)
+	if err != nil {
+		return nil, err
+	}
+	re, err := regexp.Compile(expanded)
+	if err != nil {
+		return nil, err
+	}
+	// map the regexp groups (which include unnamed groups of the patterns) to the named fields
+	fields := make([]grokField, re.NumSubexp()+1)
+	for i, name := range re.SubexpNames() {
+		var n int
+		if _, err := fmt.Sscanf(name, "g%d", &n); err == nil && n < len(matcher.fields) {
+			fields[i] = matcher.fields[n]
+		}
+	}
+	matcher.re = re
+	matcher.fields = fields
+	return matcher, nil
+}
+
+func (s *parseStage) Process(ctx context.Context, eve *dao.EventJson) (*dao.EventJson, error) {
+	value, ok := GetField(eve, s.Field)
+	if !ok {
+		return eve, nil
+	}
+	text, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a string", s.Field)
+	}
+	for _, matcher := range s.matchers {
+		match := matcher.re.FindStringSubmatchIndex(text)
+		if match == nil {
+			continue
+		}
+		extracted := make(map[string]interface{})
+		for i, field := range matcher.fields {
+			if field.path == "" || match[2*i] < 0 {
+				continue
+			}
+			var result interface{} = text[match[2*i]:match[2*i+1]]
+			if field.typ != "" {
+				converted, err := castValue(result, field.typ)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", field.path, err)
+				}
+				result = converted
+			}
+			extracted[field.path] = result
+		}
+		// the source is removed only once every field is written, a failed write keeps the original line
+		replaced := false
+		for _, path := range sortedKeys(extracted) {
+			dest := path
+			if s.Target != "" {
+				dest = s.Target + "." + path
+			}
+			replacesSource := s.RemoveField && dest == s.Field
+			if _, exists := GetField(eve, dest); exists && !s.Overwrite && !replacesSource {
+				continue
+			}
+			if err := SetField(eve, dest, extracted[path]); err != nil {
+				return nil, err
+			}
+			replaced = replaced || replacesSource
+		}
+		if s.RemoveField && !replaced {
+			DeleteField(eve, s.Field)
+		}
+		return eve, nil
+	}
+	if *s.TagOnFailure != "" {
+		addTag(eve, *s.TagOnFailure)
+	}
+	return eve, nil
+}
+
+// addTag appends a tag to the tags field (an array), unless it is there already.
+func addTag(eve *dao.EventJson, tag string) {
+	tags, _ := GetField(eve, "tags")
+	list, ok := tags.([]interface{})
+	if !ok && tags != nil {
+		list = []interface{}{tags}
+	}
+	for _, item := range list {
+		if item == tag {
+			return
+		}
+	}
+	SetField(eve, "tags", append(list, tag))
+}
@@ -0,0 +1,288 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/xinkaiwang/hermes/internal/dao"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kcommon"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kerror"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/klogging"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kmetrics"
+)
+
+var (
+	StageEventsMetric = kmetrics.CreateKmetric(context.Background(), "pipeline_stage_events", "desc", []string{"pipeline", "stage", "result"})
+)
+
+const (
+	OnErrorSkip       = "skip"        // continue with the event as it was before the stage
+	OnErrorDrop       = "drop"        // drop the event
+	OnErrorDeadLetter = "dead_letter" // send the event to the dead letter index, with the error attached
+)
+
+// Config is the content of PIPELINE_CONFIG_FILE.
+type Config struct {
+	DeadLetterIndex string           `json:"dead_letter_index,omitempty"` // default dead_letter
+	Pipelines       []PipelineConfig `json:"pipelines"`
+}
+
+// PipelineConfig is one chain of stages. An event runs through the first pipeline whose inputs and when match.
+type PipelineConfig struct {
+	Name   string        `json:"name"`
+	Inputs []string      `json:"inputs,omitempty"` // exp: ["post", "gelf"], empty matches every input
+	When   *Condition    `json:"when,omitempty"`   // route, exp: {"field": "@index", "equals": "web"}
+	Stages []StageConfig `json:"stages"`
+}
+
+// StageConfig holds the options common to all stages, Raw is the whole json object for the stage specific options.
+type StageConfig struct {
+	Type    string          `json:"type"`
+	Name    string          `json:"name,omitempty"`     // for metrics, default <position>-<type>
+	OnError string          `json:"on_error,omitempty"` // skip (default), drop or dead_letter
+	When    *Condition      `json:"when,omitempty"`     // run the stage only for matching events
+	Raw     json.RawMessage `json:"-"`
+}
+
+func (c *StageConfig) UnmarshalJSON(data []byte) error {
+	type plain StageConfig
+	if err := json.Unmarshal(data, (*plain)(c)); err != nil {
+		return err
+	}
+	c.Raw = append(json.RawMessage(nil), data...)
+	return nil
+}
+
+// Pipeline runs events through the configured chains before they are handed to emit (the batch uploader).
+// Without chains every event is emitted unchanged.
+type Pipeline struct {
+	ctx             context.Context
+	chains          []*chain
+	deadLetterIndex string
+	emit            func(eve *dao.EventJson)
+}
+
+type chain struct {
+	name   string
+	inputs map[string]bool
+	when   *Condition
+	stages []*stageRunner
+}
+
+type stageRunner struct {
+	name    string
+	onError string
+	when    *Condition
+	stage   Stage
+}
+
+// NewPipelineFromEnv loads PIPELINE_CONFIG_FILE, no file means no processing.
+func NewPipelineFromEnv(ctx context.Context, emit func(eve *dao.EventJson)) *Pipeline {
+	path := kcommon.GetEnvString("PIPELINE_CONFIG_FILE", "")
+	if path == "" {
+		return NewPipeline(ctx, &Config{}, emit)
+	}
+	config, err := LoadConfig(path)
+	if err != nil {
+		panic(err)
+	}
+	pipeline := NewPipeline(ctx, config, emit)
+	klogging.Info(ctx).With("path", path).With("pipelines", len(pipeline.chains)).Log("Pipeline", "loaded")
+	return pipeline
+}
+
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, kerror.Wrap(err, "PipelineConfigInvalid", "can not read PIPELINE_CONFIG_FILE", false).With("path", path)
+	}
+	config := &Config{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, kerror.Wrap(err, "PipelineConfigInvalid", "invalid json", false).With("path", path)
+	}
+	return config, nil
+}
+
+// NewPipeline builds the stages, an invalid config panics with PipelineConfigInvalid.
+func NewPipeline(ctx context.Context, config *Config, emit func(eve *dao.EventJson)) *Pipeline {
+	pipeline := &Pipeline{
+		ctx:             ctx,
+		deadLetterIndex: config.DeadLetterIndex,
+		emit:            emit,
+	}
+	if pipeline.deadLetterIndex == "" {
+		pipeline.deadLetterIndex = "dead_letter"
+	}
+	for i, pc := range config.Pipelines {
+		c := &chain{
+			name: pc.Name,
+			when: pc.When,
+		}
+		if c.name == "" {
+			c.name = fmt.Sprintf("pipeline-%d", i)
+		}
+		if len(pc.Inputs) > 0 {
+			c.inputs = make(map[string]bool)
+			for _, input := range pc.Inputs {
+				c.inputs[input] = true
+			}
+		}
+		if err := pc.When.compile(); err != nil {
+			panic(kerror.Wrap(err, "PipelineConfigInvalid", "invalid when", false).With("pipeline", c.name))
+		}
+		for j, sc := range pc.Stages {
+			runner := &stageRunner{
+				name:    sc.Name,
+				onError: sc.OnError,
+				when:    sc.When,
+			}
+			if runner.name == "" {
+				runner.name = fmt.Sprintf("%d-%s", j, sc.Type)
+			}
+			switch runner.onError {
+			case "":
+				runner.onError = OnErrorSkip
+			case OnErrorSkip, OnErrorDrop, OnErrorDeadLetter:
+			default:
+				panic(kerror.Create("PipelineConfigInvalid", "on_error must be skip, drop or dead_letter").With("pipeline", c.name).With("stage", runner.name))
+			}
+			if err := sc.When.compile(); err != nil {
+				panic(kerror.Wrap(err, "PipelineConfigInvalid", "invalid when", false).With("pipeline", c.name).With("stage", runner.name))
+			}
+			ke := kcommon.TryCatchRun(ctx, func() {
+				runner.stage = newStage(ctx, sc)
+			})
+			if ke != nil {
+				panic(ke.With("pipeline", c.name).With("stage", runner.name))
+			}
+			c.stages = append(c.stages, runner)
+		}
+		pipeline.chains = append(pipeline.chains, c)
+	}
+	// started once all stages exist, generated events continue after the stage that made them
+	for _, c := range pipeline.chains {
+		for j, runner := range c.stages {
+			if bg, ok := runner.stage.(backgroundStage); ok {
+				c, next := c, j+1
+				bg.Start(ctx, func(eve *dao.EventJson) {
+					pipeline.run(c, next, eve)
+				})
+			}
+		}
+	}
+	return pipeline
+}
+
+// Close stops the background stages in chain order, so that what a stage still holds (exp: multiline events) runs
+// through the later stages and is emitted before Close returns. Call it once the inputs are closed.
+func (p *Pipeline) Close() {
+	for _, c := range p.chains {
+		for _, runner := range c.stages {
+			if bg, ok := runner.stage.(backgroundStage); ok {
+				bg.Stop()
+			}
+		}
+	}
+}
+
+// Process runs the event through the first matching chain and emits the result. A dropped event is acknowledged
+// right away, so that inputs waiting for the ack (exp: kafka) can move on.
+func (p *Pipeline) Process(input string, eve *dao.EventJson) {
+	c := p.route(input, eve)
+	if c == nil {
+		p.emit(eve)
+		return
+	}
+	p.run(c, 0, eve)
+}
+
+// run runs the event through the stages of c from start on and emits the result.
+func (p *Pipeline) run(c *chain, start int, eve *dao.EventJson) {
+	for _, runner := range c.stages[start:] {
+		if runner.when != nil && !runner.when.Match(eve) {
+			continue
+		}
+		var before *dao.EventJson
+		if _, ok := runner.stage.(readOnlyStage); !ok && runner.onError != OnErrorDrop {
+			before = snapshot(eve)
+		}
+		var out *dao.EventJson
+		var err error
+		ke := kcommon.TryCatchRun(p.ctx, func() {
+			out, err = runner.stage.Process(p.ctx, eve)
+		})
+		if ke != nil {
+			err = ke
+		}
+		if err != nil {
+			if before != nil {
+				eve = before // undo what the stage did before it failed
+			}
+			StageEventsMetric.GetTimeSequence(p.ctx, c.name, runner.name, "error").Add(1)
+			klogging.Verbose(p.ctx).With("pipeline", c.name).With("stage", runner.name).With("error", err.Error()).With("onError", runner.onError).Log("PipelineStageFailed", "")
+			switch runner.onError {
+			case OnErrorDrop:
+				ackDropped(eve)
+				return
+			case OnErrorDeadLetter:
+				p.emit(p.deadLetter(eve, c.name, runner.name, err))
+				return
+			}
+			continue
+		}
+		if out == nil {
+			StageEventsMetric.GetTimeSequence(p.ctx, c.name, runner.name, "dropped").Add(1)
+			ackDropped(eve)
+			return
+		}
+		StageEventsMetric.GetTimeSequence(p.ctx, c.name, runner.name, "ok").Add(1)
+		eve = out
+	}
+	p.emit(eve)
+}
+
+func (p *Pipeline) route(input string, eve *dao.EventJson) *chain {
+	for _, c := range p.chains {
+		if c.inputs != nil && !c.inputs[input] {
+			continue
+		}
+		if c.when != nil && !c.when.Match(eve) {
+			continue
+		}
+		return c
+	}
+	return nil
+}
+
+// deadLetter moves the event (as it was before the failed stage) to the dead letter index, with the error in
+// the _pipeline_error field.
+func (p *Pipeline) deadLetter(eve *dao.EventJson, pipeline string, stage string, err error) *dao.EventJson {
+	if eve.Event == nil {
+		eve.Event = make(map[string]interface{})
+	}
+	eve.Event["_pipeline_error"] = map[string]interface{}{
+		"pipeline": pipeline,
+		"stage":    stage,
+		"error":    err.Error(),
+		"index":    eve.Index,
+	}
+	eve.Index = p.deadLetterIndex
+	return eve
+}
+
+// snapshot copies the event and its fields, so that a failed stage can be undone.
+func snapshot(eve *dao.EventJson) *dao.EventJson {
+	copied := *eve
+	if eve.Event != nil {
+		copied.Event = deepCopy(eve.Event).(map[string]interface{})
+	}
+	return &copied
+}
+
+func ackDropped(eve *dao.EventJson) {
+	if eve.Ack != nil {
+		eve.Ack(nil)
+	}
+}
@@ -0,0 +1,273 @@
+package pipeline
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/xinkaiwang/hermes/internal/dao"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kerror"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kmetrics"
+)
+
+var (
+	RedactionsMetric = kmetrics.CreateKmetric(context.Background(), "pipeline_redactions", "desc", []string{"rule"})
+)
+
+const (
+	RedactMask   = "mask"   // replace the match with the mask text
+	RedactHash   = "hash"   // replace the match with [<rule>:<hmac>], equal values give equal hashes
+	RedactRemove = "remove" // remove the whole field
+)
+
+// redactRule finds one kind of sensitive value. If the regexp has a group, only the first group is replaced
+// (exp: the token after "Bearer "). valid (optional) rejects false positives.
+type redactRule struct {
+	name  string
+	re    *regexp.Regexp
+	valid func(match string) bool
+	mode  string
+}
+
+// builtinRedactRules in the order they are applied.
+var builtinRedactRules = []*redactRule{
+	{name: "jwt", re: regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)},
+	{name: "bearer", re: regexp.MustCompile(`(?i)\bbearer\s+([A-Za-z0-9._~+/-]+=*)`)},
+	{name: "aws_key", re: regexp.MustCompile(`\b(?:AKIA|ASIA|ABIA|ACCA)[0-9A-Z]{16}\b`)},
+	{name: "aws_secret", re: regexp.MustCompile(`(?i)aws_?secret_?(?:access_?)?key["']?\s*[:=]\s*["']?([A-Za-z0-9/+=]{40})`)},
+	{name: "email", re: regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)},
+	{name: "credit_card", re: regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`), valid: luhnValid},
+	{name: "ipv4", re: regexp.MustCompile(`\b(?:(?:25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)\.){3}(?:25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)\b`)},
+	// not preceded by a letter or digit, so that exp: Foo::Bar is not taken for an address
+	{name: "ipv6", re: regexp.MustCompile(`(?i)(?:^|[^0-9a-z:.])((?:[0-9a-f]{0,4}:){2,7}[0-9a-f]{0,4})`), valid: func(match string) bool {
+		return strings.Count(match, ":") >= 2 && net.ParseIP(match) != nil
+	}},
+}
+
+// redactStage masks sensitive values in all string fields, exp:
+//
+//	{"type": "redact", "detectors": ["email", "credit_card"], "mode": "hash", "deny_fields": ["password"],
+//	 "patterns": [{"name": "session", "regex": "session=(\\w+)"}]}
+type redactStage struct {
+	Detectors   []string          `json:"detectors"` // default all built-in rules
+	Patterns    []redactPattern   `json:"patterns"`
+	AllowFields []string          `json:"allow_fields"` // never redacted, path or glob (exp: "trace.*")
+	DenyFields  []string          `json:"deny_fields"`  // always redacted as a whole
+	Mode        string            `json:"mode"`         // mask (default), hash or remove
+	RuleModes   map[string]string `json:"rule_modes"`   // per rule mode, exp: {"email": "hash"}
+	MaskText    string            `json:"mask"`         // default [REDACTED]
+	HashKeyEnv  string            `json:"hash_key_env"` // env var with the hmac key, default REDACT_HASH_KEY
+	rules       []*redactRule
+	hashKey     []byte
+}
+
+type redactPattern struct {
+	Name  string `json:"name"`
+	Regex string `json:"regex"`
+	Mode  string `json:"mode"`
+}
+
+func newRedactStage(config StageConfig) Stage {
+	stage := &redactStage{}
+	decodeStageConfig(config, stage)
+	if stage.Mode == "" {
+		stage.Mode = RedactMask
+	}
+	if stage.MaskText == "" {
+		stage.MaskText = "[REDACTED]"
+	}
+	if stage.HashKeyEnv == "" {
+		stage.HashKeyEnv = "REDACT_HASH_KEY"
+	}
+	if stage.Detectors == nil {
+		for _, rule := range builtinRedactRules {
+			stage.Detectors = append(stage.Detectors, rule.name)
+		}
+	}
+	for _, name := range stage.Detectors {
+		var builtin *redactRule
+		for _, rule := range builtinRedactRules {
+			if rule.name == name {
+				builtin = rule
+			}
+		}
+		if builtin == nil {
+			panic(kerror.Create("PipelineConfigInvalid", "unknown redact detector").With("detector", name))
+		}
+		rule := *builtin
+		stage.rules = append(stage.rules, &rule)
+	}
+	for _, pattern := range stage.Patterns {
+		re, err := regexp.Compile(pattern.Regex)
+		if err != nil || pattern.Name == "" {
+			panic(kerror.Create("PipelineConfigInvalid", "redact pattern needs name and a valid regex").With("pattern", pattern.Name))
+		}
+		stage.rules = append(stage.rules, &redactRule{name: pattern.Name, re: re, mode: pattern.Mode})
+	}
+	for _, rule := range stage.rules {
+		if rule.mode == "" {
+			rule.mode = stage.RuleModes[rule.name]
+		}
+		if rule.mode == "" {
+			rule.mode = stage.Mode
+		}
+	}
+	for _, mode := range append([]string{stage.Mode, stage.ruleMode("deny")}, stage.modes()...) {
+		switch mode {
+		case RedactMask, RedactRemove:
+		case RedactHash:
+			if stage.hashKey == nil {
+				key := os.Getenv(stage.HashKeyEnv)
+				if key == "" {
+					panic(kerror.Create("PipelineConfigInvalid", "redact mode hash needs a key").With("env", stage.HashKeyEnv))
+				}
+				stage.hashKey = []byte(key)
+			}
+		default:
+			panic(kerror.Create("PipelineConfigInvalid", "redact mode must be mask, hash or remove").With("mode", mode))
+		}
+	}
+	return stage
+}
+
+func (s *redactStage) modes() []string {
+	modes := make([]string, 0, len(s.rules))
+	for _, rule := range s.rules {
+		modes = append(modes, rule.mode)
+	}
+	return modes
+}
+
+func (s *redactStage) ruleMode(rule string) string {
+	if mode := s.RuleModes[rule]; mode != "" {
+		return mode
+	}
+	return s.Mode
+}
+
+func (s *redactStage) Process(ctx context.Context, eve *dao.EventJson) (*dao.EventJson, error) {
+	for key, value := range eve.Event {
+		if result, keep := s.redactValue(ctx, key, value); keep {
+			eve.Event[key] = result
+		} else {
+			delete(eve.Event, key)
+		}
+	}
+	return eve, nil
+}
+
+// redactValue returns the redacted value, keep is false if the field has to be removed.
+func (s *redactStage) redactValue(ctx context.Context, fieldPath string, value interface{}) (interface{}, bool) {
+	if matchFieldPath(s.AllowFields, fieldPath) {
+		return value, true
+	}
+	if matchFieldPath(s.DenyFields, fieldPath) {
+		RedactionsMetric.GetTimeSequence(ctx, "deny").Add(1)
+		switch mode := s.ruleMode("deny"); mode {
+		case RedactRemove:
+			return nil, false
+		default:
+			return s.replacement("deny", mode, valueString(value)), true
+		}
+	}
+	switch v := value.(type) {
+	case string:
+		return s.redactString(ctx, v)
+	case map[string]interface{}:
+		for key, item := range v {
+			if result, keep := s.redactValue(ctx, fieldPath+"."+key, item); keep {
+				v[key] = result
+			} else {
+				delete(v, key)
+			}
+		}
+	case []interface{}:
+		items := v[:0]
+		for _, item := range v {
+			if result, keep := s.redactValue(ctx, fieldPath, item); keep {
+				items = append(items, result)
+			}
+		}
+		return items, true
+	}
+	return value, true
+}
+
+func (s *redactStage) redactString(ctx context.Context, str string) (interface{}, bool) {
+	for _, rule := range s.rules {
+		matches := rule.re.FindAllStringSubmatchIndex(str, -1)
+		if len(matches) == 0 {
+			continue
+		}
+		var sb strings.Builder
+		last := 0
+		for _, match := range matches {
+			start, end := match[0], match[1]
+			if len(match) >= 4 && match[2] >= 0 {
+				start, end = match[2], match[3]
+			}
+			if rule.valid != nil && !rule.valid(str[start:end]) {
+				continue
+			}
+			RedactionsMetric.GetTimeSequence(ctx, rule.name).Add(1)
+			if rule.mode == RedactRemove {
+				return nil, false
+			}
+			sb.WriteString(str[last:start])
+			sb.WriteString(s.replacement(rule.name, rule.mode, str[start:end]))
+			last = end
+		}
+		sb.WriteString(str[last:])
+		str = sb.String()
+	}
+	return str, true
+}
+
+func (s *redactStage) replacement(rule string, mode string, value string) string {
+	if mode != RedactHash {
+		return s.MaskText
+	}
+	mac := hmac.New(sha256.New, s.hashKey)
+	mac.Write([]byte(value))
+	return "[" + rule + ":" + hex.EncodeToString(mac.Sum(nil)[:8]) + "]"
+}
+
+// matchFieldPath matches a path against names or globs, a name also matches everything below it.
+func matchFieldPath(patterns []string, fieldPath string) bool {
+	for _, pattern := range patterns {
+		if pattern == fieldPath || strings.HasPrefix(fieldPath, pattern+".") {
+			return true
+		}
+		if ok, _ := path.Match(pattern, fieldPath); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// luhnValid checks the credit card checksum of the digits in match.
+func luhnValid(match string) bool {
+	sum, count := 0, 0
+	for i := len(match) - 1; i >= 0; i-- {
+		c := match[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		digit := int(c - '0')
+		if count%2 == 1 {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+		count++
+	}
+	return count >= 13 && count <= 19 && sum%10 == 0
+}
@@ -0,0 +1,195 @@
+package pipeline
+
+import (
+	"context"
+	"hash/fnv"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xinkaiwang/hermes/internal/dao"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kerror"
+)
+
+// filterStage drops events by condition, exp:
+//
+//	{"type": "filter", "drop": [{"field": "level", "in": ["debug", "trace"]}], "keep": {"field": "@index", "exists": true}}
+//
+// An event is dropped if it matches any drop condition, or if keep is set and it does not match keep.
+type filterStage struct {
+	Drop []*Condition `json:"drop"`
+	Keep *Condition   `json:"keep"`
+}
+
+func newFilterStage(config StageConfig) Stage {
+	stage := &filterStage{}
+	decodeStageConfig(config, stage)
+	if len(stage.Drop) == 0 && stage.Keep == nil {
+		panic(kerror.Create("PipelineConfigInvalid", "filter needs drop or keep"))
+	}
+	for _, cond := range append(append([]*Condition{}, stage.Drop...), stage.Keep) {
+		if err := cond.compile(); err != nil {
+			panic(kerror.Wrap(err, "PipelineConfigInvalid", "invalid filter condition", false))
+		}
+	}
+	return stage
+}
+
+func (s *filterStage) Process(ctx context.Context, eve *dao.EventJson) (*dao.EventJson, error) {
+	for _, cond := range s.Drop {
+		if cond.Match(eve) {
+			return nil, nil
+		}
+	}
+	if s.Keep != nil && !s.Keep.Match(eve) {
+		return nil, nil
+	}
+	return eve, nil
+}
+
+func (s *filterStage) readOnly() {}
+
+const (
+	SampleFixed   = "fixed"   // keep 1 of rate events at random
+	SampleHash    = "hash"    // keep 1 of rate keys, all events of a kept key (exp: whole traces)
+	SampleDynamic = "dynamic" // per key rate from the key's volume in the previous window, rare keys are all kept
+)
+
+// sampleStage keeps a share of the events and writes the sample rate (1 kept event stands for rate events) to
+// rate_field, so that searches can reweight counts, exp:
+//
+//	{"type": "sample", "mode": "dynamic", "key_fields": ["service", "level"], "target_per_key": 100, "window": "1m",
+//	 "when": {"field": "level", "equals": "debug"}}
+type sampleStage struct {
+	Mode         string   `json:"mode"`           // fixed (default), hash or dynamic
+	Rate         int      `json:"rate"`           // fixed and hash: keep 1 of rate
+	KeyFields    []string `json:"key_fields"`     // hash and dynamic
+	TargetPerKey int      `json:"target_per_key"` // dynamic: events to keep per key and window, default 10
+	Window       string   `json:"window"`         // dynamic: go duration, default 30s
+	MaxRate      int      `json:"max_rate"`       // dynamic: rate cap, 0 = none
+	MaxKeys      int      `json:"max_keys"`       // dynamic: keys tracked per window, the rest share one key, default 10000
+	RateField    *string  `json:"rate_field"`     // default sample_rate, "" disables
+	window       time.Duration
+
+	mu          sync.Mutex
+	windowStart time.Time
+	current     map[string]int // events seen per key in this window
+	previous    map[string]int
+}
+
+func newSampleStage(config StageConfig) Stage {
+	stage := &sampleStage{}
+	decodeStageConfig(config, stage)
+	if stage.Mode == "" {
+		stage.Mode = SampleFixed
+	}
+	if stage.RateField == nil {
+		field := "sample_rate"
+		stage.RateField = &field
+	}
+	switch stage.Mode {
+	case SampleFixed, SampleHash:
+		if stage.Rate < 1 {
+			panic(kerror.Create("PipelineConfigInvalid", "sample rate must be >= 1").With("mode", stage.Mode))
+		}
+		if stage.Mode == SampleHash && len(stage.KeyFields) == 0 {
+			panic(kerror.Create("PipelineConfigInvalid", "sample mode hash needs key_fields"))
+		}
+	case SampleDynamic:
+		if len(stage.KeyFields) == 0 {
+			panic(kerror.Create("PipelineConfigInvalid", "sample mode dynamic needs key_fields"))
+		}
+		if stage.TargetPerKey <= 0 {
+			stage.TargetPerKey = 10
+		}
+		if stage.MaxKeys <= 0 {
+			stage.MaxKeys = 10000
+		}
+		if stage.Window == "" {
+			stage.Window = "30s"
+		}
+		stage.window = parseStageDuration(stage.Window, "window")
+		if stage.window <= 0 {
+			panic(kerror.Create("PipelineConfigInvalid", "sample window must be > 0"))
+		}
+		stage.windowStart = time.Now()
+		stage.current = make(map[string]int)
+		stage.previous = make(map[string]int)
+	default:
+		panic(kerror.Create("PipelineConfigInvalid", "sample mode must be fixed, hash or dynamic").With("mode", stage.Mode))
+	}
+	return stage
+}
+
+func (s *sampleStage) Process(ctx context.Context, eve *dao.EventJson) (*dao.EventJson, error) {
+	var rate int
+	var keep bool
+	switch s.Mode {
+	case SampleFixed:
+		rate = s.Rate
+		keep = rand.Intn(rate) == 0
+	case SampleHash:
+		rate = s.Rate
+		h := fnv.New64a()
+		h.Write([]byte(s.key(eve)))
+		keep = h.Sum64()%uint64(rate) == 0
+	case SampleDynamic:
+		rate, keep = s.dynamic(s.key(eve))
+	}
+	if !keep {
+		return nil, nil
+	}
+	if *s.RateField != "" {
+		// an event sampled twice stands for the product of the rates
+		total := float64(rate)
+		if prior, ok := GetField(eve, *s.RateField); ok {
+			if f, ok := toFloat(prior); ok && f > 0 {
+				total *= f
+			}
+		}
+		if err := SetField(eve, *s.RateField, total); err != nil {
+			return nil, err
+		}
+	}
+	return eve, nil
+}
+
+// key joins the key field values, missing fields count as empty.
+func (s *sampleStage) key(eve *dao.EventJson) string {
+	values := make([]string, len(s.KeyFields))
+	for i, field := range s.KeyFields {
+		if value, ok := GetField(eve, field); ok {
+			values[i] = valueString(value)
+		}
+	}
+	return strings.Join(values, "\x00")
+}
+
+// dynamic returns the rate of the key, from its count in the previous window, and whether this event is kept.
+// Every rate-th event of a key is kept, the first one included.
+func (s *sampleStage) dynamic(key string) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if elapsed := time.Since(s.windowStart); elapsed >= s.window {
+		s.previous = s.current
+		if elapsed >= 2*s.window {
+			s.previous = make(map[string]int) // idle for a window, nothing to go by
+		}
+		s.current = make(map[string]int)
+		s.windowStart = time.Now()
+	}
+	if _, ok := s.current[key]; !ok && len(s.current) >= s.MaxKeys {
+		key = "\x00other"
+	}
+	rate := 1
+	if prev := s.previous[key]; prev > s.TargetPerKey {
+		rate = (prev + s.TargetPerKey - 1) / s.TargetPerKey
+	}
+	if s.MaxRate > 0 && rate > s.MaxRate {
+		rate = s.MaxRate
+	}
+	seen := s.current[key]
+	s.current[key] = seen + 1
+	return rate, seen%rate == 0
+}
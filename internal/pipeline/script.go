@@ -0,0 +1,317 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/xinkaiwang/hermes/internal/dao"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kerror"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/klogging"
+	starlarkjson "go.starlark.net/lib/json"
+	starlarkmath "go.starlark.net/lib/math"
+	"go.starlark.net/starlark"
+)
+
+// metadataKeys are the EventJson metadata, as seen by scripts.
+var metadataKeys = []string{"@time", "@host", "@source", "@sourcetype", "@index"}
+
+// Script is a compiled starlark script with a process(event) function. event is a dict with the event fields
+// and the metadata keys @time (epoch ms), @host, @source, @sourcetype and @index. process modifies it in place and
+// returns None or True to keep the event, False to drop it, or a new dict to replace it. Scripts can use the json
+// and math modules, and print.
+type Script struct {
+	name     string
+	process  starlark.Callable
+	maxSteps uint64
+	timeout  time.Duration
+	Print    func(msg string) // print() output, default discarded
+}
+
+// CompileScript parses and runs the top level of the script once, and checks that it defines process(event).
+// maxSteps and timeout (0 = no limit) are the budget of each process call.
+func CompileScript(filename string, source string, maxSteps uint64, timeout time.Duration) (*Script, error) {
+	script := &Script{name: filename, maxSteps: maxSteps, timeout: timeout}
+	predeclared := starlark.StringDict{
+		"json": starlarkjson.Module,
+		"math": starlarkmath.Module,
+	}
+	thread := script.newThread()
+	if maxSteps > 0 {
+		thread.SetMaxExecutionSteps(maxSteps * 10) // the top level may build tables
+	}
+	globals, err := starlark.ExecFile(thread, filename, source, predeclared)
+	if err != nil {
+		return nil, scriptError(err)
+	}
+	globals.Freeze() // shared by concurrent calls
+	process, ok := globals["process"].(*starlark.Function)
+	if !ok {
+		return nil, fmt.Errorf("%s: no process function", filename)
+	}
+	if process.NumParams() != 1 {
+		return nil, fmt.Errorf("%s: process must take one parameter (event), not %d", filename, process.NumParams())
+	}
+	script.process = process
+	return script, nil
+}
+
+func (s *Script) newThread() *starlark.Thread {
+	return &starlark.Thread{
+		Name: s.name,
+		Print: func(_ *starlark.Thread, msg string) {
+			if s.Print != nil {
+				s.Print(msg)
+			}
+		},
+	}
+}
+
+// Run calls process, nil means drop. eve is not modified.
+func (s *Script) Run(eve *dao.EventJson) (*dao.EventJson, error) {
+	thread := s.newThread()
+	if s.maxSteps > 0 {
+		thread.SetMaxExecutionSteps(s.maxSteps)
+	}
+	if s.timeout > 0 {
+		timer := time.AfterFunc(s.timeout, func() {
+			thread.Cancel(fmt.Sprintf("timeout after %v", s.timeout))
+		})
+		defer timer.Stop()
+	}
+	event, err := eventToStarlark(eve)
+	if err != nil {
+		return nil, err
+	}
+	result, err := starlark.Call(thread, s.process, starlark.Tuple{event}, nil)
+	if err != nil {
+		return nil, scriptError(err)
+	}
+	switch r := result.(type) {
+	case starlark.NoneType:
+	case starlark.Bool:
+		if !r {
+			return nil, nil
+		}
+	case *starlark.Dict:
+		event = r
+	default:
+		return nil, fmt.Errorf("process must return None, True, False or a dict, got %s", result.Type())
+	}
+	return eventFromStarlark(eve, event)
+}
+
+// scriptError adds the starlark stack to runtime errors.
+func scriptError(err error) error {
+	var evalErr *starlark.EvalError
+	if errors.As(err, &evalErr) {
+		return errors.New(strings.TrimSuffix(evalErr.Backtrace(), "\n"))
+	}
+	return err
+}
+
+func eventToStarlark(eve *dao.EventJson) (*starlark.Dict, error) {
+	dict := starlark.NewDict(len(eve.Event) + len(metadataKeys))
+	for _, key := range metadataKeys {
+		if value, ok := GetField(eve, key); ok {
+			converted, err := toStarlark(value)
+			if err != nil {
+				return nil, err
+			}
+			dict.SetKey(starlark.String(key), converted)
+		}
+	}
+	for _, key := range sortedKeys(eve.Event) {
+		converted, err := toStarlark(eve.Event[key])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		dict.SetKey(starlark.String(key), converted)
+	}
+	return dict, nil
+}
+
+// eventFromStarlark builds the result event, metadata the script did not set is kept from eve.
+func eventFromStarlark(eve *dao.EventJson, dict *starlark.Dict) (*dao.EventJson, error) {
+	result := &dao.EventJson{
+		Event:      make(map[string]interface{}, dict.Len()),
+		Time:       eve.Time,
+		Host:       eve.Host,
+		Source:     eve.Source,
+		SourceType: eve.SourceType,
+		Index:      eve.Index,
+		Ack:        eve.Ack,
+	}
+	for _, item := range dict.Items() {
+		key, ok := item[0].(starlark.String)
+		if !ok {
+			return nil, fmt.Errorf("event keys must be strings, got %s", item[0].Type())
+		}
+		value, err := fromStarlark(item[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", string(key), err)
+		}
+		if strings.HasPrefix(string(key), "@") {
+			if err := SetField(result, string(key), value); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		result.Event[string(key)] = value
+	}
+	return result, nil
+}
+
+// toStarlark converts a json value; whole numbers become ints, so that scripts can use them as such.
+func toStarlark(value interface{}) (starlark.Value, error) {
+	switch v := value.(type) {
+	case nil:
+		return starlark.None, nil
+	case bool:
+		return starlark.Bool(v), nil
+	case string:
+		return starlark.String(v), nil
+	case int:
+		return starlark.MakeInt(v), nil
+	case int64:
+		return starlark.MakeInt64(v), nil
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return starlark.MakeInt64(int64(v)), nil
+		}
+		return starlark.Float(v), nil
+	case []interface{}:
+		items := make([]starlark.Value, len(v))
+		for i, item := range v {
+			converted, err := toStarlark(item)
+			if err != nil {
+				return nil, err
+			}
+			items[i] = converted
+		}
+		return starlark.NewList(items), nil
+	case map[string]interface{}:
+		dict := starlark.NewDict(len(v))
+		for _, key := range sortedKeys(v) {
+			converted, err := toStarlark(v[key])
+			if err != nil {
+				return nil, err
+			}
+			dict.SetKey(starlark.String(key), converted)
+		}
+		return dict, nil
+	}
+	if f, ok := toFloat(value); ok {
+		return toStarlark(f)
+	}
+	return nil, fmt.Errorf("unsupported type %T", value)
+}
+
+// fromStarlark converts back to a json value, numbers become float64 like encoding/json does.
+func fromStarlark(value starlark.Value) (interface{}, error) {
+	switch v := value.(type) {
+	case starlark.NoneType:
+		return nil, nil
+	case starlark.Bool:
+		return bool(v), nil
+	case starlark.String:
+		return string(v), nil
+	case starlark.Int:
+		if i, ok := v.Int64(); ok {
+			return float64(i), nil
+		}
+		return finiteFloat(float64(v.Float()))
+	case starlark.Float:
+		return finiteFloat(float64(v))
+	case *starlark.List, starlark.Tuple:
+		iterable := v.(starlark.Indexable)
+		items := make([]interface{}, iterable.Len())
+		for i := range items {
+			converted, err := fromStarlark(iterable.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			items[i] = converted
+		}
+		return items, nil
+	case *starlark.Dict:
+		result := make(map[string]interface{}, v.Len())
+		for _, item := range v.Items() {
+			key, ok := item[0].(starlark.String)
+			if !ok {
+				return nil, fmt.Errorf("dict keys must be strings, got %s", item[0].Type())
+			}
+			converted, err := fromStarlark(item[1])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", string(key), err)
+			}
+			result[string(key)] = converted
+		}
+		return result, nil
+	}
+	return nil, fmt.Errorf("unsupported type %s", value.Type())
+}
+
+// finiteFloat rejects NaN and ±Inf, json can not represent them.
+func finiteFloat(f float64) (interface{}, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, fmt.Errorf("%v is not a finite number", f)
+	}
+	return f, nil
+}
+
+// scriptStage runs a starlark script (see Script), exp:
+//
+//	{"type": "script", "file": "/etc/hermes/route.star", "timeout": "20ms"}
+//	{"type": "script", "source": "def process(event):\n    event['env'] = 'prod'\n"}
+//
+// The script is compiled when the config is loaded. A script error, or a call over the step or time budget, fails
+// the stage (see on_error) and leaves the event unchanged.
+type scriptStage struct {
+	Source   string `json:"source"`
+	File     string `json:"file"`
+	MaxSteps uint64 `json:"max_steps"` // starlark steps per event, default 100000
+	Timeout  string `json:"timeout"`   // go duration per event, default 50ms
+	script   *Script
+}
+
+func newScriptStage(ctx context.Context, config StageConfig) Stage {
+	stage := &scriptStage{}
+	decodeStageConfig(config, stage)
+	if (stage.Source == "") == (stage.File == "") {
+		panic(kerror.Create("PipelineConfigInvalid", "script needs either source or file"))
+	}
+	filename := "<source>"
+	if stage.File != "" {
+		data, err := os.ReadFile(stage.File)
+		if err != nil {
+			panic(kerror.Wrap(err, "PipelineConfigInvalid", "can not read script", false).With("file", stage.File))
+		}
+		filename, stage.Source = stage.File, string(data)
+	}
+	if stage.MaxSteps == 0 {
+		stage.MaxSteps = 100000
+	}
+	if stage.Timeout == "" {
+		stage.Timeout = "50ms"
+	}
+	script, err := CompileScript(filename, stage.Source, stage.MaxSteps, parseStageDuration(stage.Timeout, "timeout"))
+	if err != nil {
+		panic(kerror.Wrap(err, "PipelineConfigInvalid", "invalid script", false).With("file", filename))
+	}
+	script.Print = func(msg string) {
+		klogging.Verbose(ctx).With("file", filename).With("msg", msg).Log("PipelineScriptPrint", "")
+	}
+	stage.script = script
+	return stage
+}
+
+func (s *scriptStage) Process(ctx context.Context, eve *dao.EventJson) (*dao.EventJson, error) {
+	return s.script.Run(eve)
+}
+
+func (s *scriptStage) readOnly() {}
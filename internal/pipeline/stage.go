@@ -0,0 +1,205 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+
+	"github.com/xinkaiwang/hermes/internal/dao"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kerror"
+)
+
+// Stage transforms one event. It returns the event to continue with (usually eve itself, modified in place), nil
+// to drop the event, or an error which is handled by the stage's on_error policy. The pipeline keeps a copy of the
+// event from before the stage for on_error skip and dead_letter, so a stage may fail after modifying the event.
+type Stage interface {
+	Process(ctx context.Context, eve *dao.EventJson) (*dao.EventJson, error)
+}
+
+// readOnlyStage is a Stage that never modifies the event it is given, the pipeline does not copy events for it.
+type readOnlyStage interface {
+	Stage
+	readOnly()
+}
+
+// backgroundStage is a Stage that also creates events on its own (exp: dedup summaries). The pipeline calls Start
+// once before any event; emitted events continue with the next stage of the chain. Start must not block, the
+// background work stops when ctx is done or Stop is called. Stop emits what the stage still holds and returns once
+// it is emitted.
+type backgroundStage interface {
+	Stage
+	Start(ctx context.Context, emit func(eve *dao.EventJson))
+	Stop()
+}
+
+// newStage builds a built-in stage, panics with PipelineConfigInvalid.
+func newStage(ctx context.Context, config StageConfig) Stage {
+	switch config.Type {
+	case "add":
+		return newAddStage(config)
+	case "remove":
+		return newRemoveStage(config)
+	case "rename":
+		return newRenameStage(config)
+	case "copy":
+		return newCopyStage(config)
+	case "set_metadata":
+		return newSetMetadataStage(config)
+	case "cast":
+		return newCastStage(config)
+	case "drop":
+		return &dropStage{}
+	case "redact":
+		return newRedactStage(config)
+	case "parse":
+		return newParseStage(config)
+	case "expand":
+		return newExpandStage(config)
+	case "timestamp":
+		return newTimestampStage(config)
+	case "filter":
+		return newFilterStage(config)
+	case "sample":
+		return newSampleStage(config)
+	case "dedup":
+		return newDedupStage(config)
+	case "multiline":
+		return newMultilineStage(config)
+	case "metric":
+		return newMetricStage(config)
+	case "script":
+		return newScriptStage(ctx, config)
+	default:
+		panic(kerror.Create("PipelineConfigInvalid", "unknown stage type").With("type", config.Type))
+	}
+}
+
+// decodeStageConfig unmarshals the stage specific options.
+func decodeStageConfig(config StageConfig, target interface{}) {
+	if err := json.Unmarshal(config.Raw, target); err != nil {
+		panic(kerror.Wrap(err, "PipelineConfigInvalid", "invalid stage options", false).With("type", config.Type))
+	}
+}
+
+// Condition selects events, exp: {"field": "level", "in": ["debug", "trace"]}. All the given tests must pass.
+type Condition struct {
+	Field   string        `json:"field,omitempty"`
+	Equals  interface{}   `json:"equals,omitempty"`
+	In      []interface{} `json:"in,omitempty"`
+	Exists  *bool         `json:"exists,omitempty"`
+	Matches string        `json:"matches,omitempty"` // regexp, on the value as string
+	Not     *Condition    `json:"not,omitempty"`
+	All     []*Condition  `json:"all,omitempty"`
+	Any     []*Condition  `json:"any,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// compile checks the condition and compiles the regexps, a nil condition is valid.
+func (c *Condition) compile() error {
+	if c == nil {
+		return nil
+	}
+	if c.Field == "" && (c.Equals != nil || c.In != nil || c.Exists != nil || c.Matches != "") {
+		return fmt.Errorf("condition without field")
+	}
+	if c.Matches != "" {
+		re, err := regexp.Compile(c.Matches)
+		if err != nil {
+			return err
+		}
+		c.re = re
+	}
+	if err := c.Not.compile(); err != nil {
+		return err
+	}
+	for _, sub := range append(append([]*Condition{}, c.All...), c.Any...) {
+		if err := sub.compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Condition) Match(eve *dao.EventJson) bool {
+	if c.Field != "" {
+		value, ok := GetField(eve, c.Field)
+		if c.Exists != nil && ok != *c.Exists {
+			return false
+		}
+		if c.Equals != nil && (!ok || !valueEquals(value, c.Equals)) {
+			return false
+		}
+		if c.In != nil {
+			found := false
+			for _, item := range c.In {
+				if ok && valueEquals(value, item) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+		if c.re != nil && (!ok || !c.re.MatchString(valueString(value))) {
+			return false
+		}
+	}
+	if c.Not != nil && c.Not.Match(eve) {
+		return false
+	}
+	for _, sub := range c.All {
+		if !sub.Match(eve) {
+			return false
+		}
+	}
+	if len(c.Any) > 0 {
+		for _, sub := range c.Any {
+			if sub.Match(eve) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// valueEquals compares json values, numbers of different go types compare by value (exp: 200 and 200.0).
+func valueEquals(a interface{}, b interface{}) bool {
+	if fa, ok := toFloat(a); ok {
+		fb, ok := toFloat(b)
+		return ok && fa == fb
+	}
+	return valueString(a) == valueString(b)
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// valueString is the value as text: strings as is, everything else as json.
+func valueString(value interface{}) string {
+	if str, ok := value.(string); ok {
+		return str
+	}
+	jsonData, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(jsonData)
+}
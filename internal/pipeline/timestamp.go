@@ -0,0 +1,237 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xinkaiwang/hermes/internal/dao"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kerror"
+)
+
+// named timestamp formats, everything else is a go layout (exp: "2006-01-02 15:04:05.000")
+var timestampFormats = map[string]string{
+	"rfc3339":    time.RFC3339Nano, // also parses RFC3339 without fraction
+	"rfc1123":    time.RFC1123,
+	"rfc1123z":   time.RFC1123Z,
+	"common_log": "02/Jan/2006:15:04:05 -0700",
+	"ansic":      time.ANSIC,
+	"unixdate":   time.UnixDate,
+	"syslog":     time.Stamp,
+	"datetime":   "2006-01-02 15:04:05.999999999",
+	"iso_local":  "2006-01-02T15:04:05.999999999", // no zone, see timezone
+}
+
+// DefaultTimestampFormats are tried in order when a timestamp stage has no formats.
+var DefaultTimestampFormats = []string{"epoch", "rfc3339", "datetime", "iso_local", "rfc1123z", "rfc1123", "common_log", "ansic", "unixdate"}
+
+// ParseTimestamp reads a timestamp from a json value. formats are tried in order: epoch (numbers or numeric strings,
+// the unit is guessed from the magnitude), epoch_s, epoch_ms, epoch_us, epoch_ns, the named formats above or go
+// layouts. loc is used for layouts without zone.
+func ParseTimestamp(value interface{}, formats []string, loc *time.Location) (time.Time, bool) {
+	if formats == nil {
+		formats = DefaultTimestampFormats
+	}
+	if loc == nil {
+		loc = time.UTC
+	}
+	num, isNum := toFloat(value)
+	str, isStr := value.(string)
+	if isStr {
+		str = strings.TrimSpace(str)
+		if f, err := strconv.ParseFloat(str, 64); err == nil {
+			num, isNum = f, true
+		}
+	}
+	for _, format := range formats {
+		if strings.HasPrefix(format, "epoch") {
+			if !isNum || math.IsNaN(num) || math.IsInf(num, 0) {
+				continue
+			}
+			if t, ok := epochTime(num, strings.TrimPrefix(format, "epoch")); ok {
+				return t, true
+			}
+			continue
+		}
+		if !isStr {
+			continue
+		}
+		layout, ok := timestampFormats[format]
+		if !ok {
+			layout = format
+		}
+		t, err := time.ParseInLocation(layout, str, loc)
+		if err != nil {
+			continue
+		}
+		if t.Year() == 0 { // layouts without year (syslog)
+			now := time.Now().In(loc)
+			t = t.AddDate(now.Year(), 0, 0)
+			if t.After(now.AddDate(0, 1, 0)) { // exp: a december line read in january
+				t = t.AddDate(-1, 0, 0)
+			}
+		}
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// epochTime converts an epoch number, unit is "" (guess), "_s", "_ms", "_us" or "_ns".
+func epochTime(num float64, unit string) (time.Time, bool) {
+	if unit == "" {
+		// seconds until the year 5138, then ms, us, ns
+		switch abs := math.Abs(num); {
+		case abs < 1e11:
+			unit = "_s"
+		case abs < 1e14:
+			unit = "_ms"
+		case abs < 1e17:
+			unit = "_us"
+		default:
+			unit = "_ns"
+		}
+	}
+	var ns float64
+	switch unit {
+	case "_s":
+		ns = num * 1e9
+	case "_ms":
+		ns = num * 1e6
+	case "_us":
+		ns = num * 1e3
+	case "_ns":
+		ns = num
+	default:
+		return time.Time{}, false
+	}
+	if math.Abs(ns) > math.MaxInt64 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(ns)), true
+}
+
+// timestampStage sets the event time from the first present source field, exp:
+//
+//	{"type": "timestamp", "fields": ["ts"], "formats": ["epoch_ms", "2006-01-02 15:04:05"], "timezone": "Europe/Berlin",
+//	 "max_age": "720h", "max_future": "1h"}
+//
+// Times outside max_age / max_future are clamped to the limit (or kept, see out_of_range) and tagged.
+type timestampStage struct {
+	Fields        []string `json:"fields"`  // default time, timestamp, @timestamp, ts
+	Formats       []string `json:"formats"` // default DefaultTimestampFormats
+	Timezone      string   `json:"timezone"`
+	Target        string   `json:"target"`       // default @time, other paths get an RFC3339 string
+	RemoveField   bool     `json:"remove_field"` // remove the source field after parsing
+	MaxAge        string   `json:"max_age"`      // go duration, exp: 720h
+	MaxFuture     string   `json:"max_future"`
+	OutOfRange    string   `json:"out_of_range"`     // clamp (default) or keep
+	TagOutOfRange *string  `json:"tag_out_of_range"` // default _timestamp_out_of_range, "" disables
+	TagOnFailure  *string  `json:"tag_on_failure"`   // default _timestamp_failure, "" disables
+	loc           *time.Location
+	maxAge        time.Duration
+	maxFuture     time.Duration
+}
+
+func newTimestampStage(config StageConfig) Stage {
+	stage := &timestampStage{}
+	decodeStageConfig(config, stage)
+	if len(stage.Fields) == 0 {
+		stage.Fields = []string{"time", "timestamp", "@timestamp", "ts"}
+	}
+	if stage.Target == "" {
+		stage.Target = "@time"
+	}
+	stage.loc = time.UTC
+	if stage.Timezone != "" {
+		loc, err := time.LoadLocation(stage.Timezone)
+		if err != nil {
+			panic(kerror.Wrap(err, "PipelineConfigInvalid", "invalid timezone", false).With("timezone", stage.Timezone))
+		}
+		stage.loc = loc
+	}
+	for _, format := range stage.Formats {
+		switch format {
+		case "epoch", "epoch_s", "epoch_ms", "epoch_us", "epoch_ns":
+		default:
+			if strings.HasPrefix(format, "epoch") {
+				panic(kerror.Create("PipelineConfigInvalid", "unknown epoch unit").With("format", format))
+			}
+		}
+	}
+	stage.maxAge = parseStageDuration(stage.MaxAge, "max_age")
+	stage.maxFuture = parseStageDuration(stage.MaxFuture, "max_future")
+	switch stage.OutOfRange {
+	case "":
+		stage.OutOfRange = "clamp"
+	case "clamp", "keep":
+	default:
+		panic(kerror.Create("PipelineConfigInvalid", "out_of_range must be clamp or keep").With("out_of_range", stage.OutOfRange))
+	}
+	if stage.TagOutOfRange == nil {
+		tag := "_timestamp_out_of_range"
+		stage.TagOutOfRange = &tag
+	}
+	if stage.TagOnFailure == nil {
+		tag := "_timestamp_failure"
+		stage.TagOnFailure = &tag
+	}
+	return stage
+}
+
+// parseStageDuration parses an optional go duration option, 0 if empty.
+func parseStageDuration(value string, option string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		panic(kerror.Create("PipelineConfigInvalid", "invalid duration").With("option", option).With("value", value))
+	}
+	return d
+}
+
+func (s *timestampStage) Process(ctx context.Context, eve *dao.EventJson) (*dao.EventJson, error) {
+	for _, field := range s.Fields {
+		value, ok := GetField(eve, field)
+		if !ok || value == nil {
+			continue
+		}
+		t, ok := ParseTimestamp(value, s.Formats, s.loc)
+		if !ok {
+			if *s.TagOnFailure != "" {
+				addTag(eve, *s.TagOnFailure)
+			}
+			return eve, nil
+		}
+		now := time.Now()
+		var limit time.Time
+		if s.maxAge > 0 && t.Before(now.Add(-s.maxAge)) {
+			limit = now.Add(-s.maxAge)
+		} else if s.maxFuture > 0 && t.After(now.Add(s.maxFuture)) {
+			limit = now.Add(s.maxFuture)
+		}
+		if !limit.IsZero() {
+			if s.OutOfRange == "clamp" {
+				t = limit
+			}
+			if *s.TagOutOfRange != "" {
+				addTag(eve, *s.TagOutOfRange)
+			}
+		}
+		var result interface{} = t.UTC().Format(time.RFC3339Nano)
+		if s.Target == "@time" {
+			result = t.UnixMilli()
+		}
+		if s.RemoveField && field != s.Target {
+			DeleteField(eve, field)
+		}
+		if err := SetField(eve, s.Target, result); err != nil {
+			return nil, fmt.Errorf("timestamp %s: %w", field, err)
+		}
+		return eve, nil
+	}
+	return eve, nil
+}
@@ -0,0 +1,262 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/xinkaiwang/hermes/internal/dao"
+	"github.com/xinkaiwang/shardmanager/libs/xklib/kerror"
+)
+
+// addStage sets fields, exp: {"type": "add", "fields": {"env": "prod"}, "overwrite": true}.
+// Existing fields are kept unless overwrite.
+type addStage struct {
+	Fields    map[string]interface{} `json:"fields"`
+	Overwrite bool                   `json:"overwrite"`
+}
+
+func newAddStage(config StageConfig) Stage {
+	stage := &addStage{}
+	decodeStageConfig(config, stage)
+	if len(stage.Fields) == 0 {
+		panic(kerror.Create("PipelineConfigInvalid", "add needs fields"))
+	}
+	return stage
+}
+
+func (s *addStage) Process(ctx context.Context, eve *dao.EventJson) (*dao.EventJson, error) {
+	for _, path := range sortedKeys(s.Fields) {
+		if _, ok := GetField(eve, path); ok && !s.Overwrite {
+			continue
+		}
+		if err := SetField(eve, path, deepCopy(s.Fields[path])); err != nil {
+			return nil, err
+		}
+	}
+	return eve, nil
+}
+
+// removeStage deletes fields, exp: {"type": "remove", "fields": ["password", "headers.cookie"]}.
+type removeStage struct {
+	Fields []string `json:"fields"`
+}
+
+func newRemoveStage(config StageConfig) Stage {
+	stage := &removeStage{}
+	decodeStageConfig(config, stage)
+	if len(stage.Fields) == 0 {
+		panic(kerror.Create("PipelineConfigInvalid", "remove needs fields"))
+	}
+	return stage
+}
+
+func (s *removeStage) Process(ctx context.Context, eve *dao.EventJson) (*dao.EventJson, error) {
+	for _, path := range s.Fields {
+		DeleteField(eve, path)
+	}
+	return eve, nil
+}
+
+// renameStage moves fields, exp: {"type": "rename", "fields": {"msg": "message"}}. Missing fields are ignored,
+// an existing target is overwritten.
+type renameStage struct {
+	Fields map[string]string `json:"fields"`
+}
+
+func newRenameStage(config StageConfig) Stage {
+	stage := &renameStage{}
+	decodeStageConfig(config, stage)
+	if len(stage.Fields) == 0 {
+		panic(kerror.Create("PipelineConfigInvalid", "rename needs fields"))
+	}
+	return stage
+}
+
+func (s *renameStage) Process(ctx context.Context, eve *dao.EventJson) (*dao.EventJson, error) {
+	for _, from := range sortedKeys(s.Fields) {
+		value, ok := GetField(eve, from)
+		if !ok {
+			continue
+		}
+		if err := SetField(eve, s.Fields[from], value); err != nil {
+			return nil, err
+		}
+		DeleteField(eve, from)
+	}
+	return eve, nil
+}
+
+// copyStage copies fields, exp: {"type": "copy", "fields": {"hostname": "@host"}}. Missing fields are ignored.
+type copyStage struct {
+	Fields map[string]string `json:"fields"`
+}
+
+func newCopyStage(config StageConfig) Stage {
+	stage := &copyStage{}
+	decodeStageConfig(config, stage)
+	if len(stage.Fields) == 0 {
+		panic(kerror.Create("PipelineConfigInvalid", "copy needs fields"))
+	}
+	return stage
+}
+
+func (s *copyStage) Process(ctx context.Context, eve *dao.EventJson) (*dao.EventJson, error) {
+	for _, from := range sortedKeys(s.Fields) {
+		value, ok := GetField(eve, from)
+		if !ok {
+			continue
+		}
+		if err := SetField(eve, s.Fields[from], deepCopy(value)); err != nil {
+			return nil, err
+		}
+	}
+	return eve, nil
+}
+
+// setMetadataStage sets EventJson metadata to fixed values, exp: {"type": "set_metadata", "index": "web"}.
+// Use copy with @host etc. to take metadata from event fields.
+type setMetadataStage struct {
+	Host       *string `json:"host"`
+	Source     *string `json:"source"`
+	SourceType *string `json:"sourcetype"`
+	Index      *string `json:"index"`
+}
+
+func newSetMetadataStage(config StageConfig) Stage {
+	stage := &setMetadataStage{}
+	decodeStageConfig(config, stage)
+	if stage.Host == nil && stage.Source == nil && stage.SourceType == nil && stage.Index == nil {
+		panic(kerror.Create("PipelineConfigInvalid", "set_metadata needs host, source, sourcetype or index"))
+	}
+	return stage
+}
+
+func (s *setMetadataStage) Process(ctx context.Context, eve *dao.EventJson) (*dao.EventJson, error) {
+	if s.Host != nil {
+		eve.Host = *s.Host
+	}
+	if s.Source != nil {
+		eve.Source = *s.Source
+	}
+	if s.SourceType != nil {
+		eve.SourceType = *s.SourceType
+	}
+	if s.Index != nil {
+		eve.Index = *s.Index
+	}
+	return eve, nil
+}
+
+// castStage converts field types, exp: {"type": "cast", "fields": {"status": "int", "ok": "bool"}}. Types are
+// int, float, string and bool. Missing fields are ignored; if any value can not be converted nothing is changed.
+type castStage struct {
+	Fields map[string]string `json:"fields"`
+}
+
+func newCastStage(config StageConfig) Stage {
+	stage := &castStage{}
+	decodeStageConfig(config, stage)
+	if len(stage.Fields) == 0 {
+		panic(kerror.Create("PipelineConfigInvalid", "cast needs fields"))
+	}
+	for path, typ := range stage.Fields {
+		switch typ {
+		case "int", "float", "string", "bool":
+		default:
+			panic(kerror.Create("PipelineConfigInvalid", "cast type must be int, float, string or bool").With("field", path).With("type", typ))
+		}
+	}
+	return stage
+}
+
+func (s *castStage) Process(ctx context.Context, eve *dao.EventJson) (*dao.EventJson, error) {
+	converted := make(map[string]interface{}, len(s.Fields))
+	for path, typ := range s.Fields {
+		value, ok := GetField(eve, path)
+		if !ok {
+			continue
+		}
+		result, err := castValue(value, typ)
+		if err != nil {
+			return nil, fmt.Errorf("cast %s: %w", path, err)
+		}
+		converted[path] = result
+	}
+	for _, path := range sortedKeys(converted) {
+		if err := SetField(eve, path, converted[path]); err != nil {
+			return nil, err
+		}
+	}
+	return eve, nil
+}
+
+// castValue converts a json value; ints are float64 without fraction, like numbers decoded from json.
+func castValue(value interface{}, typ string) (interface{}, error) {
+	switch typ {
+	case "string":
+		return valueString(value), nil
+	case "bool":
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case string:
+			return strconv.ParseBool(v)
+		}
+		if f, ok := toFloat(value); ok {
+			return f != 0, nil
+		}
+	case "int", "float":
+		var f float64
+		switch v := value.(type) {
+		case string:
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, err
+			}
+			f = parsed
+		case bool:
+			if v {
+				f = 1
+			}
+		default:
+			parsed, ok := toFloat(value)
+			if !ok {
+				return nil, fmt.Errorf("can not convert %T to %s", value, typ)
+			}
+			f = parsed
+		}
+		// json has no NaN / Inf, such values would fail the upload of the whole batch
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, fmt.Errorf("can not convert %v to %s", value, typ)
+		}
+		if typ == "int" {
+			f = math.Trunc(f)
+			if f < math.MinInt64 || f >= math.MaxInt64 {
+				return nil, fmt.Errorf("%v is out of the int range", value)
+			}
+		}
+		return f, nil
+	}
+	return nil, fmt.Errorf("can not convert %T to %s", value, typ)
+}
+
+// dropStage drops every event, use it with when: {"type": "drop", "when": {"field": "level", "equals": "debug"}}.
+type dropStage struct{}
+
+func (s *dropStage) Process(ctx context.Context, eve *dao.EventJson) (*dao.EventJson, error) {
+	return nil, nil
+}
+
+func (s *dropStage) readOnly() {}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -14,6 +15,7 @@ import (
 	"github.com/xinkaiwang/hermes/internal/biz"
 	"github.com/xinkaiwang/hermes/internal/common"
 	"github.com/xinkaiwang/hermes/internal/handler"
+	"github.com/xinkaiwang/hermes/internal/pipeline"
 	"github.com/xinkaiwang/shardmanager/libs/xklib/kcommon"
 	"github.com/xinkaiwang/shardmanager/libs/xklib/klogging"
 	"github.com/xinkaiwang/shardmanager/libs/xklib/kmetrics"
@@ -42,6 +44,9 @@ func main() {
 	registry := kmetrics.GetKmetricsRegistry()
 	metricproducer.GlobalManager().AddProducer(registry)
 
+	// 注册从事件派生的指标 (pipeline metric stage)
+	metricproducer.GlobalManager().AddProducer(pipeline.GetLogMetricsRegistry())
+
 	// 注册系统指标注册表
 	metricproducer.GlobalManager().AddProducer(ksysmetrics.GetRegistry())
 
@@ -51,6 +56,11 @@ func main() {
 	// 获取端口配置
 	apiPort := kcommon.GetEnvInt("API_PORT", 8080)
 	metricsPort := kcommon.GetEnvInt("METRICS_PORT", 9090)
+	forwardPort := kcommon.GetEnvInt("FORWARD_PORT", 0) // fluentd forward, 0 表示不启用
+	gelfUdpPort := kcommon.GetEnvInt("GELF_UDP_PORT", 0)
+	gelfTcpPort := kcommon.GetEnvInt("GELF_TCP_PORT", 0)
+	lumberjackPort := kcommon.GetEnvInt("LUMBERJACK_PORT", 0) // beats, 0 表示不启用
+	kafkaBrokers := kcommon.GetEnvString("KAFKA_BROKERS", "") // 为空表示不启用 kafka consumer
 
 	// 创建 metrics 路由
 	metricsMux := http.NewServeMux()
@@ -58,9 +68,9 @@ func main() {
 
 	// 创建主路由
 	app := biz.NewApp(ctx)
-	handler := handler.NewHandler(app)
+	apiHandler := handler.NewHandler(app)
 	mainMux := http.NewServeMux()
-	handler.RegisterRoutes(mainMux)
+	apiHandler.RegisterRoutes(mainMux)
 
 	// 创建主 HTTP 服务器
 	mainServer := &http.Server{
@@ -74,14 +84,45 @@ func main() {
 		Handler: metricsMux,
 	}
 
+	// 创建 fluentd forward 服务器 (可选)
+	var forwardServer *handler.ForwardServer
+	if forwardPort > 0 {
+		forwardServer = handler.NewForwardServer(ctx, app, fmt.Sprintf(":%d", forwardPort))
+	}
+
+	// 创建 GELF 服务器 (可选)
+	var gelfServer *handler.GelfServer
+	if gelfUdpPort > 0 || gelfTcpPort > 0 {
+		gelfServer = handler.NewGelfServer(ctx, app, portAddr(gelfUdpPort), portAddr(gelfTcpPort))
+	}
+
+	// 创建 lumberjack 服务器 (可选)
+	var lumberjackServer *handler.LumberjackServer
+	if lumberjackPort > 0 {
+		lumberjackServer = handler.NewLumberjackServer(ctx, app, portAddr(lumberjackPort))
+	}
+
+	// 创建 kafka consumer (可选)
+	var kafkaConsumer *handler.KafkaConsumer
+	if kafkaBrokers != "" {
+		kafkaConsumer = handler.NewKafkaConsumerFromEnv(ctx, app)
+	}
+
 	// 记录端口配置
 	klogging.Info(ctx).
 		With("api_port", apiPort).
 		With("metrics_port", metricsPort).
+		With("forward_port", forwardPort).
+		With("gelf_udp_port", gelfUdpPort).
+		With("gelf_tcp_port", gelfTcpPort).
+		With("lumberjack_port", lumberjackPort).
+		With("kafka_brokers", kafkaBrokers).
 		Log("ServerConfig", "Server ports configuration")
 
 	// 优雅关闭
+	shutdownDone := make(chan struct{})
 	go func() {
+		defer close(shutdownDone)
 		sigChan := make(chan os.Signal, 1)
 		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 		<-sigChan
@@ -96,6 +137,20 @@ func main() {
 		if err := metricsServer.Shutdown(ctx); err != nil {
 			klogging.Error(ctx).With("error", err).Log("MetricsServerShutdownError", "Metrics server shutdown error")
 		}
+		if forwardServer != nil {
+			forwardServer.Shutdown()
+		}
+		if gelfServer != nil {
+			gelfServer.Shutdown()
+		}
+		if lumberjackServer != nil {
+			lumberjackServer.Shutdown()
+		}
+		if kafkaConsumer != nil {
+			kafkaConsumer.Shutdown()
+		}
+		// 输入都已关闭, 上传剩余事件并关闭输出
+		app.Close()
 	}()
 
 	// 启动 metrics 服务器
@@ -106,10 +161,58 @@ func main() {
 		}
 	}()
 
+	// 启动 forward 服务器
+	if forwardServer != nil {
+		go func() {
+			klogging.Info(ctx).With("addr", forwardServer.Addr()).Log("ForwardServerStarting", "Forward server starting")
+			if err := forwardServer.ListenAndServe(); err != net.ErrClosed {
+				klogging.Error(ctx).With("error", err).Log("ForwardServerError", "Forward server error")
+			}
+		}()
+	}
+
+	// 启动 GELF 服务器
+	if gelfServer != nil {
+		go func() {
+			klogging.Info(ctx).With("udpPort", gelfUdpPort).With("tcpPort", gelfTcpPort).Log("GelfServerStarting", "GELF server starting")
+			if err := gelfServer.ListenAndServe(); err != net.ErrClosed {
+				klogging.Error(ctx).With("error", err).Log("GelfServerError", "GELF server error")
+			}
+		}()
+	}
+
+	// 启动 lumberjack 服务器
+	if lumberjackServer != nil {
+		go func() {
+			klogging.Info(ctx).With("addr", lumberjackServer.Addr()).With("tls", lumberjackServer.IsTls()).Log("LumberjackServerStarting", "Lumberjack server starting")
+			if err := lumberjackServer.ListenAndServe(); err != net.ErrClosed {
+				klogging.Error(ctx).With("error", err).Log("LumberjackServerError", "Lumberjack server error")
+			}
+		}()
+	}
+
+	// 启动 kafka consumer
+	if kafkaConsumer != nil {
+		go func() {
+			klogging.Info(ctx).With("brokers", kafkaBrokers).Log("KafkaConsumerStarting", "Kafka consumer starting")
+			kafkaConsumer.Run()
+		}()
+	}
+
 	// 启动主服务器
 	klogging.Info(ctx).With("addr", mainServer.Addr).Log("MainServerStarting", "Main server starting")
 	if err := mainServer.ListenAndServe(); err != http.ErrServerClosed {
 		klogging.Error(ctx).With("error", err).Log("MainServerError", "Main server error")
+	} else {
+		<-shutdownDone
 	}
 	klogging.Info(ctx).Log("ServerShutdown", "Servers stopped")
 }
+
+// portAddr 把端口转换为监听地址, 0 表示不启用 (返回空字符串)
+func portAddr(port int) string {
+	if port <= 0 {
+		return ""
+	}
+	return fmt.Sprintf(":%d", port)
+}